@@ -2,19 +2,130 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"time"
+
+	redisCache "github.com/aniladanir/auto-messender-service/internal/cache/redis"
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
+	"github.com/aniladanir/auto-messender-service/internal/service"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultWebhookTimeout  = time.Second * 5
+	defaultShutdownTimeout = time.Second * 5
+	defaultLeaderInterval  = time.Second * 5
+	envPrefix              = "AMS_"
 )
 
 type Config struct {
-	HttpPort           int           `json:"http_port"`
-	DbConnString       string        `json:"db_conn_string"`
-	RedisAddr          string        `json:"redis_addr"`
-	WebHookUrl         string        `json:"webhook_url"`
-	MsgBatchSize       int           `json:"msg_batch_size"`
-	MsgSendIntervalStr string        `json:"msg_send_interval"`
-	MsgSendInterval    time.Duration `json:"-"`
-	MsgMaxRetry        int           `json:"msg_max_retry"`
+	HttpPort                     int               `json:"http_port"`
+	APIKey                       string            `json:"api_key"`
+	TLSCertFile                  string            `json:"tls_cert_file"`
+	TLSKeyFile                   string            `json:"tls_key_file"`
+	CorsAllowedOrigins           []string          `json:"cors_allowed_origins"`
+	CorsAllowedMethods           []string          `json:"cors_allowed_methods"`
+	CorsAllowedHeaders           []string          `json:"cors_allowed_headers"`
+	ShutdownTimeoutStr           string            `json:"shutdown_timeout"`
+	ShutdownTimeout              time.Duration     `json:"-"`
+	LogFormat                    string            `json:"log_format"`
+	LogLevel                     string            `json:"log_level"`
+	LogFile                      string            `json:"log_file"`
+	LogMaxSize                   int               `json:"log_max_size"`
+	LogMaxAge                    int               `json:"log_max_age"`
+	LogMaxBackups                int               `json:"log_max_backups"`
+	OtlpEndpoint                 string            `json:"otlp_endpoint"`
+	DbDriver                     string            `json:"db_driver"`
+	DbConnString                 string            `json:"db_conn_string"`
+	RunMigrations                *bool             `json:"run_migrations"`
+	DbConnectRetries             int               `json:"db_connect_retries"`
+	DbConnectRetryIntervalStr    string            `json:"db_connect_retry_interval"`
+	DbConnectRetryInterval       time.Duration     `json:"-"`
+	DbMaxOpenConns               int               `json:"db_max_open_conns"`
+	DbMaxIdleConns               int               `json:"db_max_idle_conns"`
+	DbConnMaxLifetimeStr         string            `json:"db_conn_max_lifetime"`
+	DbConnMaxLifetime            time.Duration     `json:"-"`
+	DbTxRetries                  int               `json:"db_tx_retries"`
+	DbTxRetryIntervalStr         string            `json:"db_tx_retry_interval"`
+	DbTxRetryInterval            time.Duration     `json:"-"`
+	DbInsertBatchSize            int               `json:"db_insert_batch_size"`
+	RedisAddr                    string            `json:"redis_addr"`
+	RedisMode                    string            `json:"redis_mode"`
+	RedisAddrs                   []string          `json:"redis_addrs"`
+	RedisMasterName              string            `json:"redis_master_name"`
+	RedisPassword                string            `json:"redis_password"`
+	RedisDB                      int               `json:"redis_db"`
+	RedisConnectRetries          int               `json:"redis_connect_retries"`
+	RedisConnectRetryIntervalStr string            `json:"redis_connect_retry_interval"`
+	RedisConnectRetryInterval    time.Duration     `json:"-"`
+	RedisMaxRetries              int               `json:"redis_max_retries"`
+	RedisDialTimeoutStr          string            `json:"redis_dial_timeout"`
+	RedisDialTimeout             time.Duration     `json:"-"`
+	RedisReadTimeoutStr          string            `json:"redis_read_timeout"`
+	RedisReadTimeout             time.Duration     `json:"-"`
+	RedisWriteTimeoutStr         string            `json:"redis_write_timeout"`
+	RedisWriteTimeout            time.Duration     `json:"-"`
+	RedisEventChannel            string            `json:"redis_event_channel"`
+	RedisPoolSize                int               `json:"redis_pool_size"`
+	WebHookUrl                   string            `json:"webhook_url"`
+	WebhookURLs                  []string          `json:"webhook_urls"`
+	MsgBatchSize                 int               `json:"msg_batch_size"`
+	MsgSendIntervalStr           string            `json:"msg_send_interval"`
+	MsgSendInterval              time.Duration     `json:"-"`
+	MsgMaxRetry                  int               `json:"msg_max_retry"`
+	RetryBaseDelayStr            string            `json:"retry_base_delay"`
+	RetryBaseDelay               time.Duration     `json:"-"`
+	RetryMaxDelayStr             string            `json:"retry_max_delay"`
+	RetryMaxDelay                time.Duration     `json:"-"`
+	RetryMultiplier              int               `json:"retry_multiplier"`
+	RetryJitter                  *bool             `json:"retry_jitter"`
+	StaleTimeoutStr              string            `json:"stale_message_timeout"`
+	StaleTimeout                 time.Duration     `json:"-"`
+	SuccessStatusCodes           []int             `json:"success_status_codes"`
+	DrainTimeoutStr              string            `json:"drain_timeout"`
+	DrainTimeout                 time.Duration     `json:"-"`
+	MaxConcurrency               int               `json:"max_concurrency"`
+	RateLimit                    float64           `json:"rate_limit"`
+	RateLimitBurst               int               `json:"rate_limit_burst"`
+	BreakerFailures              uint32            `json:"circuit_breaker_failures"`
+	BreakerCooldownStr           string            `json:"circuit_breaker_cooldown"`
+	BreakerCooldown              time.Duration     `json:"-"`
+	MaxCreateBatchSize           int               `json:"max_create_batch_size"`
+	DefaultCountryCode           string            `json:"default_country_code"`
+	MaxResponseSize              int64             `json:"max_response_size"`
+	ErrorSnippetSize             int               `json:"error_snippet_size"`
+	DedupeWindowStr              string            `json:"dedupe_window"`
+	DedupeWindow                 time.Duration     `json:"-"`
+	MessageTimeoutStr            string            `json:"message_timeout"`
+	MessageTimeout               time.Duration     `json:"-"`
+	BatchTimeoutStr              string            `json:"batch_timeout"`
+	BatchTimeout                 time.Duration     `json:"-"`
+	ProcessingLeaseTTLStr        string            `json:"processing_lease_ttl"`
+	ProcessingLeaseTTL           time.Duration     `json:"-"`
+	DryRun                       bool              `json:"dry_run"`
+	LeaderElection               bool              `json:"leader_election"`
+	LeaderElectionIntervalStr    string            `json:"leader_election_interval"`
+	LeaderElectionInterval       time.Duration     `json:"-"`
+	WebhookSigningSecret         string            `json:"webhook_signing_secret"`
+	WebhookHeaders               map[string]string `json:"webhook_headers"`
+	WebhookUserAgent             string            `json:"webhook_user_agent"`
+	PayloadTemplate              string            `json:"payload_template"`
+	WebhookTimeoutStr            string            `json:"webhook_timeout"`
+	WebhookTimeout               time.Duration     `json:"-"`
+	WebhookMaxRedirects          int               `json:"webhook_max_redirects"`
+	WebhookMaxIdleConns          int               `json:"webhook_max_idle_conns"`
+	WebhookMaxIdleConnsPerHost   int               `json:"webhook_max_idle_conns_per_host"`
+	WebhookIdleConnTimeoutStr    string            `json:"webhook_idle_conn_timeout"`
+	WebhookIdleConnTimeout       time.Duration     `json:"-"`
+	CompressPayload              bool              `json:"compress_payload"`
+	CompressMinSize              int               `json:"compress_min_size"`
 }
 
 // ReadConfigJson reads json formatted configuration from the given file
@@ -30,10 +141,368 @@ func ReadConfigJson(configFile string) (*Config, error) {
 		return nil, err
 	}
 
-	cfg.MsgSendInterval, err = time.ParseDuration(cfg.MsgSendIntervalStr)
+	return cfg, cfg.load()
+}
+
+// ReadConfigYaml reads the config from a yaml file using the same keys as the json config
+func ReadConfigYaml(configFile string) (*Config, error) {
+	content, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	return cfg, nil
+	// decode yaml into generic values and re-encode them as json to reuse the json keys of the config
+	var raw any
+	if err = yaml.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	if content, err = json.Marshal(raw); err != nil {
+		return nil, err
+	}
+
+	cfg := new(Config)
+
+	if err = json.Unmarshal(content, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.load()
+}
+
+// ReadConfig reads the config file as yaml or json depending on its extension
+func ReadConfig(configFile string) (*Config, error) {
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yaml", ".yml":
+		return ReadConfigYaml(configFile)
+	default:
+		return ReadConfigJson(configFile)
+	}
+}
+
+// load applies environment overrides and parses the duration values of the config
+func (cfg *Config) load() (err error) {
+	if err = cfg.overrideFromEnv(); err != nil {
+		return err
+	}
+
+	cfg.DefaultCountryCode = strings.ToUpper(cfg.DefaultCountryCode)
+
+	cfg.MsgSendInterval, err = time.ParseDuration(cfg.MsgSendIntervalStr)
+	if err != nil {
+		return err
+	}
+
+	if cfg.DbConnectRetryIntervalStr != "" {
+		cfg.DbConnectRetryInterval, err = time.ParseDuration(cfg.DbConnectRetryIntervalStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.RedisConnectRetryIntervalStr != "" {
+		cfg.RedisConnectRetryInterval, err = time.ParseDuration(cfg.RedisConnectRetryIntervalStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.RedisDialTimeoutStr != "" {
+		cfg.RedisDialTimeout, err = time.ParseDuration(cfg.RedisDialTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.RedisReadTimeoutStr != "" {
+		cfg.RedisReadTimeout, err = time.ParseDuration(cfg.RedisReadTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.RedisWriteTimeoutStr != "" {
+		cfg.RedisWriteTimeout, err = time.ParseDuration(cfg.RedisWriteTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.DbTxRetryIntervalStr != "" {
+		cfg.DbTxRetryInterval, err = time.ParseDuration(cfg.DbTxRetryIntervalStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.DbConnMaxLifetimeStr != "" {
+		cfg.DbConnMaxLifetime, err = time.ParseDuration(cfg.DbConnMaxLifetimeStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg.LeaderElectionInterval = defaultLeaderInterval
+	if cfg.LeaderElectionIntervalStr != "" {
+		cfg.LeaderElectionInterval, err = time.ParseDuration(cfg.LeaderElectionIntervalStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.RedisMode == "" {
+		cfg.RedisMode = redisCache.ModeSingle
+	}
+
+	if cfg.DbDriver == "" {
+		cfg.DbDriver = persistant.DriverPostgres
+	}
+
+	cfg.ShutdownTimeout = defaultShutdownTimeout
+	if cfg.ShutdownTimeoutStr != "" {
+		cfg.ShutdownTimeout, err = time.ParseDuration(cfg.ShutdownTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg.WebhookTimeout = defaultWebhookTimeout
+	if cfg.WebhookTimeoutStr != "" {
+		cfg.WebhookTimeout, err = time.ParseDuration(cfg.WebhookTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.RetryBaseDelayStr != "" {
+		cfg.RetryBaseDelay, err = time.ParseDuration(cfg.RetryBaseDelayStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.RetryMaxDelayStr != "" {
+		cfg.RetryMaxDelay, err = time.ParseDuration(cfg.RetryMaxDelayStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.RunMigrations == nil {
+		runMigrations := true
+		cfg.RunMigrations = &runMigrations
+	}
+
+	if cfg.RetryJitter == nil {
+		jitter := true
+		cfg.RetryJitter = &jitter
+	}
+
+	if cfg.BreakerCooldownStr != "" {
+		cfg.BreakerCooldown, err = time.ParseDuration(cfg.BreakerCooldownStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.MessageTimeoutStr != "" {
+		cfg.MessageTimeout, err = time.ParseDuration(cfg.MessageTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.WebhookIdleConnTimeoutStr != "" {
+		cfg.WebhookIdleConnTimeout, err = time.ParseDuration(cfg.WebhookIdleConnTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.ProcessingLeaseTTLStr != "" {
+		cfg.ProcessingLeaseTTL, err = time.ParseDuration(cfg.ProcessingLeaseTTLStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.BatchTimeoutStr != "" {
+		cfg.BatchTimeout, err = time.ParseDuration(cfg.BatchTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.DedupeWindowStr != "" {
+		cfg.DedupeWindow, err = time.ParseDuration(cfg.DedupeWindowStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.StaleTimeoutStr != "" {
+		cfg.StaleTimeout, err = time.ParseDuration(cfg.StaleTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.DrainTimeoutStr != "" {
+		cfg.DrainTimeout, err = time.ParseDuration(cfg.DrainTimeoutStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the config for missing or invalid values and reports all of them at once
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.HttpPort <= 0 || cfg.HttpPort > 65535 {
+		errs = append(errs, fmt.Errorf("http_port must be between 1 and 65535, got %d", cfg.HttpPort))
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		errs = append(errs, errors.New("tls_cert_file and tls_key_file must be set together"))
+	}
+	for _, f := range []string{cfg.TLSCertFile, cfg.TLSKeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			errs = append(errs, fmt.Errorf("tls file %q is not accessible: %w", f, err))
+		}
+	}
+	if cfg.DbConnString == "" {
+		errs = append(errs, errors.New("db_conn_string is required"))
+	}
+	if err := persistant.ValidateDriver(cfg.DbDriver); err != nil {
+		errs = append(errs, fmt.Errorf("db_driver: %w", err))
+	}
+	if cfg.LeaderElection && cfg.DbDriver != persistant.DriverPostgres {
+		errs = append(errs, errors.New("leader_election requires the postgres db_driver"))
+	}
+	switch cfg.RedisMode {
+	case redisCache.ModeSingle:
+		// redis_addrs is ignored in single mode, so it alone would connect to an empty address
+		if cfg.RedisAddr == "" && len(cfg.RedisAddrs) > 0 {
+			errs = append(errs, errors.New("redis single mode requires redis_addr, redis_addrs is only used in sentinel and cluster modes"))
+		}
+	case redisCache.ModeSentinel:
+		if cfg.RedisMasterName == "" || len(cfg.RedisAddrs) == 0 {
+			errs = append(errs, errors.New("redis sentinel mode requires redis_master_name and redis_addrs"))
+		}
+	case redisCache.ModeCluster:
+		if len(cfg.RedisAddrs) == 0 {
+			errs = append(errs, errors.New("redis cluster mode requires redis_addrs"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("redis_mode must be single, sentinel or cluster, got %q", cfg.RedisMode))
+	}
+	if cfg.RedisEventChannel != "" && cfg.RedisAddr == "" && len(cfg.RedisAddrs) == 0 {
+		errs = append(errs, errors.New("redis_event_channel requires redis_addr or redis_addrs"))
+	}
+	if err := validateWebhookURL(cfg.WebHookUrl); err != nil {
+		errs = append(errs, fmt.Errorf("webhook_url %w", err))
+	}
+	for _, u := range cfg.WebhookURLs {
+		if err := validateWebhookURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("webhook_urls entry %q %w", u, err))
+		}
+	}
+	if cfg.MsgBatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("msg_batch_size must be positive, got %d", cfg.MsgBatchSize))
+	}
+	if cfg.MsgSendInterval <= 0 {
+		errs = append(errs, fmt.Errorf("msg_send_interval must be positive, got %s", cfg.MsgSendInterval))
+	}
+	if cfg.MsgMaxRetry < 0 {
+		errs = append(errs, fmt.Errorf("msg_max_retry must not be negative, got %d", cfg.MsgMaxRetry))
+	}
+	if cfg.LeaderElectionInterval <= 0 {
+		errs = append(errs, fmt.Errorf("leader_election_interval must be positive, got %s", cfg.LeaderElectionInterval))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout must be positive, got %s", cfg.ShutdownTimeout))
+	}
+	if cfg.DrainTimeout > 0 && cfg.DrainTimeout >= cfg.ShutdownTimeout {
+		errs = append(errs, fmt.Errorf("drain_timeout must be less than shutdown_timeout, got %s", cfg.DrainTimeout))
+	}
+	if cfg.WebhookTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("webhook_timeout must be positive, got %s", cfg.WebhookTimeout))
+	}
+	if cfg.ProcessingLeaseTTL < 0 {
+		errs = append(errs, fmt.Errorf("processing_lease_ttl must not be negative, got %s", cfg.ProcessingLeaseTTL))
+	}
+	if cfg.ProcessingLeaseTTL > 0 {
+		// leases are kept in redis, the in-memory cache isn't shared with the other instances
+		if cfg.RedisAddr == "" && len(cfg.RedisAddrs) == 0 {
+			errs = append(errs, errors.New("processing_lease_ttl requires redis_addr or redis_addrs"))
+		}
+		if minTTL := max(service.MinProcessingLeaseTTL, cfg.MessageTimeout); cfg.ProcessingLeaseTTL < minTTL {
+			errs = append(errs, fmt.Errorf("processing_lease_ttl must be at least %s, got %s", minTTL, cfg.ProcessingLeaseTTL))
+		}
+	}
+	if cfg.WebhookMaxRedirects < 0 {
+		errs = append(errs, fmt.Errorf("webhook_max_redirects must not be negative, got %d", cfg.WebhookMaxRedirects))
+	}
+	if cfg.DefaultCountryCode != "" && !domain.IsSupportedRegion(cfg.DefaultCountryCode) {
+		errs = append(errs, fmt.Errorf("default_country_code must be a known ISO 3166-1 alpha-2 region code, got %q", cfg.DefaultCountryCode))
+	}
+	if cfg.DbInsertBatchSize < 0 {
+		errs = append(errs, fmt.Errorf("db_insert_batch_size must not be negative, got %d", cfg.DbInsertBatchSize))
+	}
+	if cfg.LogMaxSize < 0 || cfg.LogMaxAge < 0 || cfg.LogMaxBackups < 0 {
+		errs = append(errs, errors.New("log_max_size, log_max_age and log_max_backups must not be negative"))
+	}
+	if (cfg.LogMaxAge > 0 || cfg.LogMaxBackups > 0) && cfg.LogMaxSize == 0 {
+		errs = append(errs, errors.New("log_max_age and log_max_backups require log_max_size"))
+	}
+	if cfg.LogMaxSize > 0 && (cfg.LogFile == "" || cfg.LogFile == "stdout" || cfg.LogFile == "stderr") {
+		errs = append(errs, errors.New("log_max_size requires log_file to be a file"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateWebhookURL checks that the given url is an absolute http or https url
+func validateWebhookURL(rawURL string) error {
+	if rawURL == "" {
+		return errors.New("is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an absolute http or https url")
+	}
+	return nil
+}
+
+// overrideFromEnv overwrites config fields with environment variables named after their json keys,
+// e.g. AMS_DB_CONN_STRING overrides db_conn_string. Non-string values are decoded as json.
+func (cfg *Config) overrideFromEnv() error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := range t.NumField() {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		envKey := envPrefix + strings.ToUpper(key)
+		val, ok := os.LookupEnv(envKey)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(val)
+			continue
+		}
+		if err := json.Unmarshal([]byte(val), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", envKey, err)
+		}
+	}
+
+	return nil
 }
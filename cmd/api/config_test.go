@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readShippedConfig reads the config file that is shipped with the service
+func readShippedConfig(t *testing.T) *Config {
+	t.Helper()
+
+	cfg, err := ReadConfig("../../config.json")
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	return cfg
+}
+
+func TestShippedConfigIsValid(t *testing.T) {
+	if err := readShippedConfig(t).Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestValidateDrainTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		drain   time.Duration
+		wantErr bool
+	}{
+		{name: "disabled", drain: 0},
+		{name: "less than shutdown timeout", drain: 4 * time.Second},
+		{name: "equal to shutdown timeout", drain: 5 * time.Second, wantErr: true},
+		{name: "exceeds shutdown timeout", drain: 10 * time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := readShippedConfig(t)
+			cfg.ShutdownTimeout = 5 * time.Second
+			cfg.DrainTimeout = tt.drain
+
+			err := cfg.Validate()
+			if got := err != nil && strings.Contains(err.Error(), "drain_timeout"); got != tt.wantErr {
+				t.Errorf("Validate() error = %v, want drain_timeout error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	t.Setenv("AMS_DB_CONN_STRING", "postgres://env@db/messenger")
+	t.Setenv("AMS_REDIS_ADDR", "env-redis:6379")
+	t.Setenv("AMS_WEBHOOK_URL", "https://env.example.com/hook")
+	t.Setenv("AMS_MSG_BATCH_SIZE", "7")
+	t.Setenv("AMS_MSG_SEND_INTERVAL", "30s")
+	t.Setenv("AMS_SUCCESS_STATUS_CODES", "[200,202]")
+
+	cfg := readShippedConfig(t)
+
+	if cfg.DbConnString != "postgres://env@db/messenger" {
+		t.Errorf("db_conn_string = %q, want the env value", cfg.DbConnString)
+	}
+	if cfg.RedisAddr != "env-redis:6379" {
+		t.Errorf("redis_addr = %q, want the env value", cfg.RedisAddr)
+	}
+	if cfg.WebHookUrl != "https://env.example.com/hook" {
+		t.Errorf("webhook_url = %q, want the env value", cfg.WebHookUrl)
+	}
+	if cfg.MsgBatchSize != 7 {
+		t.Errorf("msg_batch_size = %d, want 7", cfg.MsgBatchSize)
+	}
+	if cfg.MsgSendInterval != 30*time.Second {
+		t.Errorf("msg_send_interval = %s, want 30s", cfg.MsgSendInterval)
+	}
+	if !slices.Equal(cfg.SuccessStatusCodes, []int{200, 202}) {
+		t.Errorf("success_status_codes = %v, want [200 202]", cfg.SuccessStatusCodes)
+	}
+	// values without an env variable are read from the file
+	if cfg.HttpPort != 6060 {
+		t.Errorf("http_port = %d, want the file value 6060", cfg.HttpPort)
+	}
+}
+
+func TestDefaultCountryCodeIsCaseInsensitive(t *testing.T) {
+	t.Setenv("AMS_DEFAULT_COUNTRY_CODE", "tr")
+
+	cfg := readShippedConfig(t)
+	if cfg.DefaultCountryCode != "TR" {
+		t.Errorf("default_country_code = %q, want %q", cfg.DefaultCountryCode, "TR")
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestEnvOverrideWithInvalidValue(t *testing.T) {
+	t.Setenv("AMS_MSG_BATCH_SIZE", "ten")
+
+	if _, err := ReadConfig("../../config.json"); err == nil || !strings.Contains(err.Error(), "AMS_MSG_BATCH_SIZE") {
+		t.Errorf("ReadConfig() error = %v, want an error naming AMS_MSG_BATCH_SIZE", err)
+	}
+}
+
+func TestValidateInvalidFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		wantErr string
+	}{
+		{name: "zero http port", modify: func(cfg *Config) { cfg.HttpPort = 0 }, wantErr: "http_port"},
+		{name: "http port out of range", modify: func(cfg *Config) { cfg.HttpPort = 70000 }, wantErr: "http_port"},
+		{name: "tls cert without key", modify: func(cfg *Config) { cfg.TLSCertFile = "cert.pem" }, wantErr: "tls_cert_file and tls_key_file"},
+		{name: "missing tls files", modify: func(cfg *Config) { cfg.TLSCertFile, cfg.TLSKeyFile = "missing.pem", "missing.key" }, wantErr: "tls file"},
+		{name: "empty db conn string", modify: func(cfg *Config) { cfg.DbConnString = "" }, wantErr: "db_conn_string"},
+		{name: "unknown db driver", modify: func(cfg *Config) { cfg.DbDriver = "mysql" }, wantErr: "db_driver"},
+		{name: "unknown redis mode", modify: func(cfg *Config) { cfg.RedisMode = "replica" }, wantErr: "redis_mode"},
+		{name: "single mode with only redis addrs", modify: func(cfg *Config) { cfg.RedisAddr, cfg.RedisAddrs = "", []string{"redis:6379"} }, wantErr: "redis single mode requires redis_addr"},
+		{name: "sentinel without master", modify: func(cfg *Config) { cfg.RedisMode = "sentinel" }, wantErr: "redis sentinel mode"},
+		{name: "empty webhook url", modify: func(cfg *Config) { cfg.WebHookUrl = "" }, wantErr: "webhook_url is required"},
+		{name: "relative webhook url", modify: func(cfg *Config) { cfg.WebHookUrl = "/hook" }, wantErr: "webhook_url must be an absolute"},
+		{name: "non http webhook url", modify: func(cfg *Config) { cfg.WebHookUrl = "ftp://example.com" }, wantErr: "webhook_url must be an absolute"},
+		{name: "invalid fallback webhook url", modify: func(cfg *Config) { cfg.WebhookURLs = []string{"example.com"} }, wantErr: "webhook_urls"},
+		{name: "zero batch size", modify: func(cfg *Config) { cfg.MsgBatchSize = 0 }, wantErr: "msg_batch_size"},
+		{name: "zero send interval", modify: func(cfg *Config) { cfg.MsgSendInterval = 0 }, wantErr: "msg_send_interval"},
+		{name: "negative max retry", modify: func(cfg *Config) { cfg.MsgMaxRetry = -1 }, wantErr: "msg_max_retry"},
+		{name: "zero shutdown timeout", modify: func(cfg *Config) { cfg.ShutdownTimeout = 0 }, wantErr: "shutdown_timeout"},
+		{name: "zero webhook timeout", modify: func(cfg *Config) { cfg.WebhookTimeout = 0 }, wantErr: "webhook_timeout"},
+		{name: "negative lease ttl", modify: func(cfg *Config) { cfg.ProcessingLeaseTTL = -time.Second }, wantErr: "processing_lease_ttl"},
+		{name: "lease ttl without redis", modify: func(cfg *Config) { cfg.ProcessingLeaseTTL, cfg.RedisAddr, cfg.RedisAddrs = time.Minute, "", nil }, wantErr: "processing_lease_ttl requires redis"},
+		{name: "lease ttl below a second", modify: func(cfg *Config) { cfg.ProcessingLeaseTTL = time.Nanosecond }, wantErr: "processing_lease_ttl must be at least 1s"},
+		{name: "lease ttl below message timeout", modify: func(cfg *Config) { cfg.ProcessingLeaseTTL, cfg.MessageTimeout = 5*time.Second, 10*time.Second }, wantErr: "processing_lease_ttl must be at least 10s"},
+		{name: "negative max redirects", modify: func(cfg *Config) { cfg.WebhookMaxRedirects = -1 }, wantErr: "webhook_max_redirects"},
+		{name: "unknown country code", modify: func(cfg *Config) { cfg.DefaultCountryCode = "XX" }, wantErr: "default_country_code"},
+		{name: "negative insert batch size", modify: func(cfg *Config) { cfg.DbInsertBatchSize = -1 }, wantErr: "db_insert_batch_size"},
+		{name: "log rotation without file", modify: func(cfg *Config) { cfg.LogMaxSize = 10 }, wantErr: "log_max_size requires log_file"},
+		{name: "log backups without size", modify: func(cfg *Config) { cfg.LogFile, cfg.LogMaxBackups = "service.log", 3 }, wantErr: "require log_max_size"},
+		{name: "negative log max age", modify: func(cfg *Config) { cfg.LogFile, cfg.LogMaxSize, cfg.LogMaxAge = "service.log", 10, -1 }, wantErr: "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := readShippedConfig(t)
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateAggregatesErrors(t *testing.T) {
+	cfg := readShippedConfig(t)
+	cfg.MsgBatchSize = 0
+	cfg.WebHookUrl = ""
+	cfg.MsgMaxRetry = -1
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() error = nil, want error")
+	}
+	for _, want := range []string{"msg_batch_size", "webhook_url", "msg_max_retry"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error = %v, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestYamlAndJsonConfigsAreEquivalent(t *testing.T) {
+	const jsonConfig = `{
+    "http_port": 6060,
+    "db_conn_string": "postgres://postgres:postgres@db:5432/messenger?sslmode=disable",
+    "run_migrations": false,
+    "redis_addr": "redis:6379",
+    "webhook_url": "https://example.com/hook",
+    "webhook_urls": ["https://fallback.example.com/hook"],
+    "webhook_headers": {"Authorization": "Bearer token"},
+    "webhook_timeout": "5s",
+    "msg_batch_size": 2,
+    "msg_send_interval": "2m",
+    "msg_max_retry": 10,
+    "retry_jitter": true,
+    "success_status_codes": [200, 202],
+    "drain_timeout": "10s"
+}`
+	const yamlConfig = `# equivalent of the json config
+http_port: 6060
+db_conn_string: "postgres://postgres:postgres@db:5432/messenger?sslmode=disable"
+run_migrations: false
+redis_addr: redis:6379
+webhook_url: https://example.com/hook
+webhook_urls:
+  - https://fallback.example.com/hook
+webhook_headers:
+  Authorization: Bearer token
+webhook_timeout: 5s
+msg_batch_size: 2
+msg_send_interval: 2m
+msg_max_retry: 10
+retry_jitter: true
+success_status_codes: [200, 202]
+drain_timeout: 10s
+`
+	dir := t.TempDir()
+	jsonFile, yamlFile := filepath.Join(dir, "config.json"), filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(jsonFile, []byte(jsonConfig), 0o600); err != nil {
+		t.Fatalf("failed to write json config: %v", err)
+	}
+	if err := os.WriteFile(yamlFile, []byte(yamlConfig), 0o600); err != nil {
+		t.Fatalf("failed to write yaml config: %v", err)
+	}
+
+	fromJson, err := ReadConfig(jsonFile)
+	if err != nil {
+		t.Fatalf("ReadConfig() of json error = %v", err)
+	}
+	fromYaml, err := ReadConfig(yamlFile)
+	if err != nil {
+		t.Fatalf("ReadConfig() of yaml error = %v", err)
+	}
+
+	if !reflect.DeepEqual(fromJson, fromYaml) {
+		t.Errorf("yaml config = %+v, want the json config %+v", fromYaml, fromJson)
+	}
+	if fromYaml.MsgSendInterval != 2*time.Minute || fromYaml.DrainTimeout != 10*time.Second {
+		t.Errorf("yaml durations = %s and %s, want 2m and 10s", fromYaml.MsgSendInterval, fromYaml.DrainTimeout)
+	}
+}
+
+func TestRunMigrationsDefaultsToTrue(t *testing.T) {
+	data, err := os.ReadFile("../../config.json")
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	dir := t.TempDir()
+	for name, tt := range map[string]struct {
+		set  func(fields map[string]any)
+		want bool
+	}{
+		"omitted":  {set: func(fields map[string]any) { delete(fields, "run_migrations") }, want: true},
+		"disabled": {set: func(fields map[string]any) { fields["run_migrations"] = false }, want: false},
+	} {
+		var fields map[string]any
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("failed to decode config: %v", err)
+		}
+		tt.set(fields)
+		modified, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatalf("failed to encode config: %v", err)
+		}
+		file := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(file, modified, 0o600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+
+		cfg, err := ReadConfig(file)
+		if err != nil {
+			t.Fatalf("ReadConfig() error = %v", err)
+		}
+		if *cfg.RunMigrations != tt.want {
+			t.Errorf("run_migrations of %s config = %t, want %t", name, *cfg.RunMigrations, tt.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// newLogger creates a logger with the handler format and level given in the configuration
+func newLogger(config *Config) (logger *slog.Logger, closeLog func(), err error) {
+	opts := &slog.HandlerOptions{}
+	if config.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+			return nil, nil, fmt.Errorf("invalid log level %q: %w", config.LogLevel, err)
+		}
+		opts.Level = level
+	}
+
+	out, closeLog, err := openLogOutput(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch config.LogFormat {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(out, opts)), closeLog, nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, opts)), closeLog, nil
+	default:
+		closeLog()
+		return nil, nil, fmt.Errorf("invalid log format %q, must be text or json", config.LogFormat)
+	}
+}
+
+// openLogOutput opens the destination of the logs, which is stdout, stderr or a file the logs are appended to.
+// The file is rotated once it reaches the configured size. The returned function syncs and closes the file.
+func openLogOutput(config *Config) (io.Writer, func(), error) {
+	switch config.LogFile {
+	case "", "stdout":
+		return os.Stdout, func() {}, nil
+	case "stderr":
+		return os.Stderr, func() {}, nil
+	}
+
+	if config.LogMaxSize > 0 {
+		w := &lumberjack.Logger{
+			Filename:   config.LogFile,
+			MaxSize:    config.LogMaxSize,
+			MaxAge:     config.LogMaxAge,
+			MaxBackups: config.LogMaxBackups,
+			LocalTime:  true,
+		}
+		return w, func() { w.Close() }, nil
+	}
+
+	f, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return f, func() {
+		f.Sync()
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLoggerFormat(t *testing.T) {
+	for _, format := range []string{"", "text", "json", "xml"} {
+		logger, closeLog, err := newLogger(&Config{LogFormat: format})
+		if format == "xml" {
+			if err == nil {
+				t.Errorf("newLogger() with format %q error = nil, want error", format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("newLogger() with format %q error = %v", format, err)
+		}
+		closeLog()
+
+		switch logger.Handler().(type) {
+		case *slog.JSONHandler:
+			if format != "json" {
+				t.Errorf("format %q uses json handler, want text", format)
+			}
+		case *slog.TextHandler:
+			if format == "json" {
+				t.Errorf("format %q uses text handler, want json", format)
+			}
+		default:
+			t.Errorf("format %q uses handler %T", format, logger.Handler())
+		}
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	tests := []struct {
+		level       string
+		wantEnabled slog.Level
+		wantOff     slog.Level
+		wantErr     bool
+	}{
+		{level: "", wantEnabled: slog.LevelInfo, wantOff: slog.LevelDebug},
+		{level: "debug", wantEnabled: slog.LevelDebug, wantOff: slog.LevelDebug - 1},
+		{level: "warn", wantEnabled: slog.LevelWarn, wantOff: slog.LevelInfo},
+		{level: "ERROR", wantEnabled: slog.LevelError, wantOff: slog.LevelWarn},
+		{level: "verbose", wantErr: true},
+	}
+	for _, tt := range tests {
+		logger, closeLog, err := newLogger(&Config{LogLevel: tt.level})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newLogger() with level %q error = nil, want error", tt.level)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("newLogger() with level %q error = %v", tt.level, err)
+		}
+		closeLog()
+
+		if !logger.Enabled(context.Background(), tt.wantEnabled) {
+			t.Errorf("level %q filters %s logs", tt.level, tt.wantEnabled)
+		}
+		if logger.Enabled(context.Background(), tt.wantOff) {
+			t.Errorf("level %q doesn't filter %s logs", tt.level, tt.wantOff)
+		}
+	}
+}
+
+func TestNewLoggerWritesToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	if err := os.WriteFile(path, []byte("earlier line\n"), 0o644); err != nil {
+		t.Fatalf("failed to write log file: %v", err)
+	}
+
+	logger, closeLog, err := newLogger(&Config{LogFile: path, LogFormat: "json"})
+	if err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+	logger.Info("service started", "port", 8080)
+	closeLog()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	// the file is appended to, so logs of earlier runs are kept
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != "earlier line" {
+		t.Fatalf("log file = %q, want the earlier line followed by the new log", data)
+	}
+	var entry struct {
+		Msg  string `json:"msg"`
+		Port int    `json:"port"`
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("failed to decode log line %q: %v", lines[1], err)
+	}
+	if entry.Msg != "service started" || entry.Port != 8080 {
+		t.Errorf("log entry = %+v, want the logged message", entry)
+	}
+}
+
+func TestOpenLogOutputStandardStreams(t *testing.T) {
+	tests := []struct {
+		logFile string
+		want    *os.File
+	}{
+		{logFile: "", want: os.Stdout},
+		{logFile: "stdout", want: os.Stdout},
+		{logFile: "stderr", want: os.Stderr},
+	}
+	for _, tt := range tests {
+		out, closeLog, err := openLogOutput(&Config{LogFile: tt.logFile})
+		if err != nil {
+			t.Fatalf("openLogOutput() with %q error = %v", tt.logFile, err)
+		}
+		// closing must not close the standard streams
+		closeLog()
+		if out != tt.want {
+			t.Errorf("openLogOutput() with %q = %v, want %s", tt.logFile, out, tt.want.Name())
+		}
+	}
+	if _, err := os.Stdout.Stat(); err != nil {
+		t.Errorf("stdout is closed: %v", err)
+	}
+}
+
+func TestNewLoggerWithUnwritableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "service.log")
+
+	if _, _, err := newLogger(&Config{LogFile: path}); err == nil {
+		t.Error("newLogger() with a file in a missing directory error = nil, want error")
+	}
+}
+
+func TestNewLoggerRotatesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "service.log")
+
+	logger, closeLog, err := newLogger(&Config{LogFile: path, LogMaxSize: 1, LogMaxBackups: 2})
+	if err != nil {
+		t.Fatalf("newLogger() error = %v", err)
+	}
+	// the size limit is in megabytes, write past it
+	payload := strings.Repeat("a", 64<<10)
+	for range 20 {
+		logger.Info("filler", "payload", payload)
+	}
+	closeLog()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read log directory: %v", err)
+	}
+	var backups int
+	for _, entry := range entries {
+		if entry.Name() != "service.log" && strings.HasPrefix(entry.Name(), "service-") && strings.HasSuffix(entry.Name(), ".log") {
+			backups++
+		}
+	}
+	if backups != 1 {
+		t.Errorf("log directory has %d backups, want 1, files: %v", backups, entries)
+	}
+
+	// the current file stays within the limit
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat log file: %v", err)
+	}
+	if info.Size() > 1<<20 {
+		t.Errorf("log file size = %d, want at most %d", info.Size(), 1<<20)
+	}
+}
@@ -10,19 +10,26 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
-	"time"
 
+	"github.com/aniladanir/auto-messender-service/internal/cache"
+	memoryCache "github.com/aniladanir/auto-messender-service/internal/cache/memory"
 	redisCache "github.com/aniladanir/auto-messender-service/internal/cache/redis"
 	"github.com/aniladanir/auto-messender-service/internal/domain"
 	httpHandler "github.com/aniladanir/auto-messender-service/internal/handler/http"
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
 	"github.com/aniladanir/auto-messender-service/internal/persistant/postgresql"
+	"github.com/aniladanir/auto-messender-service/internal/persistant/sqlite"
 	messageRepo "github.com/aniladanir/auto-messender-service/internal/repository/message"
 	"github.com/aniladanir/auto-messender-service/internal/service"
+	"github.com/aniladanir/auto-messender-service/internal/tracing"
 	"gorm.io/gorm"
 )
 
 var (
-	configFile = flag.String("config", "config.json", "config file path")
+	configFile = flag.String("config", "config.json", "config file path, json or yaml")
+	seed       = flag.Bool("seed", false, "populate an empty database with seed messages")
+	seedFile   = flag.String("seed-file", "", "json file to read seed messages from, dummy messages are used if empty")
+	printVer   = flag.Bool("version", false, "print build information and exit")
 )
 
 func main() {
@@ -37,24 +44,59 @@ func main() {
 	// parse flags
 	flag.Parse()
 
+	if *printVer {
+		fmt.Println(versionString())
+		return
+	}
+
 	// parse config
-	config, err := ReadConfigJson(*configFile)
+	config, err := ReadConfig(*configFile)
 	if err != nil {
 		log.Fatalf("failed to read config file: %v", err)
 	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("invalid config:\n%v", err)
+	}
+
+	// setup logger
+	logger, closeLog, err := newLogger(config)
+	if err != nil {
+		log.Fatalf("failed to setup logger: %v", err)
+	}
+	slog.SetDefault(logger)
+	logger.Info("starting application", "version", version, "commit", commit, "buildDate", buildDate)
+
+	// setup tracing
+	shutdownTracing, err := tracing.Initialize(notifyCtx, config.OtlpEndpoint, "auto-messenger-service")
+	if err != nil {
+		log.Fatalf("failed to setup tracing: %v", err)
+	}
 
 	// initialize external dependencies
-	db, rClient, err := initExternalDependencies(notifyCtx, config)
+	db, appCache, err := initExternalDependencies(notifyCtx, config)
 	if err != nil {
 		log.Fatalf("failed to initialize external dependencies: %v", err)
 	}
 
-	// setup logger
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
-	slog.SetDefault(logger)
-
 	// init message repository
-	msgRepo := messageRepo.NewMessageRepository(db, rClient)
+	msgRepo := messageRepo.NewMessageRepository(db, appCache,
+		messageRepo.WithTxRetry(config.DbTxRetries, config.DbTxRetryInterval),
+		messageRepo.WithInsertBatchSize(config.DbInsertBatchSize))
+
+	// elect a single instance to schedule batches if leader election is enabled
+	var leaderElector service.LeaderElector
+	if config.LeaderElection {
+		elector := postgresql.NewLeaderElector(db, "auto-messenger-service", config.LeaderElectionInterval,
+			logger.With(slog.String("component", "leaderElector")))
+		go elector.Run(notifyCtx)
+		leaderElector = elector
+	}
+
+	// publish sent events with the redis client, the in-memory cache can't publish events
+	var publisher service.EventPublisher
+	if p, ok := appCache.(service.EventPublisher); ok {
+		publisher = p
+	}
 
 	// init message sender service
 	msgSender, err := service.NewMessageSenderService(
@@ -64,20 +106,61 @@ func main() {
 		&config.MsgMaxRetry,
 		config.MsgBatchSize,
 		config.MsgSendInterval,
+		service.WithStaleMessageTimeout(config.StaleTimeout),
+		service.WithSuccessStatusCodes(config.SuccessStatusCodes),
+		service.WithDrainTimeout(config.DrainTimeout),
+		service.WithMaxConcurrency(config.MaxConcurrency),
+		service.WithRateLimit(config.RateLimit, config.RateLimitBurst),
+		service.WithCircuitBreaker(config.BreakerFailures, config.BreakerCooldown),
+		service.WithMaxCreateBatchSize(config.MaxCreateBatchSize),
+		service.WithDefaultCountryCode(config.DefaultCountryCode),
+		service.WithMaxResponseSize(config.MaxResponseSize),
+		service.WithErrorSnippetSize(config.ErrorSnippetSize),
+		service.WithDedupeWindow(config.DedupeWindow),
+		service.WithMessageTimeout(config.MessageTimeout),
+		service.WithBatchTimeout(config.BatchTimeout),
+		service.WithProcessingLease(config.ProcessingLeaseTTL),
+		service.WithDryRun(config.DryRun),
+		service.WithSigningSecret(config.WebhookSigningSecret),
+		service.WithWebhookHeaders(config.WebhookHeaders),
+		service.WithUserAgent(config.WebhookUserAgent),
+		service.WithPayloadTemplate(config.PayloadTemplate),
+		service.WithFallbackWebhookURLs(config.WebhookURLs),
+		service.WithWebhookTimeout(config.WebhookTimeout),
+		service.WithMaxRedirects(config.WebhookMaxRedirects),
+		service.WithIdleConns(config.WebhookMaxIdleConns, config.WebhookMaxIdleConnsPerHost, config.WebhookIdleConnTimeout),
+		service.WithPayloadCompression(config.CompressPayload, config.CompressMinSize),
+		service.WithRetryBaseDelay(config.RetryBaseDelay),
+		service.WithRetryMaxDelay(config.RetryMaxDelay),
+		service.WithRetryMultiplier(config.RetryMultiplier),
+		service.WithRetryJitter(*config.RetryJitter),
+		service.WithLeaderElector(leaderElector),
+		service.WithEventPublisher(publisher, config.RedisEventChannel),
 	)
 	if err != nil {
 		log.Fatalf("failed to initiate message sender service: %v", err)
 	}
 
-	// populate database with dummy data
-	if err := populateDatabase(db); err != nil {
-		log.Fatalf("failed to populate db: %v", err)
+	// populate database with seed data
+	if *seed {
+		if err := populateDatabase(db, *seedFile, config.DefaultCountryCode); err != nil {
+			log.Fatalf("failed to populate db: %v", err)
+		}
 	}
 
 	// init http handler
 	httpHandler := httpHandler.NewHttpHandler(
 		fmt.Sprintf(":%d", config.HttpPort),
 		msgSender,
+		map[string]httpHandler.HealthCheck{
+			"database": func(ctx context.Context) error { return persistant.Ping(ctx, db) },
+			"cache":    appCache.Ping,
+		},
+		httpHandler.WithAPIKey(config.APIKey),
+		httpHandler.WithCallbackSecret(config.WebhookSigningSecret),
+		httpHandler.WithLogger(logger),
+		httpHandler.WithTLS(config.TLSCertFile, config.TLSKeyFile),
+		httpHandler.WithCORS(config.CorsAllowedOrigins, config.CorsAllowedMethods, config.CorsAllowedHeaders),
 	)
 
 	// Start Scheduler automatically on deployment as requested
@@ -98,51 +181,103 @@ func main() {
 		<-notifyCtx.Done()
 		logger.Info("application shutting down...")
 
-		shutDownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		shutDownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
 		defer cancel()
 
-		msgSender.Stop()
-		httpHandler.Shutdown(shutDownCtx)
-		postgresql.Close(db)
+		shutdown(shutDownCtx, logger, msgSender, httpHandler, db)
+		shutdownTracing(shutDownCtx)
+
+		logger.Info("application is shut down")
+		closeLog()
 	})
 
 	wg.Wait()
 	os.Exit(0)
 }
 
-func initExternalDependencies(ctx context.Context, config *Config) (db *gorm.DB, rCache *redisCache.RedisCache, err error) {
+func initExternalDependencies(ctx context.Context, config *Config) (db *gorm.DB, c cache.Cache, err error) {
 	// initialize database
-	db, err = postgresql.Initialize(config.DbConnString, []any{&domain.Message{}})
+	models := []any{&domain.Message{}}
+	switch config.DbDriver {
+	case persistant.DriverSQLite:
+		db, err = sqlite.Initialize(config.DbConnString, models, *config.RunMigrations)
+	default:
+		db, err = postgresql.Initialize(config.DbConnString, models,
+			postgresql.WithConnectRetry(config.DbConnectRetries, config.DbConnectRetryInterval),
+			postgresql.WithMaxOpenConns(config.DbMaxOpenConns),
+			postgresql.WithMaxIdleConns(config.DbMaxIdleConns),
+			postgresql.WithConnMaxLifetime(config.DbConnMaxLifetime),
+			postgresql.WithRunMigrations(*config.RunMigrations),
+		)
+	}
 	if err != nil {
 		return
 	}
 
-	// initialize cache
-	rCache, err = redisCache.NewRedisCache(ctx, config.RedisAddr)
+	// initialize cache, fall back to in-memory cache if redis is not configured
+	if config.RedisAddr == "" && len(config.RedisAddrs) == 0 {
+		c = memoryCache.NewMemoryCache(ctx)
+		return
+	}
+	redisOpts := []redisCache.Option{
+		redisCache.WithConnectRetry(config.RedisConnectRetries, config.RedisConnectRetryInterval),
+		redisCache.WithMaxRetries(config.RedisMaxRetries),
+		redisCache.WithTimeouts(config.RedisDialTimeout, config.RedisReadTimeout, config.RedisWriteTimeout),
+		redisCache.WithPoolSize(config.RedisPoolSize),
+	}
+	switch config.RedisMode {
+	case redisCache.ModeSentinel:
+		redisOpts = append(redisOpts, redisCache.WithSentinel(config.RedisMasterName, config.RedisAddrs))
+	case redisCache.ModeCluster:
+		redisOpts = append(redisOpts, redisCache.WithCluster(config.RedisAddrs))
+	}
+	c, err = redisCache.NewRedisCache(ctx, config.RedisAddr, config.RedisPassword, config.RedisDB, redisOpts...)
 
 	return
 }
 
-func populateDatabase(db *gorm.DB) error {
-	var msgCount int64
-	if err := db.Model(&domain.Message{}).Count(&msgCount).Error; err != nil {
-		return err
-	}
-	if msgCount == 0 {
-		messages := []domain.Message{
-			{Content: "Hello World 1", PhoneNumber: "+905549998877"},
-			{Content: "Hello World 2", PhoneNumber: "+905549998876"},
-			{Content: "Hello World 3", PhoneNumber: "+905549998875"},
-			{Content: "Hello World 4", PhoneNumber: "+905549998874"},
-			{Content: "Hello World 5", PhoneNumber: "+905549998873"},
-			{Content: "Hello World 6", PhoneNumber: "+905549998872"},
-			{Content: "Hello World 7", PhoneNumber: "+905549998871"},
-			{Content: "Hello World 8", PhoneNumber: "+905549998870"},
-		}
-		if err := db.Create(&messages).Error; err != nil {
-			return err
+// shutdown stops the message sender and the http server, then closes the database. Stop is expected to return
+// within the drain timeout, which is less than the shutdown timeout, and the statuses it writes after the drain
+// are bounded by ctx, so the sequence completes before ctx is done.
+func shutdown(ctx context.Context, logger *slog.Logger, msgSender service.MessageSender, server *httpHandler.Handler, db *gorm.DB) {
+	senderStopped := make(chan struct{})
+	go func() {
+		defer close(senderStopped)
+		if err := msgSender.Stop(ctx); err != nil {
+			logger.Error("message sender did not stop in time", "error", err.Error())
 		}
+	}()
+	select {
+	case <-senderStopped:
+	case <-ctx.Done():
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("http server did not shut down in time", "error", err.Error())
+	}
+	// sends that are cancelled on stop still write their statuses, so don't close the database under them unless
+	// the deadline has passed
+	select {
+	case <-senderStopped:
+	case <-ctx.Done():
+		logger.Error("message sender did not stop before closing the database", "error", ctx.Err().Error())
 	}
+	if err := runWithDeadline(ctx, func() { persistant.Close(db) }); err != nil {
+		logger.Error("database connection did not close in time", "error", err.Error())
+	}
+}
 
-	return nil
+// runWithDeadline runs fn and returns once it completes or the context is done, whichever happens first
+func runWithDeadline(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aniladanir/auto-messender-service/internal/cache/memory"
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	httpHandler "github.com/aniladanir/auto-messender-service/internal/handler/http"
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
+	"github.com/aniladanir/auto-messender-service/internal/persistant/sqlite"
+	messageRepo "github.com/aniladanir/auto-messender-service/internal/repository/message"
+	"github.com/aniladanir/auto-messender-service/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestShutdownCompletesWithinTimeout(t *testing.T) {
+	const (
+		drainTimeout    = 100 * time.Millisecond
+		shutdownTimeout = time.Second
+	)
+
+	// the webhook never answers, so the in-flight send has to be cancelled once the drain timeout passes
+	started := make(chan struct{}, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(webhook.Close)
+
+	db, err := sqlite.Initialize("file::memory:", []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusPending}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+
+	logger := slog.New(slog.DiscardHandler)
+	maxRetry := 3
+	msgSender, err := service.NewMessageSenderService(messageRepo.NewMessageRepository(db, memory.NewMemoryCache(t.Context())),
+		logger, webhook.URL, &maxRetry, 10, time.Hour, service.WithDrainTimeout(drainTimeout))
+	if err != nil {
+		t.Fatalf("NewMessageSenderService() error = %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	server := httpHandler.NewHttpHandler(addr, msgSender, nil, httpHandler.WithLogger(logger))
+	runErr := make(chan error, 1)
+	go func() { runErr <- server.Run() }()
+
+	msgSender.Start()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	start := time.Now()
+	shutdown(ctx, logger, msgSender, server, db)
+
+	if elapsed := time.Since(start); elapsed >= shutdownTimeout {
+		t.Errorf("shutdown took %s, want less than the shutdown timeout %s", elapsed, shutdownTimeout)
+	}
+	if err := <-runErr; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Run() error = %v, want %v", err, http.ErrServerClosed)
+	}
+	if err := persistant.Ping(context.Background(), db); err == nil {
+		t.Error("database is not closed")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	"gorm.io/gorm"
+)
+
+// populateDatabase inserts seed messages if the database has no messages.
+// Messages are read from the seed file if given, otherwise dummy messages are used. Phone numbers without a country code
+// are parsed for the default region.
+func populateDatabase(db *gorm.DB, seedFile, defaultRegion string) error {
+	var msgCount int64
+	if err := db.Model(&domain.Message{}).Count(&msgCount).Error; err != nil {
+		return err
+	}
+	if msgCount == 0 {
+		messages, err := readSeedMessages(seedFile)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		for i := range messages {
+			if err := messages[i].Validate(); err != nil {
+				return err
+			}
+			phoneNumber, err := domain.NormalizePhoneNumber(messages[i].PhoneNumber, defaultRegion)
+			if err != nil {
+				return err
+			}
+			messages[i].PhoneNumber = phoneNumber
+		}
+		if err := db.Create(&messages).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSeedMessages reads json formatted seed messages from the given file
+func readSeedMessages(seedFile string) ([]domain.Message, error) {
+	if seedFile == "" {
+		return dummyMessages(), nil
+	}
+
+	content, err := os.ReadFile(seedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []domain.Message
+	if err = json.Unmarshal(content, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func dummyMessages() []domain.Message {
+	return []domain.Message{
+		{Content: "Hello World 1", PhoneNumber: "+905549998877"},
+		{Content: "Hello World 2", PhoneNumber: "+905549998876"},
+		{Content: "Hello World 3", PhoneNumber: "+905549998875"},
+		{Content: "Hello World 4", PhoneNumber: "+905549998874"},
+		{Content: "Hello World 5", PhoneNumber: "+905549998873"},
+		{Content: "Hello World 6", PhoneNumber: "+905549998872"},
+		{Content: "Hello World 7", PhoneNumber: "+905549998871"},
+		{Content: "Hello World 8", PhoneNumber: "+905549998870"},
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "fmt"
+
+// build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("auto-messenger-service %s (commit %s, built %s)", version, commit, buildDate)
+}
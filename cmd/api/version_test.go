@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"testing"
+)
+
+func TestVersionString(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+
+	if got, want := versionString(), "auto-messenger-service dev (commit unknown, built unknown)"; got != want {
+		t.Errorf("versionString() without build information = %q, want %q", got, want)
+	}
+
+	// the values set with -ldflags
+	version, commit, buildDate = "v1.2.3", "abc1234", "2024-05-01T10:00:00Z"
+	if got, want := versionString(), "auto-messenger-service v1.2.3 (commit abc1234, built 2024-05-01T10:00:00Z)"; got != want {
+		t.Errorf("versionString() = %q, want %q", got, want)
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	// the binary is run again to call main with the flag, which prints the version without reading the config
+	if os.Getenv("AMS_TEST_VERSION_FLAG") == "1" {
+		os.Args = []string{os.Args[0], "-version", "-config", "missing.json"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersionFlag$")
+	cmd.Env = append(os.Environ(), "AMS_TEST_VERSION_FLAG=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("running with -version error = %v, output:\n%s", err, out)
+	}
+
+	if !regexp.MustCompile(`(?m)^auto-messenger-service \S+ \(commit \S+, built \S+\)$`).Match(out) {
+		t.Errorf("output = %q, want the build information", out)
+	}
+}
@@ -15,90 +15,996 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/callbacks/delivery": {
+            "post": {
+                "description": "Called by the provider to report the final delivery status of a message by the message id it returned.\nThe body must be signed with the webhook signing secret, if no secret is configured the api key is required instead.",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Callbacks"
+                ],
+                "summary": "Report delivery status",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Hex encoded HMAC-SHA256 of the request body",
+                        "name": "X-Signature",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Delivery status of the message",
+                        "name": "callback",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.deliveryCallbackRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large"
+                    }
+                }
+            }
+        },
+        "/config/batch-size": {
+            "patch": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Changes the number of messages sent in each batch without a restart, starting with the next batch",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Control"
+                ],
+                "summary": "Change the batch size",
+                "parameters": [
+                    {
+                        "description": "New batch size",
+                        "name": "batchSize",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.batchSizeRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/service.Status"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    }
+                }
+            }
+        },
+        "/config/interval": {
+            "patch": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Changes the interval between batches without a restart, the running scheduler processes its next batch after the new interval",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Control"
+                ],
+                "summary": "Change the send interval",
+                "parameters": [
+                    {
+                        "description": "New send interval",
+                        "name": "interval",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.intervalRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/service.Status"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    }
+                }
+            }
+        },
+        "/healthz": {
+            "get": {
+                "description": "Returns 200 as long as the process is up",
+                "tags": [
+                    "Health"
+                ],
+                "summary": "Liveness probe",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
         "/messages": {
             "get": {
-                "description": "Retrieves all messages marked as sent",
+                "description": "Retrieves a page of messages with the given status, defaults to messages marked as sent.\nIf broadcast_id is given, messages of the broadcast are returned in any status unless status is given too.",
                 "tags": [
                     "Messages"
                 ],
-                "summary": "Get list of sent messages",
+                "summary": "Get list of messages",
+                "parameters": [
+                    {
+                        "enum": [
+                            "pending",
+                            "processing",
+                            "success",
+                            "failed",
+                            "dead_letter",
+                            "rejected"
+                        ],
+                        "type": "string",
+                        "description": "Message status",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Broadcast id to filter messages by",
+                        "name": "broadcast_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum number of messages to return (default 50, max 500)",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of messages to skip",
+                        "name": "offset",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/domain.MessagePage"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Validates the given message and enqueues it for sending. If the Idempotency-Key header\nmatches a previously created message, the existing message is returned instead.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Create message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Key that prevents the message from being enqueued twice",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Message to create",
+                        "name": "message",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.createMessageRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Message with the same idempotency key already exists",
+                        "schema": {
+                            "$ref": "#/definitions/domain.Message"
+                        }
+                    },
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/domain.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    }
+                }
+            }
+        },
+        "/messages/batch": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Validates the given messages and enqueues the valid ones for sending in a single transaction",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Create messages in batch",
+                "parameters": [
+                    {
+                        "description": "Messages to create",
+                        "name": "messages",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/handler.createMessageRequest"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
                         "schema": {
                             "type": "array",
                             "items": {
-                                "$ref": "#/definitions/domain.Message"
+                                "$ref": "#/definitions/service.CreateResult"
                             }
                         }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/service.CreateResult"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large"
                     }
                 }
             }
         },
-        "/start": {
+        "/messages/broadcast": {
             "post": {
-                "description": "Starts the background process that sends x messages every y minutes",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Enqueues the same content for each of the given phone numbers in a single transaction,\ngrouped under a generated broadcast id. Nothing is created if any of the numbers is invalid.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Broadcast message",
+                "parameters": [
+                    {
+                        "description": "Content and recipients of the broadcast",
+                        "name": "broadcast",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.broadcastRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/service.Broadcast"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large"
+                    }
+                }
+            }
+        },
+        "/messages/export": {
+            "get": {
+                "description": "Streams the messages with the given status as a file, defaults to messages marked as sent.\nOnly csv format is supported.",
+                "produces": [
+                    "text/csv"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Export messages",
+                "parameters": [
+                    {
+                        "enum": [
+                            "csv"
+                        ],
+                        "type": "string",
+                        "description": "Export format",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "pending",
+                            "processing",
+                            "success",
+                            "failed",
+                            "dead_letter",
+                            "rejected"
+                        ],
+                        "type": "string",
+                        "description": "Message status",
+                        "name": "status",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    }
+                }
+            }
+        },
+        "/messages/flush": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Processes a batch of pending messages immediately, out of the schedule, and returns the number of messages handled",
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
                     "Control"
                 ],
-                "summary": "Start the automatic message sender",
+                "summary": "Send a batch now",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    },
+                    "409": {
+                        "description": "A batch is already in progress"
+                    },
+                    "503": {
+                        "description": "Circuit breaker is open"
+                    }
+                }
+            }
+        },
+        "/messages/requeue": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Resets all failed, dead lettered or rejected messages back to pending with their retries zeroed so they are sent again,\ne.g. once a webhook outage is resolved. Returns the number of messages requeued.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Control"
+                ],
+                "summary": "Requeue messages",
+                "parameters": [
+                    {
+                        "description": "Status of the messages to requeue",
+                        "name": "requeue",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/handler.requeueRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    }
+                }
+            }
+        },
+        "/messages/summary": {
+            "get": {
+                "description": "Returns the number of messages in each status",
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Get message counts by status",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
                             "type": "object",
                             "additionalProperties": {
-                                "type": "string"
+                                "type": "integer"
                             }
                         }
                     }
                 }
             }
         },
-        "/stop": {
+        "/messages/{id}": {
+            "get": {
+                "description": "Retrieves a single message by its id",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Get message",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Message id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/domain.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            }
+        },
+        "/messages/{id}/cache": {
+            "get": {
+                "description": "Retrieves cached metadata of a sent message by the messageId returned from the webhook.\nThe path parameter is the messageId of the webhook response, not the id of the message.",
+                "tags": [
+                    "Messages"
+                ],
+                "summary": "Get cached sent message",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "messageId returned from the webhook",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/domain.CachedMessage"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    }
+                }
+            }
+        },
+        "/messages/{id}/resend": {
             "post": {
-                "description": "Stops the background sending process",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Resets a single message back to pending with its retries zeroed so it is sent again in a later batch,\nwhatever its status is. A message that is being processed can't be resent.",
+                "produces": [
+                    "application/json"
+                ],
                 "tags": [
                     "Control"
                 ],
-                "summary": "Stop the automatic message sender",
+                "summary": "Resend a message",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Message id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "string"
-                            }
+                            "$ref": "#/definitions/domain.Message"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    },
+                    "404": {
+                        "description": "Not Found"
+                    },
+                    "409": {
+                        "description": "Conflict"
+                    }
+                }
+            }
+        },
+        "/readyz": {
+            "get": {
+                "description": "Checks the database and cache, returns 503 naming the unhealthy dependencies if any check fails",
+                "tags": [
+                    "Health"
+                ],
+                "summary": "Readiness probe",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "503": {
+                        "description": "Service Unavailable"
+                    }
+                }
+            }
+        },
+        "/start": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Starts the background process that sends x messages every y minutes",
+                "tags": [
+                    "Control"
+                ],
+                "summary": "Start the automatic message sender",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    }
+                }
+            }
+        },
+        "/stats": {
+            "get": {
+                "description": "Returns the number of messages sent and failed by this instance in the last minute and hour,\nthe success ratio and the average webhook latency of the last hour",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Control"
+                ],
+                "summary": "Get send statistics",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/service.Stats"
+                        }
+                    }
+                }
+            }
+        },
+        "/status": {
+            "get": {
+                "description": "Returns whether the automatic message sender is running along with its interval and batch size",
+                "tags": [
+                    "Control"
+                ],
+                "summary": "Get sender status",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/service.Status"
                         }
                     }
                 }
             }
+        },
+        "/stop": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Stops the background sending process",
+                "tags": [
+                    "Control"
+                ],
+                "summary": "Stop the automatic message sender",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "401": {
+                        "description": "Unauthorized"
+                    }
+                }
+            }
         }
     },
     "definitions": {
+        "domain.CachedMessage": {
+            "type": "object",
+            "properties": {
+                "messageId": {
+                    "type": "string"
+                },
+                "sentAt": {
+                    "type": "string"
+                }
+            }
+        },
         "domain.Message": {
             "type": "object",
             "properties": {
+                "broadcast_id": {
+                    "description": "BroadcastID groups the messages that are created from the same broadcast",
+                    "type": "string"
+                },
                 "content": {
                     "type": "string"
                 },
                 "created_at": {
                     "type": "string"
                 },
+                "delivery_status": {
+                    "description": "DeliveryStatus is reported by the provider after the message is sent, empty until then",
+                    "type": "string",
+                    "enum": [
+                        "delivered",
+                        "undelivered"
+                    ]
+                },
                 "id": {
                     "type": "integer"
                 },
+                "idempotency_key": {
+                    "description": "IdempotencyKey is an optional client provided key that prevents the same message from being enqueued twice",
+                    "type": "string"
+                },
+                "last_error": {
+                    "description": "LastError describes why the last attempt to send the message failed, empty if no attempt failed",
+                    "type": "string"
+                },
                 "phone_number": {
                     "type": "string"
                 },
-                "status": {
+                "provider_message_id": {
+                    "description": "ProviderMessageID is the message id returned by the webhook when the message is sent",
+                    "type": "string"
+                },
+                "retry_count": {
                     "type": "integer"
                 },
+                "scheduled_at": {
+                    "type": "string"
+                },
+                "sent_at": {
+                    "description": "SentAt is the time the message is accepted by the webhook, empty until then",
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "pending",
+                        "processing",
+                        "success",
+                        "failed",
+                        "dead_letter",
+                        "rejected"
+                    ]
+                },
+                "template": {
+                    "description": "Template is interpolated with Variables to create the content just before the message is sent, e.g. \"Hi {{.name}}\"",
+                    "type": "string"
+                },
                 "updated_at": {
                     "type": "string"
+                },
+                "variables": {
+                    "description": "Variables are the per recipient values of the template",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
                 }
             }
+        },
+        "domain.MessagePage": {
+            "type": "object",
+            "properties": {
+                "messages": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/domain.Message"
+                    }
+                },
+                "next_offset": {
+                    "description": "NextOffset is the offset of the next page, nil if there are no more messages",
+                    "type": "integer"
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.batchSizeRequest": {
+            "type": "object",
+            "properties": {
+                "batch_size": {
+                    "type": "integer",
+                    "example": 10
+                }
+            }
+        },
+        "handler.broadcastRequest": {
+            "type": "object",
+            "properties": {
+                "content": {
+                    "type": "string"
+                },
+                "phone_numbers": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "scheduled_at": {
+                    "description": "ScheduledAt is the earliest time the messages are sent at, sent as soon as possible if empty",
+                    "type": "string"
+                }
+            }
+        },
+        "handler.createMessageRequest": {
+            "type": "object",
+            "properties": {
+                "content": {
+                    "type": "string"
+                },
+                "phone_number": {
+                    "type": "string"
+                },
+                "scheduled_at": {
+                    "description": "ScheduledAt is the earliest time the message is sent at, sent as soon as possible if empty",
+                    "type": "string"
+                },
+                "template": {
+                    "description": "Template is rendered with Variables instead of sending Content, e.g. \"Hi {{.name}}\"",
+                    "type": "string"
+                },
+                "variables": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "handler.deliveryCallbackRequest": {
+            "type": "object",
+            "properties": {
+                "messageId": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "delivered",
+                        "undelivered"
+                    ]
+                }
+            }
+        },
+        "handler.intervalRequest": {
+            "type": "object",
+            "properties": {
+                "interval": {
+                    "description": "Interval is a duration such as \"30s\" or \"2m\"",
+                    "type": "string",
+                    "example": "2m"
+                }
+            }
+        },
+        "handler.requeueRequest": {
+            "type": "object",
+            "properties": {
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "failed",
+                        "dead_letter",
+                        "rejected"
+                    ]
+                }
+            }
+        },
+        "service.Broadcast": {
+            "type": "object",
+            "properties": {
+                "broadcast_id": {
+                    "type": "string"
+                },
+                "messages": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/domain.Message"
+                    }
+                }
+            }
+        },
+        "service.CreateResult": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "index": {
+                    "type": "integer"
+                }
+            }
+        },
+        "service.Stats": {
+            "type": "object",
+            "properties": {
+                "avg_latency_ms": {
+                    "description": "AvgLatencyMs is the average latency of the webhook requests made in the last hour in milliseconds",
+                    "type": "number"
+                },
+                "failed_last_hour": {
+                    "type": "integer"
+                },
+                "failed_last_minute": {
+                    "type": "integer"
+                },
+                "sent_last_hour": {
+                    "type": "integer"
+                },
+                "sent_last_minute": {
+                    "type": "integer"
+                },
+                "success_ratio": {
+                    "description": "SuccessRatio is the ratio of sent messages to sent and failed messages in the last hour, zero if there are none",
+                    "type": "number"
+                }
+            }
+        },
+        "service.Status": {
+            "type": "object",
+            "properties": {
+                "batch_size": {
+                    "type": "integer"
+                },
+                "is_leader": {
+                    "description": "IsLeader reports whether this instance schedules batches, always true if leader election is disabled",
+                    "type": "boolean"
+                },
+                "is_running": {
+                    "type": "boolean"
+                },
+                "send_interval": {
+                    "type": "string"
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "ApiKeyAuth": {
+            "type": "apiKey",
+            "name": "X-API-Key",
+            "in": "header"
         }
     }
 }`
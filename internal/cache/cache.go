@@ -2,10 +2,21 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
+var (
+	// ErrCacheMiss is returned when the requested key doesn't exist in cache
+	ErrCacheMiss = errors.New("cache miss")
+	// ErrCacheUnavailable is returned when the cache can't be reached, which is expected to be transient
+	ErrCacheUnavailable = errors.New("cache unavailable")
+)
+
 type Cache interface {
 	Set(ctx context.Context, key, val string, ttl time.Duration) error
 	Get(ctx context.Context, key string) (string, error)
+	Delete(ctx context.Context, key string) error
+	// Ping checks whether the cache is reachable
+	Ping(ctx context.Context) error
 }
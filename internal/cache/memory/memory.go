@@ -0,0 +1,100 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aniladanir/auto-messender-service/internal/cache"
+)
+
+const sweepInterval = time.Minute
+
+type entry struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+type MemoryCache struct {
+	mtx     sync.RWMutex
+	entries map[string]entry
+}
+
+// NewMemoryCache creates a new in-memory cache that complies with cache interface.
+// Expired entries are swept periodically until the given context is done.
+func NewMemoryCache(ctx context.Context) *MemoryCache {
+	m := &MemoryCache{
+		entries: make(map[string]entry),
+	}
+
+	go m.sweep(ctx)
+
+	return m
+}
+
+// Set stores the value under the given key. Zero ttl means the key never expires.
+func (m *MemoryCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	e := entry{value: value}
+	if ttl > 0 {
+		e.expiresAt = time.Now().Add(ttl)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.entries[key] = e
+	return nil
+}
+
+func (m *MemoryCache) Get(ctx context.Context, key string) (string, error) {
+	m.mtx.RLock()
+	e, ok := m.entries[key]
+	m.mtx.RUnlock()
+
+	if !ok || e.expired(time.Now()) {
+		return "", cache.ErrCacheMiss
+	}
+	return e.value, nil
+}
+
+func (m *MemoryCache) Delete(ctx context.Context, key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// Ping always succeeds since the cache lives in process memory
+func (m *MemoryCache) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryCache) sweep(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.removeExpired(time.Now())
+		}
+	}
+}
+
+func (m *MemoryCache) removeExpired(now time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for key, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+}
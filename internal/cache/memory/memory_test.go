@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aniladanir/auto-messender-service/internal/cache"
+)
+
+func TestSetGet(t *testing.T) {
+	m := NewMemoryCache(t.Context())
+
+	if _, err := m.Get(t.Context(), "key"); !errors.Is(err, cache.ErrCacheMiss) {
+		t.Errorf("Get() of missing key error = %v, want %v", err, cache.ErrCacheMiss)
+	}
+
+	if err := m.Set(t.Context(), "key", "value", 0); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if got, err := m.Get(t.Context(), "key"); err != nil || got != "value" {
+		t.Errorf("Get() = %q, %v, want %q", got, err, "value")
+	}
+
+	if err := m.Set(t.Context(), "key", "overwritten", 0); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if got, err := m.Get(t.Context(), "key"); err != nil || got != "overwritten" {
+		t.Errorf("Get() = %q, %v, want %q", got, err, "overwritten")
+	}
+}
+
+func TestTTLExpiry(t *testing.T) {
+	m := NewMemoryCache(t.Context())
+
+	if err := m.Set(t.Context(), "key", "value", 20*time.Millisecond); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, err := m.Get(t.Context(), "key"); err != nil {
+		t.Fatalf("Get() before expiry error = %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := m.Get(t.Context(), "key"); !errors.Is(err, cache.ErrCacheMiss) {
+		t.Errorf("Get() after expiry error = %v, want %v", err, cache.ErrCacheMiss)
+	}
+}
+
+func TestSweepRemovesExpiredEntries(t *testing.T) {
+	m := &MemoryCache{entries: map[string]entry{
+		"expired": {value: "value", expiresAt: time.Now().Add(-time.Second)},
+		"live":    {value: "value", expiresAt: time.Now().Add(time.Hour)},
+		"forever": {value: "value"},
+	}}
+
+	m.removeExpired(time.Now())
+
+	if _, ok := m.entries["expired"]; ok {
+		t.Error("expired entry is not swept")
+	}
+	if len(m.entries) != 2 {
+		t.Errorf("%d entries are left, want 2", len(m.entries))
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	m := NewMemoryCache(t.Context())
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Go(func() {
+			for j := range 100 {
+				key := strconv.Itoa(j % 10)
+				m.Set(t.Context(), key, strconv.Itoa(i), time.Minute)
+				m.Get(t.Context(), key)
+				if j%7 == 0 {
+					m.Delete(t.Context(), key)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
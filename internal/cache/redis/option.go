@@ -0,0 +1,85 @@
+package redis
+
+import "time"
+
+// Supported redis topologies
+const (
+	ModeSingle   = "single"
+	ModeSentinel = "sentinel"
+	ModeCluster  = "cluster"
+)
+
+const (
+	defaultConnectRetries       = 5
+	defaultConnectRetryInterval = time.Second * 2
+)
+
+type settings struct {
+	mode                 string
+	masterName           string
+	addrs                []string
+	connectRetries       int
+	connectRetryInterval time.Duration
+	maxRetries           int
+	dialTimeout          time.Duration
+	readTimeout          time.Duration
+	writeTimeout         time.Duration
+	poolSize             int
+}
+
+type Option func(s *settings)
+
+// WithConnectRetry sets how many times pinging the redis instance is attempted and the interval between attempts.
+// Non-positive values keep the defaults of 5 attempts and 2 seconds.
+func WithConnectRetry(retries int, interval time.Duration) Option {
+	return func(s *settings) {
+		if retries > 0 {
+			s.connectRetries = retries
+		}
+		if interval > 0 {
+			s.connectRetryInterval = interval
+		}
+	}
+}
+
+// WithMaxRetries sets how many times a failed command is retried with backoff before giving up.
+// Zero keeps the client default of 3 retries, -1 disables retries.
+func WithMaxRetries(n int) Option {
+	return func(s *settings) {
+		s.maxRetries = n
+	}
+}
+
+// WithTimeouts sets the dial, read and write timeouts of the connections. Zero keeps the client defaults.
+func WithTimeouts(dial, read, write time.Duration) Option {
+	return func(s *settings) {
+		s.dialTimeout = dial
+		s.readTimeout = read
+		s.writeTimeout = write
+	}
+}
+
+// WithPoolSize sets the maximum number of connections. Zero keeps the client default of 10 per cpu.
+func WithPoolSize(n int) Option {
+	return func(s *settings) {
+		s.poolSize = n
+	}
+}
+
+// WithSentinel connects to the master with the given name through the given sentinels instead of a single node
+func WithSentinel(masterName string, sentinelAddrs []string) Option {
+	return func(s *settings) {
+		s.mode = ModeSentinel
+		s.masterName = masterName
+		s.addrs = sentinelAddrs
+	}
+}
+
+// WithCluster connects to a redis cluster through the given seed nodes instead of a single node.
+// The db is ignored since clusters only support db 0.
+func WithCluster(addrs []string) Option {
+	return func(s *settings) {
+		s.mode = ModeCluster
+		s.addrs = addrs
+	}
+}
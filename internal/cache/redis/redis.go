@@ -2,28 +2,80 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"syscall"
 	"time"
 
+	"github.com/aniladanir/auto-messender-service/internal/cache"
 	"github.com/go-redis/redis/v8"
 )
 
 type RedisCache struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
-// NewRedisCache creates a new redis cache that complies with cache interface
-func NewRedisCache(ctx context.Context, addr string) (*RedisCache, error) {
-	rClient := redis.NewClient(&redis.Options{
-		Addr: addr,
-	})
+// NewRedisCache creates a new redis cache that complies with cache interface.
+// Password may be empty if the redis instance doesn't require authentication.
+// A single node at addr is used unless sentinel or cluster mode is given with options.
+func NewRedisCache(ctx context.Context, addr string, password string, db int, opts ...Option) (*RedisCache, error) {
+	s := &settings{
+		mode:                 ModeSingle,
+		connectRetries:       defaultConnectRetries,
+		connectRetryInterval: defaultConnectRetryInterval,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	if len(s.addrs) == 0 {
+		s.addrs = []string{addr}
+	}
+
+	var rClient redis.UniversalClient
+	switch s.mode {
+	case ModeSentinel:
+		rClient = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    s.masterName,
+			SentinelAddrs: s.addrs,
+			Password:      password,
+			DB:            db,
+			MaxRetries:    s.maxRetries,
+			DialTimeout:   s.dialTimeout,
+			ReadTimeout:   s.readTimeout,
+			WriteTimeout:  s.writeTimeout,
+			PoolSize:      s.poolSize,
+		})
+	case ModeCluster:
+		rClient = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        s.addrs,
+			Password:     password,
+			MaxRetries:   s.maxRetries,
+			DialTimeout:  s.dialTimeout,
+			ReadTimeout:  s.readTimeout,
+			WriteTimeout: s.writeTimeout,
+			PoolSize:     s.poolSize,
+		})
+	default:
+		rClient = redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     password,
+			DB:           db,
+			MaxRetries:   s.maxRetries,
+			DialTimeout:  s.dialTimeout,
+			ReadTimeout:  s.readTimeout,
+			WriteTimeout: s.writeTimeout,
+			PoolSize:     s.poolSize,
+		})
+	}
 
-	retryTicker := time.NewTicker(time.Second * 2)
+	retryTicker := time.NewTicker(s.connectRetryInterval)
 	defer retryTicker.Stop()
 
 	// retry ping
 	var pingErr error
-	for range 5 {
+	for range s.connectRetries {
 		if pingErr = rClient.Ping(ctx).Err(); pingErr == nil {
 			break
 		}
@@ -39,9 +91,38 @@ func NewRedisCache(ctx context.Context, addr string) (*RedisCache, error) {
 }
 
 func (r *RedisCache) Set(ctx context.Context, key, value string, ttl time.Duration) error {
-	return r.client.Set(ctx, key, value, ttl).Err()
+	return translateError(r.client.Set(ctx, key, value, ttl).Err())
 }
 
+// Get returns the value of the key. cache.ErrCacheMiss is returned if the key doesn't exist.
 func (r *RedisCache) Get(ctx context.Context, key string) (string, error) {
-	return r.client.Get(ctx, key).Result()
+	val, err := r.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", cache.ErrCacheMiss
+	}
+	return val, translateError(err)
+}
+
+func (r *RedisCache) Delete(ctx context.Context, key string) error {
+	return translateError(r.client.Del(ctx, key).Err())
+}
+
+func (r *RedisCache) Ping(ctx context.Context) error {
+	return translateError(r.client.Ping(ctx).Err())
+}
+
+// Publish sends the payload to the subscribers of the channel
+func (r *RedisCache) Publish(ctx context.Context, channel, payload string) error {
+	return translateError(r.client.Publish(ctx, channel, payload).Err())
+}
+
+// translateError wraps errors caused by the connection to redis, e.g. while it is unreachable or restarting,
+// with cache.ErrCacheUnavailable so they can be told apart from errors of the command itself.
+func translateError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, redis.ErrClosed) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%w: %w", cache.ErrCacheUnavailable, err)
+	}
+	return err
 }
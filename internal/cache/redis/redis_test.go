@@ -0,0 +1,317 @@
+package redis
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/aniladanir/auto-messender-service/internal/cache"
+	"github.com/go-redis/redis/v8"
+)
+
+// unusedAddr returns a local address nothing listens on
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve an address: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestNewRedisCacheAuthentication(t *testing.T) {
+	tests := []struct {
+		name            string
+		requirePassword string
+		password        string
+		wantErr         bool
+	}{
+		{name: "no password required", password: ""},
+		{name: "correct password", requirePassword: "secret", password: "secret"},
+		{name: "wrong password", requirePassword: "secret", password: "wrong", wantErr: true},
+		{name: "missing password", requirePassword: "secret", password: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			if tt.requirePassword != "" {
+				mr.RequireAuth(tt.requirePassword)
+			}
+
+			_, err := NewRedisCache(t.Context(), mr.Addr(), tt.password, 0, WithConnectRetry(1, time.Millisecond))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewRedisCache() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewRedisCacheSelectsDB(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	c, err := NewRedisCache(t.Context(), mr.Addr(), "", 3)
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+	if err := c.Set(t.Context(), "key", "value", time.Minute); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	if got, err := mr.DB(3).Get("key"); err != nil || got != "value" {
+		t.Errorf("key in db 3 = %q, %v, want %q", got, err, "value")
+	}
+	if mr.DB(0).Exists("key") {
+		t.Error("key is written to db 0")
+	}
+}
+
+func TestGetMissingKeyIsCacheMiss(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c, err := NewRedisCache(t.Context(), mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+
+	_, err = c.Get(t.Context(), "missing")
+	if !errors.Is(err, cache.ErrCacheMiss) {
+		t.Fatalf("Get() of missing key error = %v, want %v", err, cache.ErrCacheMiss)
+	}
+	// the driver error doesn't leak through the cache abstraction
+	if errors.Is(err, redis.Nil) {
+		t.Errorf("Get() of missing key error = %v, want it not to be redis.Nil", err)
+	}
+
+	// an expired key is missing as well
+	if err := c.Set(t.Context(), "key", "value", time.Second); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	mr.FastForward(2 * time.Second)
+	if _, err := c.Get(t.Context(), "key"); !errors.Is(err, cache.ErrCacheMiss) {
+		t.Errorf("Get() of expired key error = %v, want %v", err, cache.ErrCacheMiss)
+	}
+}
+
+func TestDeleteIsMiss(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c, err := NewRedisCache(t.Context(), mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+
+	if err := c.Set(t.Context(), "key", "value", time.Minute); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := c.Delete(t.Context(), "key"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := c.Get(t.Context(), "key"); !errors.Is(err, cache.ErrCacheMiss) {
+		t.Errorf("Get() after Delete() error = %v, want %v", err, cache.ErrCacheMiss)
+	}
+
+	// deleting a missing key is not an error
+	if err := c.Delete(t.Context(), "missing"); err != nil {
+		t.Errorf("Delete() of missing key error = %v", err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c, err := NewRedisCache(t.Context(), mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+	sub := mr.NewSubscriber()
+	defer sub.Close()
+	sub.Subscribe("events")
+
+	// the subscriber is unbuffered, so publishing blocks until the message is read
+	published := make(chan error, 1)
+	go func() {
+		published <- c.Publish(t.Context(), "events", `{"id":1}`)
+	}()
+
+	select {
+	case got := <-sub.Messages():
+		if got.Channel != "events" || got.Message != `{"id":1}` {
+			t.Errorf("published message = %+v, want the payload on the events channel", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the published message")
+	}
+	if err := <-published; err != nil {
+		t.Errorf("Publish() error = %v", err)
+	}
+}
+
+func TestNewRedisCacheRetriesUntilRedisIsUp(t *testing.T) {
+	// the address refuses connections until redis starts on it
+	addr := unusedAddr(t)
+	mr := miniredis.NewMiniRedis()
+	t.Cleanup(mr.Close)
+	started := make(chan error, 1)
+	time.AfterFunc(50*time.Millisecond, func() { started <- mr.StartAddr(addr) })
+
+	_, err := NewRedisCache(t.Context(), addr, "", 0, WithConnectRetry(20, 20*time.Millisecond), WithMaxRetries(-1))
+	if startErr := <-started; startErr != nil {
+		t.Fatalf("failed to start redis: %v", startErr)
+	}
+	if err != nil {
+		t.Errorf("NewRedisCache() error = %v, want redis to be reached once it is up", err)
+	}
+}
+
+func TestNewRedisCacheGivesUpAfterRetries(t *testing.T) {
+	start := time.Now()
+	_, err := NewRedisCache(t.Context(), unusedAddr(t), "", 0, WithConnectRetry(3, 20*time.Millisecond), WithMaxRetries(-1))
+	if err == nil {
+		t.Fatal("NewRedisCache() error = nil, want error")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("NewRedisCache() gave up after %s, want it to wait between the 3 attempts", elapsed)
+	}
+}
+
+func TestOutageIsReportedAsUnavailable(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c, err := NewRedisCache(t.Context(), mr.Addr(), "", 0, WithMaxRetries(-1))
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+	if err := c.Set(t.Context(), "key", "value", time.Minute); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	mr.Close()
+	if err := c.Set(t.Context(), "key", "value", time.Minute); !errors.Is(err, cache.ErrCacheUnavailable) {
+		t.Errorf("Set() during outage error = %v, want %v", err, cache.ErrCacheUnavailable)
+	}
+	if _, err := c.Get(t.Context(), "key"); !errors.Is(err, cache.ErrCacheUnavailable) {
+		t.Errorf("Get() during outage error = %v, want %v", err, cache.ErrCacheUnavailable)
+	}
+
+	// the client reconnects once redis is back
+	if err := mr.Restart(); err != nil {
+		t.Fatalf("failed to restart redis: %v", err)
+	}
+	if err := c.Set(t.Context(), "key", "value", time.Minute); err != nil {
+		t.Errorf("Set() after recovery error = %v", err)
+	}
+	if got, err := c.Get(t.Context(), "key"); err != nil || got != "value" {
+		t.Errorf("Get() after recovery = %q, %v, want %q", got, err, "value")
+	}
+	// errors of the commands themselves aren't reported as unavailable
+	if _, err := c.Get(t.Context(), "missing"); errors.Is(err, cache.ErrCacheUnavailable) {
+		t.Errorf("Get() of missing key error = %v, want it not to be %v", err, cache.ErrCacheUnavailable)
+	}
+}
+
+func TestRetriesRideOutBriefOutage(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c, err := NewRedisCache(t.Context(), mr.Addr(), "", 0, WithMaxRetries(10))
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+
+	// redis comes back while the command is being retried
+	mr.Close()
+	restarted := make(chan error, 1)
+	time.AfterFunc(50*time.Millisecond, func() { restarted <- mr.Restart() })
+
+	err = c.Set(t.Context(), "key", "value", time.Minute)
+	if restartErr := <-restarted; restartErr != nil {
+		t.Fatalf("failed to restart redis: %v", restartErr)
+	}
+	if err != nil {
+		t.Errorf("Set() error = %v, want it to succeed once redis is back", err)
+	}
+}
+
+// runSentinel starts a fake sentinel that monitors the given redis as the master with the given name
+func runSentinel(t *testing.T, masterName string, master *miniredis.Miniredis) string {
+	t.Helper()
+
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start sentinel: %v", err)
+	}
+	t.Cleanup(srv.Close)
+
+	srv.Register("PING", func(c *server.Peer, cmd string, args []string) {
+		c.WriteInline("PONG")
+	})
+	srv.Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		switch {
+		case len(args) == 2 && strings.EqualFold(args[0], "get-master-addr-by-name") && args[1] == masterName:
+			c.WriteStrings([]string{master.Host(), master.Port()})
+		case len(args) == 2 && strings.EqualFold(args[0], "get-master-addr-by-name"):
+			c.WriteNull()
+		case len(args) == 2 && strings.EqualFold(args[0], "sentinels"):
+			c.WriteLen(0)
+		default:
+			c.WriteError("ERR unknown sentinel command")
+		}
+	})
+	// the client subscribes to master switches
+	srv.Register("SUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		for i, channel := range args {
+			c.WriteLen(3)
+			c.WriteBulk("subscribe")
+			c.WriteBulk(channel)
+			c.WriteInt(i + 1)
+		}
+	})
+	return srv.Addr().String()
+}
+
+func TestNewRedisCacheModes(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(mr *miniredis.Miniredis) []Option
+	}{
+		{name: "single", opts: func(mr *miniredis.Miniredis) []Option { return nil }},
+		{
+			name: "sentinel",
+			opts: func(mr *miniredis.Miniredis) []Option {
+				return []Option{WithSentinel("mymaster", []string{runSentinel(t, "mymaster", mr)})}
+			},
+		},
+		{name: "cluster", opts: func(mr *miniredis.Miniredis) []Option { return []Option{WithCluster([]string{mr.Addr()})} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+
+			c, err := NewRedisCache(t.Context(), mr.Addr(), "", 0, tt.opts(mr)...)
+			if err != nil {
+				t.Fatalf("NewRedisCache() error = %v", err)
+			}
+			if err := c.Set(t.Context(), "key", "value", time.Minute); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+
+			// commands reach the redis the mode resolves to
+			if got, err := mr.Get("key"); err != nil || got != "value" {
+				t.Errorf("stored value = %q, %v, want %q", got, err, "value")
+			}
+			if got, err := c.Get(t.Context(), "key"); err != nil || got != "value" {
+				t.Errorf("Get() = %q, %v, want %q", got, err, "value")
+			}
+		})
+	}
+}
+
+func TestNewRedisCacheSentinelWithUnknownMaster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	sentinel := runSentinel(t, "mymaster", mr)
+
+	_, err := NewRedisCache(t.Context(), "", "", 0, WithSentinel("other", []string{sentinel}), WithConnectRetry(1, time.Millisecond))
+	if err == nil {
+		t.Error("NewRedisCache() error = nil, want error for a master the sentinel doesn't know")
+	}
+}
@@ -0,0 +1,21 @@
+package domain
+
+import "fmt"
+
+// DeliveryStatus is the final delivery state of a sent message as reported by the provider
+type DeliveryStatus string
+
+const (
+	DeliveryDelivered   DeliveryStatus = "delivered"
+	DeliveryUndelivered DeliveryStatus = "undelivered"
+)
+
+// Validate checks whether the delivery status is a known one
+func (s DeliveryStatus) Validate() error {
+	switch s {
+	case DeliveryDelivered, DeliveryUndelivered:
+		return nil
+	default:
+		return fmt.Errorf("unknown delivery status %q", string(s))
+	}
+}
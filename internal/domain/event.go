@@ -0,0 +1,10 @@
+package domain
+
+import "time"
+
+// MessageSentEvent is published when a message is accepted by the webhook
+type MessageSentEvent struct {
+	ID                int       `json:"id"`
+	ProviderMessageID *string   `json:"providerMessageId"`
+	SentAt            time.Time `json:"sentAt"`
+}
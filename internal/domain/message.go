@@ -1,28 +1,88 @@
 package domain
 
 import (
+	"errors"
+	"fmt"
 	"time"
+	"unicode/utf8"
 )
 
-type MessageStatus int
+// MaxContentLength is the maximum number of characters allowed in a message content
+const MaxContentLength = 160
 
-const (
-	StatusPending MessageStatus = iota
-	StatusProcessing
-	StatusSuccess
-	StatusFailed
+// MaxLastErrorLength is the maximum number of characters of the last error kept on a message
+const MaxLastErrorLength = 512
+
+var (
+	ErrEmptyContent     = errors.New("message content is empty")
+	ErrContentTooLong   = fmt.Errorf("message content exceeds %d characters", MaxContentLength)
+	ErrEmptyPhoneNumber = errors.New("message phone number is empty")
 )
 
 type Message struct {
-	ID          int        `gorm:"primaryKey" json:"id"`
-	Content     string     `gorm:"type:varchar(160);not null" json:"content"`
-	PhoneNumber string     `gorm:"type:varchar(20);not null" json:"phone_number"`
-	Status      int        `gorm:"type:int;not null" json:"status"`
-	CreatedAt   time.Time  `json:"created_at"`
-	UpdatedAt   *time.Time `json:"updated_at"`
+	ID      int    `gorm:"primaryKey" json:"id"`
+	Content string `gorm:"type:varchar(160);not null" json:"content"`
+	// Template is interpolated with Variables to create the content just before the message is sent, e.g. "Hi {{.name}}"
+	Template string `gorm:"type:text" json:"template,omitempty"`
+	// Variables are the per recipient values of the template
+	Variables   map[string]string `gorm:"type:text;serializer:json" json:"variables,omitempty"`
+	PhoneNumber string            `gorm:"type:varchar(20);not null" json:"phone_number"`
+	Status      MessageStatus     `gorm:"type:int;not null" json:"status" swaggertype:"string" enums:"pending,processing,success,failed,dead_letter,rejected"`
+	RetryCount  int               `gorm:"type:int;not null;default:0" json:"retry_count"`
+	// Version is incremented on every status change to detect concurrent updates
+	Version     int        `gorm:"type:int;not null;default:0" json:"-"`
+	ScheduledAt *time.Time `gorm:"index" json:"scheduled_at"`
+	// IdempotencyKey is an optional client provided key that prevents the same message from being enqueued twice
+	IdempotencyKey *string `gorm:"type:varchar(255);uniqueIndex" json:"idempotency_key,omitempty"`
+	// BroadcastID groups the messages that are created from the same broadcast
+	BroadcastID *string `gorm:"type:varchar(36);index" json:"broadcast_id,omitempty"`
+	// ProviderMessageID is the message id returned by the webhook when the message is sent
+	ProviderMessageID *string `gorm:"type:varchar(255);index" json:"provider_message_id,omitempty"`
+	// DeliveryStatus is reported by the provider after the message is sent, empty until then
+	DeliveryStatus *DeliveryStatus `gorm:"type:varchar(20)" json:"delivery_status,omitempty" swaggertype:"string" enums:"delivered,undelivered"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      *time.Time      `json:"updated_at"`
+	// SentAt is the time the message is accepted by the webhook, empty until then
+	SentAt *time.Time `json:"sent_at"`
+	// LastError describes why the last attempt to send the message failed, empty if no attempt failed
+	LastError *string `gorm:"type:varchar(512)" json:"last_error,omitempty"`
+}
+
+// Validate checks whether the message can be stored and sent. The content of a templated message
+// is validated by rendering its template.
+func (m *Message) Validate() error {
+	content, err := m.RenderContent()
+	if err != nil {
+		return err
+	}
+	contentLen := utf8.RuneCountInString(content)
+	if contentLen == 0 {
+		return ErrEmptyContent
+	}
+	if contentLen > MaxContentLength {
+		return ErrContentTooLong
+	}
+	if m.PhoneNumber == "" {
+		return ErrEmptyPhoneNumber
+	}
+	return nil
 }
 
 type WebhookResponse struct {
 	MessageID string `json:"messageId"`
 	Message   string `json:"message"`
 }
+
+// MessagePage represents a page of messages along with pagination metadata
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	Total    int64     `json:"total"`
+	// NextOffset is the offset of the next page, nil if there are no more messages
+	NextOffset *int `json:"next_offset"`
+}
+
+// CachedMessage represents sent message metadata that is kept in cache
+type CachedMessage struct {
+	MessageID string    `json:"messageId"`
+	SentAt    time.Time `json:"sentAt"`
+}
@@ -0,0 +1,31 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMessageValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		phoneNumber string
+		wantErr     error
+	}{
+		{name: "single character", content: "a", phoneNumber: "+905549998877"},
+		{name: "exactly 160 characters", content: strings.Repeat("a", 160), phoneNumber: "+905549998877"},
+		{name: "160 multibyte characters", content: strings.Repeat("ş", 160), phoneNumber: "+905549998877"},
+		{name: "161 characters", content: strings.Repeat("a", 161), phoneNumber: "+905549998877", wantErr: ErrContentTooLong},
+		{name: "empty content", content: "", phoneNumber: "+905549998877", wantErr: ErrEmptyContent},
+		{name: "empty phone number", content: "hello", phoneNumber: "", wantErr: ErrEmptyPhoneNumber},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := Message{Content: tt.content, PhoneNumber: tt.phoneNumber}
+			if err := msg.Validate(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+var ErrInvalidPhoneNumber = errors.New("invalid phone number")
+
+// NormalizePhoneNumber parses the given phone number and returns it in E.164 format.
+// A number without a country code is parsed as a national number of the given default region, e.g. "TR",
+// and rejected if the default region is empty.
+func NormalizePhoneNumber(phoneNumber, defaultRegion string) (string, error) {
+	parsed, err := phonenumbers.Parse(phoneNumber, defaultRegion)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPhoneNumber, err.Error())
+	}
+	if !phonenumbers.IsValidNumber(parsed) {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPhoneNumber, phoneNumber)
+	}
+
+	return phonenumbers.Format(parsed, phonenumbers.E164), nil
+}
+
+// IsSupportedRegion reports whether the given ISO 3166-1 alpha-2 code is a region phone numbers can be parsed for
+func IsSupportedRegion(region string) bool {
+	return phonenumbers.GetSupportedRegions()[region]
+}
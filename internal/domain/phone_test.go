@@ -0,0 +1,47 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	tests := []struct {
+		name        string
+		phoneNumber string
+		region      string
+		want        string
+		wantErr     bool
+	}{
+		{name: "e164", phoneNumber: "+905549998877", want: "+905549998877"},
+		{name: "e164 with spaces", phoneNumber: "+90 554 999 88 77", want: "+905549998877"},
+		{name: "international prefix", phoneNumber: "00905549998877", region: "TR", want: "+905549998877"},
+		{name: "local with trunk prefix", phoneNumber: "0554 999 88 77", region: "TR", want: "+905549998877"},
+		{name: "local with punctuation", phoneNumber: "(554) 999-8877", region: "TR", want: "+905549998877"},
+		{name: "national without default region", phoneNumber: "05549998877", wantErr: true},
+		{name: "national of another region", phoneNumber: "05549998877", region: "US", wantErr: true},
+		{name: "e164 with another default region", phoneNumber: "+905549998877", region: "US", want: "+905549998877"},
+		{name: "empty", phoneNumber: "", wantErr: true},
+		{name: "letters", phoneNumber: "not a number", wantErr: true},
+		{name: "too short", phoneNumber: "+90554", wantErr: true},
+		{name: "too long", phoneNumber: "+9055499988771234", wantErr: true},
+		{name: "unassigned country code", phoneNumber: "+9995549998877", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizePhoneNumber(tt.phoneNumber, tt.region)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidPhoneNumber) {
+					t.Errorf("NormalizePhoneNumber(%q) error = %v, want %v", tt.phoneNumber, err, ErrInvalidPhoneNumber)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizePhoneNumber(%q) error = %v", tt.phoneNumber, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizePhoneNumber(%q) = %q, want %q", tt.phoneNumber, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type MessageStatus int
+
+const (
+	StatusPending MessageStatus = iota
+	StatusProcessing
+	StatusSuccess
+	StatusFailed
+	// StatusDeadLetter indicates retries are exhausted after transient errors such as 5xx responses
+	StatusDeadLetter
+	// StatusRejected indicates the message can't be delivered by retrying, e.g. a 4xx response or an invalid phone number
+	StatusRejected
+)
+
+var ErrUnknownStatus = errors.New("unknown message status")
+
+var statusNames = map[MessageStatus]string{
+	StatusPending:    "pending",
+	StatusProcessing: "processing",
+	StatusSuccess:    "success",
+	StatusFailed:     "failed",
+	StatusDeadLetter: "dead_letter",
+	StatusRejected:   "rejected",
+}
+
+// MessageStatuses returns all known message statuses in ascending order
+func MessageStatuses() []MessageStatus {
+	return []MessageStatus{StatusPending, StatusProcessing, StatusSuccess, StatusFailed, StatusDeadLetter, StatusRejected}
+}
+
+// ParseMessageStatus maps the given status name to its message status
+func ParseMessageStatus(name string) (MessageStatus, error) {
+	for status, statusName := range statusNames {
+		if statusName == name {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnknownStatus, name)
+}
+
+// String returns the name of the status. Unknown values are formatted as "unknown(<value>)"
+func (s MessageStatus) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// MarshalJSON encodes the status as its name
+func (s MessageStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON decodes the status from its name
+func (s *MessageStatus) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+
+	status, err := ParseMessageStatus(name)
+	if err != nil {
+		return err
+	}
+	*s = status
+	return nil
+}
@@ -0,0 +1,59 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestMessageStatusJSONRoundTrip(t *testing.T) {
+	for _, status := range MessageStatuses() {
+		data, err := json.Marshal(status)
+		if err != nil {
+			t.Fatalf("Marshal(%d) error = %v", status, err)
+		}
+		if want := `"` + statusNames[status] + `"`; string(data) != want {
+			t.Errorf("Marshal(%d) = %s, want %s", status, data, want)
+		}
+
+		var got MessageStatus
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", data, err)
+		}
+		if got != status {
+			t.Errorf("Unmarshal(%s) = %d, want %d", data, got, status)
+		}
+	}
+}
+
+func TestMessageStatusUnmarshalRejectsUnknown(t *testing.T) {
+	for _, data := range []string{`"delivered"`, `""`, `2`} {
+		var status MessageStatus
+		if err := json.Unmarshal([]byte(data), &status); err == nil {
+			t.Errorf("Unmarshal(%s) error = nil, want error", data)
+		}
+	}
+
+	var status MessageStatus
+	if err := json.Unmarshal([]byte(`"delivered"`), &status); !errors.Is(err, ErrUnknownStatus) {
+		t.Errorf("Unmarshal() error = %v, want %v", err, ErrUnknownStatus)
+	}
+}
+
+func TestUnknownMessageStatusString(t *testing.T) {
+	for status, want := range map[MessageStatus]string{
+		MessageStatus(42): "unknown(42)",
+		MessageStatus(-1): "unknown(-1)",
+	} {
+		if got := status.String(); got != want {
+			t.Errorf("MessageStatus(%d).String() = %q, want %q", int(status), got, want)
+		}
+		data, err := json.Marshal(status)
+		if err != nil {
+			t.Fatalf("Marshal(%d) error = %v", int(status), err)
+		}
+		if string(data) != `"`+want+`"` {
+			t.Errorf("Marshal(%d) = %s, want %q", int(status), data, want)
+		}
+	}
+}
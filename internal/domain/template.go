@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+var ErrInvalidTemplate = errors.New("invalid message template")
+
+// RenderContent interpolates the template of the message with its variables, e.g. "Hi {{.name}}".
+// The content is returned as is if the message has no template.
+func (m *Message) RenderContent() (string, error) {
+	if m.Template == "" {
+		return m.Content, nil
+	}
+
+	tmpl, err := template.New("content").Option("missingkey=error").Parse(m.Template)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+	}
+
+	variables := m.Variables
+	if variables == nil {
+		variables = map[string]string{}
+	}
+	buf := new(strings.Builder)
+	if err := tmpl.Execute(buf, variables); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRenderContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     Message
+		want    string
+		wantErr error
+	}{
+		{name: "without template", msg: Message{Content: "Hi {{.name}}"}, want: "Hi {{.name}}"},
+		{name: "with variables", msg: Message{Template: "Hi {{.name}}, your code is {{.code}}", Variables: map[string]string{"name": "Ada", "code": "42"}}, want: "Hi Ada, your code is 42"},
+		{name: "unused variables", msg: Message{Template: "Hello", Variables: map[string]string{"name": "Ada"}}, want: "Hello"},
+		{name: "missing variable", msg: Message{Template: "Hi {{.name}}", Variables: map[string]string{"code": "42"}}, wantErr: ErrInvalidTemplate},
+		{name: "without variables", msg: Message{Template: "Hi {{.name}}"}, wantErr: ErrInvalidTemplate},
+		{name: "malformed template", msg: Message{Template: "Hi {{.name", Variables: map[string]string{"name": "Ada"}}, wantErr: ErrInvalidTemplate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.msg.RenderContent()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RenderContent() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("RenderContent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRendersTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     Message
+		wantErr error
+	}{
+		{name: "rendered within the limit", msg: Message{Template: "Hi {{.name}}", Variables: map[string]string{"name": "Ada"}}},
+		{name: "rendered beyond the limit", msg: Message{Template: "Hi {{.name}}", Variables: map[string]string{"name": strings.Repeat("a", MaxContentLength)}}, wantErr: ErrContentTooLong},
+		{name: "rendered empty", msg: Message{Template: "{{.name}}", Variables: map[string]string{"name": ""}}, wantErr: ErrEmptyContent},
+		{name: "malformed template", msg: Message{Template: "Hi {{"}, wantErr: ErrInvalidTemplate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.msg.PhoneNumber = "+905549998877"
+			if err := tt.msg.Validate(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
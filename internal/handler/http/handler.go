@@ -2,18 +2,80 @@ package handler
 
 import (
 	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	_ "github.com/aniladanir/auto-messender-service/docs"
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	messageRepo "github.com/aniladanir/auto-messender-service/internal/repository/message"
 	"github.com/aniladanir/auto-messender-service/internal/service"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
 
+const (
+	defaultPageLimit   = 50
+	maxPageLimit       = 500
+	healthCheckTimeout = time.Second * 2
+)
+
+// HealthCheck reports whether a dependency of the service is healthy
+type HealthCheck func(ctx context.Context) error
+
+type createMessageRequest struct {
+	Content string `json:"content"`
+	// Template is rendered with Variables instead of sending Content, e.g. "Hi {{.name}}"
+	Template    string            `json:"template"`
+	Variables   map[string]string `json:"variables"`
+	PhoneNumber string            `json:"phone_number"`
+	// ScheduledAt is the earliest time the message is sent at, sent as soon as possible if empty
+	ScheduledAt *time.Time `json:"scheduled_at"`
+}
+
+type broadcastRequest struct {
+	Content      string   `json:"content"`
+	PhoneNumbers []string `json:"phone_numbers"`
+	// ScheduledAt is the earliest time the messages are sent at, sent as soon as possible if empty
+	ScheduledAt *time.Time `json:"scheduled_at"`
+}
+
+type deliveryCallbackRequest struct {
+	MessageID string                `json:"messageId"`
+	Status    domain.DeliveryStatus `json:"status" swaggertype:"string" enums:"delivered,undelivered"`
+}
+
+type intervalRequest struct {
+	// Interval is a duration such as "30s" or "2m"
+	Interval string `json:"interval" example:"2m"`
+}
+
+type requeueRequest struct {
+	Status domain.MessageStatus `json:"status" swaggertype:"string" enums:"failed,dead_letter,rejected"`
+}
+
+type batchSizeRequest struct {
+	BatchSize int `json:"batch_size" example:"10"`
+}
+
 type Handler struct {
-	msgSender service.MessageSender
-	server    *http.Server
+	msgSender      service.MessageSender
+	healthChecks   map[string]HealthCheck
+	apiKey         string
+	callbackSecret string
+	logger         *slog.Logger
+	tlsCertFile    string
+	tlsKeyFile     string
+	corsOrigins    []string
+	corsMethods    []string
+	corsHeaders    []string
+	server         *http.Server
 }
 
 // @title Auto Messenger API
@@ -21,19 +83,54 @@ type Handler struct {
 // @description API for automatic message sending service
 // @host localhost:6060
 // @BasePath /
-func NewHttpHandler(addr string, svc service.MessageSender) *Handler {
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name X-API-Key
+func NewHttpHandler(addr string, svc service.MessageSender, healthChecks map[string]HealthCheck, opts ...Option) *Handler {
 	h := &Handler{
-		msgSender: svc,
+		msgSender:    svc,
+		healthChecks: healthChecks,
+		logger:       slog.Default(),
+		corsMethods:  defaultCorsMethods,
+		corsHeaders:  defaultCorsHeaders,
+	}
+	for _, o := range opts {
+		o(h)
 	}
 
 	// create router
-	router := gin.Default()
+	router := gin.New()
+	router.Use(h.logRequests, gin.Recovery(), h.cors)
 
 	// register routes
-	router.POST("/start", h.startProcess)
-	router.POST("/stop", h.stopProcess)
-	router.GET("/messages", h.getSentMessages)
+	router.GET("/status", h.getStatus)
+	router.GET("/stats", h.getStats)
+	router.GET("/healthz", h.liveness)
+	router.GET("/readyz", h.readiness)
+	router.GET("/messages", h.getMessages)
+	router.GET("/messages/summary", h.getMessageSummary)
+	router.GET("/messages/export", h.exportMessages)
+	router.GET("/messages/:id", h.getMessage)
+	// the segment is the messageId returned from the webhook, it's named id since gin requires sibling routes
+	// to share the wildcard name
+	router.GET("/messages/:id/cache", h.getCachedMessage)
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	// the provider calling back doesn't hold the api key, callbacks are authenticated by their signature instead
+	router.POST("/callbacks/delivery", h.verifySignature, h.deliveryCallback)
+
+	// register mutating routes that require authentication
+	protected := router.Group("/", h.authenticate)
+	protected.POST("/start", h.startProcess)
+	protected.POST("/stop", h.stopProcess)
+	protected.POST("/messages", h.createMessage)
+	protected.POST("/messages/batch", h.createMessages)
+	protected.POST("/messages/broadcast", h.createBroadcast)
+	protected.POST("/messages/flush", h.flushMessages)
+	protected.POST("/messages/requeue", h.requeueMessages)
+	protected.POST("/messages/:id/resend", h.resendMessage)
+	protected.PATCH("/config/interval", h.setInterval)
+	protected.PATCH("/config/batch-size", h.setBatchSize)
 
 	// create http server
 	h.server = &http.Server{
@@ -45,6 +142,9 @@ func NewHttpHandler(addr string, svc service.MessageSender) *Handler {
 }
 
 func (h *Handler) Run() error {
+	if h.tlsCertFile != "" && h.tlsKeyFile != "" {
+		return h.server.ListenAndServeTLS(h.tlsCertFile, h.tlsKeyFile)
+	}
 	return h.server.ListenAndServe()
 }
 
@@ -57,6 +157,8 @@ func (h *Handler) Shutdown(ctx context.Context) error {
 // @Description Starts the background process that sends x messages every y minutes
 // @Tags Control
 // @Success 200
+// @Failure 401
+// @Security ApiKeyAuth
 // @Router /start [post]
 func (h *Handler) startProcess(c *gin.Context) {
 	h.msgSender.Start()
@@ -68,23 +170,587 @@ func (h *Handler) startProcess(c *gin.Context) {
 // @Description Stops the background sending process
 // @Tags Control
 // @Success 200
+// @Failure 401
+// @Security ApiKeyAuth
 // @Router /stop [post]
 func (h *Handler) stopProcess(c *gin.Context) {
-	h.msgSender.Stop()
+	// the stop outlives the request so a disconnecting client doesn't cut the in-flight batch short
+	if err := h.msgSender.Stop(context.WithoutCancel(c.Request.Context())); err != nil {
+		h.logger.Error("failed to stop the message sender", "error", err.Error())
+		c.Status(http.StatusInternalServerError)
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
-// GetSentMessages godoc
-// @Summary Get list of sent messages
-// @Description Retrieves all messages marked as sent
+// GetStats godoc
+// @Summary Get send statistics
+// @Description Returns the number of messages sent and failed by this instance in the last minute and hour,
+// @Description the success ratio and the average webhook latency of the last hour
+// @Tags Control
+// @Produce json
+// @Success 200 {object} service.Stats
+// @Router /stats [get]
+func (h *Handler) getStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.msgSender.GetStats())
+}
+
+// GetStatus godoc
+// @Summary Get sender status
+// @Description Returns whether the automatic message sender is running along with its interval and batch size
+// @Tags Control
+// @Success 200 {object} service.Status
+// @Router /status [get]
+func (h *Handler) getStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, h.msgSender.GetStatus())
+}
+
+// Liveness godoc
+// @Summary Liveness probe
+// @Description Returns 200 as long as the process is up
+// @Tags Health
+// @Success 200
+// @Router /healthz [get]
+func (h *Handler) liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readiness godoc
+// @Summary Readiness probe
+// @Description Checks the database and cache, returns 503 naming the unhealthy dependencies if any check fails
+// @Tags Health
+// @Success 200
+// @Failure 503
+// @Router /readyz [get]
+func (h *Handler) readiness(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+	defer cancel()
+
+	unhealthy := make(map[string]string)
+	for name, check := range h.healthChecks {
+		if err := check(ctx); err != nil {
+			unhealthy[name] = err.Error()
+		}
+	}
+	if len(unhealthy) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "unhealthy": unhealthy})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GetMessages godoc
+// @Summary Get list of messages
+// @Description Retrieves a page of messages with the given status, defaults to messages marked as sent.
+// @Description If broadcast_id is given, messages of the broadcast are returned in any status unless status is given too.
 // @Tags Messages
-// @Success 200 {array} domain.Message
+// @Param status query string false "Message status" Enums(pending, processing, success, failed, dead_letter, rejected)
+// @Param broadcast_id query string false "Broadcast id to filter messages by"
+// @Param limit query int false "Maximum number of messages to return (default 50, max 500)"
+// @Param offset query int false "Number of messages to skip"
+// @Success 200 {object} domain.MessagePage
+// @Failure 400
 // @Router /messages [get]
-func (h *Handler) getSentMessages(c *gin.Context) {
-	msgs, err := h.msgSender.GetSentMessages()
+func (h *Handler) getMessages(c *gin.Context) {
+	limit, offset, err := parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var status *domain.MessageStatus
+	if val := c.Query("status"); val != "" {
+		parsed, err := domain.ParseMessageStatus(val)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		status = &parsed
+	}
+
+	var page *domain.MessagePage
+	if broadcastID := c.Query("broadcast_id"); broadcastID != "" {
+		page, err = h.msgSender.GetBroadcastMessages(broadcastID, status, limit, offset)
+	} else if status != nil {
+		page, err = h.msgSender.GetMessagesByStatus(c.Request.Context(), *status, limit, offset)
+	} else {
+		page, err = h.msgSender.GetSentMessages(c.Request.Context(), limit, offset)
+	}
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// ExportMessages godoc
+// @Summary Export messages
+// @Description Streams the messages with the given status as a file, defaults to messages marked as sent.
+// @Description Only csv format is supported.
+// @Tags Messages
+// @Produce text/csv
+// @Param format query string false "Export format" Enums(csv)
+// @Param status query string false "Message status" Enums(pending, processing, success, failed, dead_letter, rejected)
+// @Success 200 {file} file
+// @Failure 400
+// @Router /messages/export [get]
+func (h *Handler) exportMessages(c *gin.Context) {
+	if format := c.DefaultQuery("format", "csv"); format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported export format: %s", format)})
+		return
+	}
+
+	status := domain.StatusSuccess
+	if val := c.Query("status"); val != "" {
+		parsed, err := domain.ParseMessageStatus(val)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		status = parsed
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", `attachment; filename="messages.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	err := w.Write([]string{"id", "phone_number", "content", "status", "created_at", "sent_at"})
+	if err == nil {
+		err = h.msgSender.ExportMessages(status, func(msg domain.Message) error {
+			sentAt := ""
+			if msg.SentAt != nil {
+				sentAt = msg.SentAt.UTC().Format(time.RFC3339)
+			}
+			return w.Write([]string{
+				strconv.Itoa(msg.ID),
+				msg.PhoneNumber,
+				msg.Content,
+				msg.Status.String(),
+				msg.CreatedAt.UTC().Format(time.RFC3339),
+				sentAt,
+			})
+		})
+	}
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		// the status is already sent, so the export can only be cut short
+		h.logger.Error("failed to export messages", "error", err.Error())
+		c.Abort()
+	}
+}
+
+// GetMessage godoc
+// @Summary Get message
+// @Description Retrieves a single message by its id
+// @Tags Messages
+// @Produce json
+// @Param id path int true "Message id"
+// @Success 200 {object} domain.Message
+// @Failure 400
+// @Failure 404
+// @Router /messages/{id} [get]
+func (h *Handler) getMessage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id must be a positive integer"})
+		return
+	}
+
+	msg, err := h.msgSender.GetMessage(id)
+	if errors.Is(err, messageRepo.ErrMessageNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, msg)
+}
+
+// GetMessageSummary godoc
+// @Summary Get message counts by status
+// @Description Returns the number of messages in each status
+// @Tags Messages
+// @Success 200 {object} map[string]int64
+// @Router /messages/summary [get]
+func (h *Handler) getMessageSummary(c *gin.Context) {
+	summary, err := h.msgSender.GetStatusSummary()
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// CreateMessage godoc
+// @Summary Create message
+// @Description Validates the given message and enqueues it for sending. If the Idempotency-Key header
+// @Description matches a previously created message, the existing message is returned instead.
+// @Tags Messages
+// @Accept json
+// @Produce json
+// @Param Idempotency-Key header string false "Key that prevents the message from being enqueued twice"
+// @Param message body createMessageRequest true "Message to create"
+// @Success 201 {object} domain.Message
+// @Success 200 {object} domain.Message "Message with the same idempotency key already exists"
+// @Failure 400
+// @Failure 401
+// @Security ApiKeyAuth
+// @Router /messages [post]
+func (h *Handler) createMessage(c *gin.Context) {
+	var req createMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	msg := domain.Message{
+		Content:     req.Content,
+		Template:    req.Template,
+		Variables:   req.Variables,
+		PhoneNumber: req.PhoneNumber,
+		ScheduledAt: req.ScheduledAt,
+	}
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		msg.IdempotencyKey = &key
+	}
+
+	created, isNew, err := h.msgSender.CreateMessage(msg)
+	if errors.Is(err, service.ErrInvalidMessage) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	if isNew {
+		c.JSON(http.StatusCreated, created)
+	} else {
+		c.JSON(http.StatusOK, created)
+	}
+}
+
+// CreateMessages godoc
+// @Summary Create messages in batch
+// @Description Validates the given messages and enqueues the valid ones for sending in a single transaction
+// @Tags Messages
+// @Accept json
+// @Produce json
+// @Param messages body []createMessageRequest true "Messages to create"
+// @Success 201 {array} service.CreateResult
+// @Failure 400 {array} service.CreateResult
+// @Failure 413
+// @Failure 401
+// @Security ApiKeyAuth
+// @Router /messages/batch [post]
+func (h *Handler) createMessages(c *gin.Context) {
+	var req []createMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no messages given"})
+		return
+	}
+
+	msgs := make([]domain.Message, 0, len(req))
+	for _, r := range req {
+		msgs = append(msgs, domain.Message{
+			Content:     r.Content,
+			Template:    r.Template,
+			Variables:   r.Variables,
+			PhoneNumber: r.PhoneNumber,
+			ScheduledAt: r.ScheduledAt,
+		})
+	}
+
+	results, err := h.msgSender.CreateMessages(msgs)
+	if errors.Is(err, service.ErrBatchTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	// respond with bad request only if none of the messages could be created
+	for _, result := range results {
+		if result.Error == "" {
+			c.JSON(http.StatusCreated, results)
+			return
+		}
+	}
+	c.JSON(http.StatusBadRequest, results)
+}
+
+// CreateBroadcast godoc
+// @Summary Broadcast message
+// @Description Enqueues the same content for each of the given phone numbers in a single transaction,
+// @Description grouped under a generated broadcast id. Nothing is created if any of the numbers is invalid.
+// @Tags Messages
+// @Accept json
+// @Produce json
+// @Param broadcast body broadcastRequest true "Content and recipients of the broadcast"
+// @Success 201 {object} service.Broadcast
+// @Failure 400
+// @Failure 401
+// @Failure 413
+// @Security ApiKeyAuth
+// @Router /messages/broadcast [post]
+func (h *Handler) createBroadcast(c *gin.Context) {
+	var req broadcastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	broadcast, err := h.msgSender.CreateBroadcast(req.Content, req.PhoneNumbers, req.ScheduledAt)
+	if errors.Is(err, service.ErrInvalidMessage) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, service.ErrBatchTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusCreated, broadcast)
+}
+
+// FlushMessages godoc
+// @Summary Send a batch now
+// @Description Processes a batch of pending messages immediately, out of the schedule, and returns the number of messages handled
+// @Tags Control
+// @Produce json
+// @Success 200
+// @Failure 401
+// @Failure 409 "A batch is already in progress"
+// @Failure 503 "Circuit breaker is open"
+// @Security ApiKeyAuth
+// @Router /messages/flush [post]
+func (h *Handler) flushMessages(c *gin.Context) {
+	processed, err := h.msgSender.TriggerBatch(c.Request.Context())
+	if errors.Is(err, service.ErrBatchInProgress) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, service.ErrCircuitOpen) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"processed": processed})
+}
+
+// RequeueMessages godoc
+// @Summary Requeue messages
+// @Description Resets all failed, dead lettered or rejected messages back to pending with their retries zeroed so they are sent again,
+// @Description e.g. once a webhook outage is resolved. Returns the number of messages requeued.
+// @Tags Control
+// @Accept json
+// @Produce json
+// @Param requeue body requeueRequest true "Status of the messages to requeue"
+// @Success 200
+// @Failure 400
+// @Failure 401
+// @Security ApiKeyAuth
+// @Router /messages/requeue [post]
+func (h *Handler) requeueMessages(c *gin.Context) {
+	var req requeueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	requeued, err := h.msgSender.RequeueMessages(req.Status)
+	if errors.Is(err, service.ErrNotRequeueable) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requeued": requeued})
+}
+
+// ResendMessage godoc
+// @Summary Resend a message
+// @Description Resets a single message back to pending with its retries zeroed so it is sent again in a later batch,
+// @Description whatever its status is. A message that is being processed can't be resent.
+// @Tags Control
+// @Produce json
+// @Param id path int true "Message id"
+// @Success 200 {object} domain.Message
+// @Failure 400
+// @Failure 401
+// @Failure 404
+// @Failure 409
+// @Security ApiKeyAuth
+// @Router /messages/{id}/resend [post]
+func (h *Handler) resendMessage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id must be a positive integer"})
+		return
+	}
+
+	msg, err := h.msgSender.ResendMessage(id)
+	if errors.Is(err, messageRepo.ErrMessageNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	} else if errors.Is(err, messageRepo.ErrMessageProcessing) || errors.Is(err, messageRepo.ErrConcurrentUpdate) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, msg)
+}
+
+// DeliveryCallback godoc
+// @Summary Report delivery status
+// @Description Called by the provider to report the final delivery status of a message by the message id it returned.
+// @Description The body must be signed with the webhook signing secret, if no secret is configured the api key is required instead.
+// @Tags Callbacks
+// @Accept json
+// @Param X-Signature header string false "Hex encoded HMAC-SHA256 of the request body"
+// @Param callback body deliveryCallbackRequest true "Delivery status of the message"
+// @Success 200
+// @Failure 400
+// @Failure 401
+// @Failure 404
+// @Failure 413
+// @Router /callbacks/delivery [post]
+func (h *Handler) deliveryCallback(c *gin.Context) {
+	var req deliveryCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.msgSender.RecordDelivery(req.MessageID, req.Status)
+	if errors.Is(err, service.ErrInvalidMessage) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, messageRepo.ErrMessageNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// SetInterval godoc
+// @Summary Change the send interval
+// @Description Changes the interval between batches without a restart, the running scheduler processes its next batch after the new interval
+// @Tags Control
+// @Accept json
+// @Produce json
+// @Param interval body intervalRequest true "New send interval"
+// @Success 200 {object} service.Status
+// @Failure 400
+// @Failure 401
+// @Security ApiKeyAuth
+// @Router /config/interval [patch]
+func (h *Handler) setInterval(c *gin.Context) {
+	var req intervalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	interval, err := time.ParseDuration(req.Interval)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.msgSender.SetInterval(interval); errors.Is(err, service.ErrInvalidInterval) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
 		c.Status(http.StatusInternalServerError)
 		return
 	}
-	c.JSON(http.StatusOK, msgs)
+	c.JSON(http.StatusOK, h.msgSender.GetStatus())
+}
+
+// SetBatchSize godoc
+// @Summary Change the batch size
+// @Description Changes the number of messages sent in each batch without a restart, starting with the next batch
+// @Tags Control
+// @Accept json
+// @Produce json
+// @Param batchSize body batchSizeRequest true "New batch size"
+// @Success 200 {object} service.Status
+// @Failure 400
+// @Failure 401
+// @Security ApiKeyAuth
+// @Router /config/batch-size [patch]
+func (h *Handler) setBatchSize(c *gin.Context) {
+	var req batchSizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.msgSender.SetBatchSize(req.BatchSize); errors.Is(err, service.ErrInvalidBatchSize) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, h.msgSender.GetStatus())
+}
+
+// GetCachedMessage godoc
+// @Summary Get cached sent message
+// @Description Retrieves cached metadata of a sent message by the messageId returned from the webhook.
+// @Description The path parameter is the messageId of the webhook response, not the id of the message.
+// @Tags Messages
+// @Param id path string true "messageId returned from the webhook"
+// @Success 200 {object} domain.CachedMessage
+// @Failure 404
+// @Router /messages/{id}/cache [get]
+func (h *Handler) getCachedMessage(c *gin.Context) {
+	cachedMsg, err := h.msgSender.GetCachedMessage(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	if cachedMsg == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, cachedMsg)
+}
+
+// parsePagination reads limit and offset query parameters, applying the default and maximum page limit
+func parsePagination(c *gin.Context) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if val := c.Query("limit"); val != "" {
+		if limit, err = strconv.Atoi(val); err != nil || limit <= 0 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+		limit = min(limit, maxPageLimit)
+	}
+
+	if val := c.Query("offset"); val != "" {
+		if offset, err = strconv.Atoi(val); err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, nil
 }
@@ -0,0 +1,973 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aniladanir/auto-messender-service/internal/cache/memory"
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
+	"github.com/aniladanir/auto-messender-service/internal/persistant/sqlite"
+	messageRepo "github.com/aniladanir/auto-messender-service/internal/repository/message"
+	"github.com/aniladanir/auto-messender-service/internal/service"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// fakeSender implements the methods the tests call, the embedded interface panics for the others
+type fakeSender struct {
+	service.MessageSender
+	status     service.Status
+	stats      service.Stats
+	deliveries []string
+	cached     map[string]*domain.CachedMessage
+	// pageQuery is the last page requested from the sender
+	pageQuery pageQuery
+	created   []domain.Message
+	byKey     map[string]*domain.Message
+	stops     int
+	// triggerErr is returned from manually triggered batches
+	triggerErr error
+	messages   map[int]*domain.Message
+}
+
+type pageQuery struct {
+	status        domain.MessageStatus
+	broadcastID   string
+	limit, offset int
+}
+
+func (f *fakeSender) GetSentMessages(ctx context.Context, limit, offset int) (*domain.MessagePage, error) {
+	return f.GetMessagesByStatus(ctx, domain.StatusSuccess, limit, offset)
+}
+
+func (f *fakeSender) GetMessagesByStatus(ctx context.Context, status domain.MessageStatus, limit, offset int) (*domain.MessagePage, error) {
+	f.pageQuery = pageQuery{status: status, limit: limit, offset: offset}
+	next := offset + limit
+	return &domain.MessagePage{Messages: []domain.Message{}, Total: 1000, NextOffset: &next}, nil
+}
+
+// GetBroadcastMessages records the status as pending if it is nil
+func (f *fakeSender) GetBroadcastMessages(broadcastID string, status *domain.MessageStatus, limit, offset int) (*domain.MessagePage, error) {
+	f.pageQuery = pageQuery{broadcastID: broadcastID, limit: limit, offset: offset}
+	if status != nil {
+		f.pageQuery.status = *status
+	}
+	return &domain.MessagePage{Messages: []domain.Message{}}, nil
+}
+
+func (f *fakeSender) GetMessage(id int) (*domain.Message, error) {
+	if msg, ok := f.messages[id]; ok {
+		return msg, nil
+	}
+	return nil, fmt.Errorf("%w: id %d", messageRepo.ErrMessageNotFound, id)
+}
+
+func (f *fakeSender) TriggerBatch(ctx context.Context) (int, error) {
+	return 0, f.triggerErr
+}
+
+func (f *fakeSender) Stop(ctx context.Context) error {
+	f.stops++
+	return nil
+}
+
+func (f *fakeSender) GetStatus() service.Status {
+	return f.status
+}
+
+func (f *fakeSender) GetStats() service.Stats {
+	return f.stats
+}
+
+func (f *fakeSender) GetCachedMessage(ctx context.Context, msgID string) (*domain.CachedMessage, error) {
+	return f.cached[msgID], nil
+}
+
+// CreateMessage returns the message created earlier with the same idempotency key, if any
+func (f *fakeSender) CreateMessage(msg domain.Message) (*domain.Message, bool, error) {
+	if msg.IdempotencyKey != nil {
+		if existing, ok := f.byKey[*msg.IdempotencyKey]; ok {
+			return existing, false, nil
+		}
+	}
+	f.created = append(f.created, msg)
+	created := &msg
+	created.ID = len(f.created)
+	if msg.IdempotencyKey != nil {
+		if f.byKey == nil {
+			f.byKey = make(map[string]*domain.Message)
+		}
+		f.byKey[*msg.IdempotencyKey] = created
+	}
+	return created, true, nil
+}
+
+// CreateMessages reports messages without content as invalid
+func (f *fakeSender) CreateMessages(msgs []domain.Message) ([]service.CreateResult, error) {
+	results := make([]service.CreateResult, len(msgs))
+	for i, msg := range msgs {
+		results[i].Index = i
+		if msg.Content == "" {
+			results[i].Error = domain.ErrEmptyContent.Error()
+			continue
+		}
+		results[i].ID = i + 1
+	}
+	return results, nil
+}
+
+func (f *fakeSender) RecordDelivery(providerMsgID string, status domain.DeliveryStatus) error {
+	f.deliveries = append(f.deliveries, providerMsgID)
+	return nil
+}
+
+// newTestService creates a message sender service on a private in-memory sqlite database, the scheduler isn't started
+func newTestService(t *testing.T, webhookURL string) (service.MessageSender, *gorm.DB) {
+	t.Helper()
+
+	db, err := sqlite.Initialize("file::memory:", []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { persistant.Close(db) })
+
+	repo := messageRepo.NewMessageRepository(db, memory.NewMemoryCache(t.Context()))
+	sender, err := service.NewMessageSenderService(repo, slog.New(slog.DiscardHandler), webhookURL, nil, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("NewMessageSenderService() error = %v", err)
+	}
+	return sender, db
+}
+
+// serve sends the request to a handler built with the given options and returns the response
+func serve(t *testing.T, sender service.MessageSender, req *http.Request, opts ...Option) *httptest.ResponseRecorder {
+	t.Helper()
+
+	h := NewHttpHandler(":0", sender, nil, opts...)
+	rec := httptest.NewRecorder()
+	h.server.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode unmarshals the json response body into v
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response %q: %v", rec.Body.String(), err)
+	}
+}
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestDeliveryCallbackSignature(t *testing.T) {
+	const (
+		secret = "callback-secret"
+		body   = `{"messageId":"provider-1","status":"delivered"}`
+	)
+	tests := []struct {
+		name       string
+		signature  string
+		wantStatus int
+	}{
+		{name: "valid signature", signature: sign(secret, body), wantStatus: http.StatusOK},
+		{name: "missing signature", wantStatus: http.StatusUnauthorized},
+		{name: "signed with another secret", signature: sign("other", body), wantStatus: http.StatusUnauthorized},
+		{name: "malformed signature", signature: "not-hex", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{}
+			req := httptest.NewRequest(http.MethodPost, "/callbacks/delivery", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.signature != "" {
+				req.Header.Set("X-Signature", tt.signature)
+			}
+
+			// the api key is not required from signed callbacks
+			rec := serve(t, sender, req, WithAPIKey("api-key"), WithCallbackSecret(secret))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			wantDeliveries := 0
+			if tt.wantStatus == http.StatusOK {
+				wantDeliveries = 1
+			}
+			if len(sender.deliveries) != wantDeliveries {
+				t.Errorf("recorded %d deliveries, want %d", len(sender.deliveries), wantDeliveries)
+			}
+		})
+	}
+}
+
+func TestDeliveryCallbackBodyIsLimited(t *testing.T) {
+	const secret = "callback-secret"
+	body := `{"messageId":"provider-1","status":"delivered","padding":"` + strings.Repeat("x", maxCallbackBodySize) + `"}`
+	sender := &fakeSender{}
+	req := httptest.NewRequest(http.MethodPost, "/callbacks/delivery", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", sign(secret, body))
+
+	rec := serve(t, sender, req, WithCallbackSecret(secret))
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if len(sender.deliveries) != 0 {
+		t.Errorf("recorded %d deliveries, want none", len(sender.deliveries))
+	}
+}
+
+func TestDeliveryCallbackRequiresAPIKeyWithoutSecret(t *testing.T) {
+	const body = `{"messageId":"provider-1","status":"delivered"}`
+
+	for _, key := range []string{"", "api-key"} {
+		sender := &fakeSender{}
+		req := httptest.NewRequest(http.MethodPost, "/callbacks/delivery", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+
+		rec := serve(t, sender, req, WithAPIKey("api-key"))
+
+		wantStatus := http.StatusUnauthorized
+		if key != "" {
+			wantStatus = http.StatusOK
+		}
+		if rec.Code != wantStatus {
+			t.Errorf("status with api key %q = %d, want %d", key, rec.Code, wantStatus)
+		}
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	sender := &fakeSender{status: service.Status{IsRunning: true, SendInterval: "2m0s", BatchSize: 2, IsLeader: true}}
+
+	rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got service.Status
+	decode(t, rec, &got)
+	if got != sender.status {
+		t.Errorf("response = %+v, want %+v", got, sender.status)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	sender := &fakeSender{stats: service.Stats{SentLastMinute: 3, SentLastHour: 9, FailedLastHour: 1, SuccessRatio: 0.9, AvgLatencyMs: 12.5}}
+
+	rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got service.Stats
+	decode(t, rec, &got)
+	if got != sender.stats {
+		t.Errorf("response = %+v, want %+v", got, sender.stats)
+	}
+}
+
+func TestGetCachedMessage(t *testing.T) {
+	cached := &domain.CachedMessage{MessageID: "provider-1", SentAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	sender := &fakeSender{cached: map[string]*domain.CachedMessage{"provider-1": cached}}
+
+	rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/messages/provider-1/cache", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got domain.CachedMessage
+	decode(t, rec, &got)
+	if got.MessageID != cached.MessageID || !got.SentAt.Equal(cached.SentAt) {
+		t.Errorf("response = %+v, want %+v", got, *cached)
+	}
+
+	rec = serve(t, sender, httptest.NewRequest(http.MethodGet, "/messages/unknown/cache", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status of unknown message = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestGetMessagesPagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantQuery  pageQuery
+	}{
+		{name: "default page", query: "", wantStatus: http.StatusOK, wantQuery: pageQuery{limit: defaultPageLimit}},
+		{name: "custom page", query: "?limit=20&offset=40", wantStatus: http.StatusOK, wantQuery: pageQuery{limit: 20, offset: 40}},
+		{name: "limit is capped", query: "?limit=100000", wantStatus: http.StatusOK, wantQuery: pageQuery{limit: maxPageLimit}},
+		{name: "zero limit", query: "?limit=0", wantStatus: http.StatusBadRequest},
+		{name: "non numeric limit", query: "?limit=ten", wantStatus: http.StatusBadRequest},
+		{name: "negative offset", query: "?offset=-1", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{}
+
+			rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/messages"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			tt.wantQuery.status = domain.StatusSuccess
+			if sender.pageQuery != tt.wantQuery {
+				t.Errorf("requested page = %+v, want %+v", sender.pageQuery, tt.wantQuery)
+			}
+			var page domain.MessagePage
+			decode(t, rec, &page)
+			if page.Total != 1000 || page.NextOffset == nil || *page.NextOffset != tt.wantQuery.offset+tt.wantQuery.limit {
+				t.Errorf("response = %+v, want the pagination metadata of the sender", page)
+			}
+		})
+	}
+}
+
+func TestGetMessagesStatusFilter(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       domain.MessageStatus
+	}{
+		{query: "", wantStatus: http.StatusOK, want: domain.StatusSuccess},
+		{query: "?status=pending", wantStatus: http.StatusOK, want: domain.StatusPending},
+		{query: "?status=processing", wantStatus: http.StatusOK, want: domain.StatusProcessing},
+		{query: "?status=failed", wantStatus: http.StatusOK, want: domain.StatusFailed},
+		{query: "?status=dead_letter", wantStatus: http.StatusOK, want: domain.StatusDeadLetter},
+		{query: "?status=rejected", wantStatus: http.StatusOK, want: domain.StatusRejected},
+		{query: "?status=delivered", wantStatus: http.StatusBadRequest},
+		{query: "?status=2", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		sender := &fakeSender{}
+
+		rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/messages"+tt.query, nil))
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("status of %q = %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusOK && sender.pageQuery.status != tt.want {
+			t.Errorf("requested status of %q = %s, want %s", tt.query, sender.pageQuery.status, tt.want)
+		}
+	}
+}
+
+func TestGetMessagesBroadcastFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  pageQuery
+	}{
+		{query: "?broadcast_id=b-1", want: pageQuery{broadcastID: "b-1", limit: 50}},
+		{query: "?broadcast_id=b-1&status=failed&limit=10&offset=20", want: pageQuery{status: domain.StatusFailed, broadcastID: "b-1", limit: 10, offset: 20}},
+	}
+	for _, tt := range tests {
+		sender := &fakeSender{}
+
+		rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/messages"+tt.query, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("status of %q = %d, want %d", tt.query, rec.Code, http.StatusOK)
+			continue
+		}
+		if sender.pageQuery != tt.want {
+			t.Errorf("query of %q = %+v, want %+v", tt.query, sender.pageQuery, tt.want)
+		}
+	}
+}
+
+func TestCreateMessagesBatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantErrors []int
+	}{
+		{
+			name:       "all valid",
+			body:       `[{"content":"first","phone_number":"+905549998877"},{"content":"second","phone_number":"+905549998877"}]`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "partially invalid",
+			body:       `[{"content":"first","phone_number":"+905549998877"},{"content":"","phone_number":"+905549998877"}]`,
+			wantStatus: http.StatusCreated,
+			wantErrors: []int{1},
+		},
+		{
+			name:       "all invalid",
+			body:       `[{"content":"","phone_number":"+905549998877"}]`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/messages/batch", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			rec := serve(t, &fakeSender{}, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var results []service.CreateResult
+			decode(t, rec, &results)
+			var gotErrors []int
+			for _, result := range results {
+				if result.Error != "" {
+					gotErrors = append(gotErrors, result.Index)
+				}
+			}
+			if !slices.Equal(gotErrors, tt.wantErrors) {
+				t.Errorf("failed indexes = %v, want %v", gotErrors, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestCreateMessageIdempotencyKey(t *testing.T) {
+	const body = `{"content":"hello","phone_number":"+905549998877"}`
+	sender := &fakeSender{}
+	h := NewHttpHandler(":0", sender, nil)
+
+	post := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	wantCodes := []int{http.StatusCreated, http.StatusOK, http.StatusCreated}
+	for i, key := range []string{"request-1", "request-1", ""} {
+		if rec := post(key); rec.Code != wantCodes[i] {
+			t.Errorf("request %d with key %q status = %d, want %d", i+1, key, rec.Code, wantCodes[i])
+		}
+	}
+	if len(sender.created) != 2 {
+		t.Errorf("%d messages are created, want 2", len(sender.created))
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	healthy := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+	tests := []struct {
+		name          string
+		checks        map[string]HealthCheck
+		wantReady     int
+		wantUnhealthy []string
+	}{
+		{name: "healthy", checks: map[string]HealthCheck{"database": healthy, "cache": healthy}, wantReady: http.StatusOK},
+		{name: "database down", checks: map[string]HealthCheck{"database": down, "cache": healthy}, wantReady: http.StatusServiceUnavailable, wantUnhealthy: []string{"database"}},
+		{name: "all down", checks: map[string]HealthCheck{"database": down, "cache": down}, wantReady: http.StatusServiceUnavailable, wantUnhealthy: []string{"cache", "database"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHttpHandler(":0", &fakeSender{}, tt.checks)
+
+			// liveness doesn't depend on the dependencies
+			rec := httptest.NewRecorder()
+			h.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("liveness status = %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			rec = httptest.NewRecorder()
+			h.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.wantReady {
+				t.Fatalf("readiness status = %d, want %d", rec.Code, tt.wantReady)
+			}
+			var body struct {
+				Unhealthy map[string]string `json:"unhealthy"`
+			}
+			decode(t, rec, &body)
+			if got := slices.Sorted(maps.Keys(body.Unhealthy)); !slices.Equal(got, tt.wantUnhealthy) {
+				t.Errorf("unhealthy dependencies = %v, want %v", got, tt.wantUnhealthy)
+			}
+		})
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to the given directory
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestRunServesTLS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedCert(t, t.TempDir())
+
+	// reserve a port for the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	h := NewHttpHandler(addr, &fakeSender{}, nil, WithTLS(certFile, keyFile))
+	runErr := make(chan error, 1)
+	go func() { runErr <- h.Run() }()
+	t.Cleanup(func() {
+		h.Shutdown(context.Background())
+		if err := <-runErr; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Run() error = %v, want %v", err, http.ErrServerClosed)
+		}
+	})
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	t.Cleanup(client.CloseIdleConnections)
+	var resp *http.Response
+	for range 50 {
+		if resp, err = client.Get("https://" + addr + "/healthz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("https request error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp.TLS == nil {
+		t.Error("response is not served over tls")
+	}
+}
+
+func TestFlushMessagesProcessesPendingMessages(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(webhook.Close)
+
+	// the scheduler isn't started, so only the flush sends the messages
+	sender, db := newTestService(t, webhook.URL)
+	msgs := []domain.Message{
+		{Content: "first", PhoneNumber: "+905549998871", Status: domain.StatusPending},
+		{Content: "second", PhoneNumber: "+905549998872", Status: domain.StatusPending},
+	}
+	if err := db.Create(&msgs).Error; err != nil {
+		t.Fatalf("failed to seed messages: %v", err)
+	}
+
+	rec := serve(t, sender, httptest.NewRequest(http.MethodPost, "/messages/flush", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var body struct {
+		Processed int `json:"processed"`
+	}
+	decode(t, rec, &body)
+	if body.Processed != len(msgs) {
+		t.Errorf("processed = %d, want %d", body.Processed, len(msgs))
+	}
+	var sent int64
+	if err := db.Model(&domain.Message{}).Where("status = ?", domain.StatusSuccess).Count(&sent).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if sent != int64(len(msgs)) {
+		t.Errorf("%d messages are sent, want %d", sent, len(msgs))
+	}
+}
+
+func TestRequeueMessages(t *testing.T) {
+	sender, db := newTestService(t, "http://localhost")
+	msgs := []domain.Message{
+		{Content: "first", PhoneNumber: "+905549998871", Status: domain.StatusFailed, RetryCount: 3},
+		{Content: "second", PhoneNumber: "+905549998872", Status: domain.StatusFailed, RetryCount: 2},
+		{Content: "third", PhoneNumber: "+905549998873", Status: domain.StatusDeadLetter, RetryCount: 3},
+	}
+	if err := db.Create(&msgs).Error; err != nil {
+		t.Fatalf("failed to seed messages: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/messages/requeue", strings.NewReader(`{"status":"failed"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := serve(t, sender, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d, body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var body struct {
+		Requeued int64 `json:"requeued"`
+	}
+	decode(t, rec, &body)
+	if body.Requeued != 2 {
+		t.Errorf("requeued = %d, want 2", body.Requeued)
+	}
+
+	want := []domain.MessageStatus{domain.StatusPending, domain.StatusPending, domain.StatusDeadLetter}
+	for i, msg := range msgs {
+		var got domain.Message
+		if err := db.First(&got, msg.ID).Error; err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if got.Status != want[i] {
+			t.Errorf("status of message %d = %s, want %s", i, got.Status, want[i])
+		}
+		if got.Status == domain.StatusPending && got.RetryCount != 0 {
+			t.Errorf("retry count of requeued message %d = %d, want 0", i, got.RetryCount)
+		}
+	}
+}
+
+func TestRequeueMessagesRejectsStatus(t *testing.T) {
+	sender, _ := newTestService(t, "http://localhost")
+
+	for _, body := range []string{`{"status":"processing"}`, `{"status":"success"}`, `{"status":"unknown"}`, `{`} {
+		req := httptest.NewRequest(http.MethodPost, "/messages/requeue", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if rec := serve(t, sender, req); rec.Code != http.StatusBadRequest {
+			t.Errorf("status of requeue with %s = %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestResendMessage(t *testing.T) {
+	lastError := "webhook responded with status 500"
+	tests := []struct {
+		name       string
+		status     domain.MessageStatus
+		wantCode   int
+		wantStatus domain.MessageStatus
+	}{
+		{name: "pending", status: domain.StatusPending, wantCode: http.StatusOK, wantStatus: domain.StatusPending},
+		{name: "success", status: domain.StatusSuccess, wantCode: http.StatusOK, wantStatus: domain.StatusPending},
+		{name: "failed", status: domain.StatusFailed, wantCode: http.StatusOK, wantStatus: domain.StatusPending},
+		{name: "dead letter", status: domain.StatusDeadLetter, wantCode: http.StatusOK, wantStatus: domain.StatusPending},
+		{name: "rejected", status: domain.StatusRejected, wantCode: http.StatusOK, wantStatus: domain.StatusPending},
+		{name: "processing", status: domain.StatusProcessing, wantCode: http.StatusConflict, wantStatus: domain.StatusProcessing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, db := newTestService(t, "http://localhost")
+			msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: tt.status, RetryCount: 3, LastError: &lastError}
+			if tt.status == domain.StatusSuccess {
+				sentAt, providerID, delivery := time.Now().UTC(), "provider-1", domain.DeliveryDelivered
+				msg.SentAt, msg.ProviderMessageID, msg.DeliveryStatus = &sentAt, &providerID, &delivery
+			}
+			if err := db.Create(&msg).Error; err != nil {
+				t.Fatalf("failed to seed message: %v", err)
+			}
+
+			rec := serve(t, sender, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/messages/%d/resend", msg.ID), nil))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d, body: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			var got domain.Message
+			if err := db.First(&got, msg.ID).Error; err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("message status = %s, want %s", got.Status, tt.wantStatus)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			// the message starts over with its retries and error cleared
+			if got.RetryCount != 0 || got.LastError != nil {
+				t.Errorf("message retry count = %d, last error = %v, want them cleared", got.RetryCount, got.LastError)
+			}
+			if got.SentAt != nil || got.ProviderMessageID != nil || got.DeliveryStatus != nil {
+				t.Errorf("message sent at = %v, provider id = %v, delivery status = %v, want them cleared",
+					got.SentAt, got.ProviderMessageID, got.DeliveryStatus)
+			}
+			var body domain.Message
+			decode(t, rec, &body)
+			if body.ID != msg.ID || body.Status != domain.StatusPending {
+				t.Errorf("response = %+v, want message %d as pending", body, msg.ID)
+			}
+		})
+	}
+}
+
+func TestResendMessageNotFound(t *testing.T) {
+	sender, _ := newTestService(t, "http://localhost")
+
+	if rec := serve(t, sender, httptest.NewRequest(http.MethodPost, "/messages/42/resend", nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("status of missing message = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	for _, id := range []string{"0", "-1", "abc"} {
+		if rec := serve(t, sender, httptest.NewRequest(http.MethodPost, "/messages/"+id+"/resend", nil)); rec.Code != http.StatusBadRequest {
+			t.Errorf("status of id %q = %d, want %d", id, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetMessagesStopsWhenClientGoesAway(t *testing.T) {
+	sender, db := newTestService(t, "http://localhost")
+	if err := db.Create(&domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusSuccess}).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+
+	// the request context is cancelled once the client disconnects, before the query runs here
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	rec := serve(t, sender, httptest.NewRequestWithContext(ctx, http.MethodGet, "/messages", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d since the query is cancelled", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestFlushMessagesConflictsWithRunningBatch(t *testing.T) {
+	sender := &fakeSender{triggerErr: service.ErrBatchInProgress}
+
+	rec := serve(t, sender, httptest.NewRequest(http.MethodPost, "/messages/flush", nil))
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestGetMessage(t *testing.T) {
+	sender := &fakeSender{messages: map[int]*domain.Message{
+		7: {ID: 7, Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusSuccess},
+	}}
+
+	rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/messages/7", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status of a known message = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got map[string]any
+	decode(t, rec, &got)
+	if got["id"] != float64(7) || got["content"] != "hello" || got["status"] != "success" {
+		t.Errorf("message = %v, want message 7 with its status as string", got)
+	}
+
+	for path, want := range map[string]int{
+		"/messages/8":   http.StatusNotFound,
+		"/messages/0":   http.StatusBadRequest,
+		"/messages/abc": http.StatusBadRequest,
+	} {
+		if rec := serve(t, sender, httptest.NewRequest(http.MethodGet, path, nil)); rec.Code != want {
+			t.Errorf("status of %s = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestDeliveryCallback(t *testing.T) {
+	sender, db := newTestService(t, "http://localhost")
+	providerID := "provider-1"
+	msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusSuccess, ProviderMessageID: &providerID}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "unknown message id", body: `{"messageId":"provider-2","status":"delivered"}`, wantStatus: http.StatusNotFound},
+		{name: "empty message id", body: `{"status":"delivered"}`, wantStatus: http.StatusBadRequest},
+		{name: "unknown status", body: `{"messageId":"provider-1","status":"read"}`, wantStatus: http.StatusBadRequest},
+		{name: "malformed body", body: `{"messageId":`, wantStatus: http.StatusBadRequest},
+		{name: "known message id", body: `{"messageId":"provider-1","status":"undelivered"}`, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/callbacks/delivery", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+
+		if rec := serve(t, sender, req); rec.Code != tt.wantStatus {
+			t.Errorf("status of %s = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+	}
+
+	// only the known message is updated
+	var got domain.Message
+	if err := db.First(&got, msg.ID).Error; err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if got.DeliveryStatus == nil || *got.DeliveryStatus != domain.DeliveryUndelivered {
+		t.Errorf("delivery status = %v, want %s", got.DeliveryStatus, domain.DeliveryUndelivered)
+	}
+}
+
+func TestSetInterval(t *testing.T) {
+	sender, _ := newTestService(t, "http://localhost")
+	tests := []struct {
+		body       string
+		wantStatus int
+	}{
+		{body: `{"interval":"abc"}`, wantStatus: http.StatusBadRequest},
+		{body: `{"interval":"100ms"}`, wantStatus: http.StatusBadRequest},
+		{body: `{"interval":"2m"}`, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPatch, "/config/interval", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+
+		if rec := serve(t, sender, req); rec.Code != tt.wantStatus {
+			t.Errorf("status of %s = %d, want %d", tt.body, rec.Code, tt.wantStatus)
+		}
+	}
+
+	if got := sender.GetStatus().SendInterval; got != "2m0s" {
+		t.Errorf("send interval = %s, want 2m0s", got)
+	}
+}
+
+func TestSetBatchSize(t *testing.T) {
+	sender, _ := newTestService(t, "http://localhost")
+	tests := []struct {
+		body       string
+		wantStatus int
+	}{
+		{body: `{"batch_size":"ten"}`, wantStatus: http.StatusBadRequest},
+		{body: `{"batch_size":0}`, wantStatus: http.StatusBadRequest},
+		{body: `{"batch_size":25}`, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPatch, "/config/batch-size", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+
+		if rec := serve(t, sender, req); rec.Code != tt.wantStatus {
+			t.Errorf("status of %s = %d, want %d", tt.body, rec.Code, tt.wantStatus)
+		}
+	}
+
+	if got := sender.GetStatus().BatchSize; got != 25 {
+		t.Errorf("batch size = %d, want 25", got)
+	}
+}
+
+func TestExportMessagesCSV(t *testing.T) {
+	sender, db := newTestService(t, "http://localhost")
+	createdAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	sentAt := createdAt.Add(time.Minute)
+	msgs := []domain.Message{
+		{Content: "hello, world", PhoneNumber: "+905549998871", Status: domain.StatusSuccess, CreatedAt: createdAt, SentAt: &sentAt},
+		{Content: "pending", PhoneNumber: "+905549998872", Status: domain.StatusPending, CreatedAt: createdAt},
+	}
+	if err := db.Create(&msgs).Error; err != nil {
+		t.Fatalf("failed to seed messages: %v", err)
+	}
+
+	tests := []struct {
+		query    string
+		wantRows [][]string
+	}{
+		{
+			query:    "?format=csv",
+			wantRows: [][]string{{strconv.Itoa(msgs[0].ID), "+905549998871", "hello, world", "success", "2024-05-01T10:00:00Z", "2024-05-01T10:01:00Z"}},
+		},
+		{
+			query:    "?status=pending",
+			wantRows: [][]string{{strconv.Itoa(msgs[1].ID), "+905549998872", "pending", "pending", "2024-05-01T10:00:00Z", ""}},
+		},
+	}
+	for _, tt := range tests {
+		rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/messages/export"+tt.query, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status of %q = %d, want %d", tt.query, rec.Code, http.StatusOK)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "text/csv" {
+			t.Errorf("content type of %q = %q, want text/csv", tt.query, got)
+		}
+		records, err := csv.NewReader(rec.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("failed to read csv of %q: %v", tt.query, err)
+		}
+		want := append([][]string{{"id", "phone_number", "content", "status", "created_at", "sent_at"}}, tt.wantRows...)
+		if !slices.EqualFunc(records, want, slices.Equal) {
+			t.Errorf("csv of %q = %q, want %q", tt.query, records, want)
+		}
+	}
+
+	for _, query := range []string{"?format=xml", "?status=unknown"} {
+		if rec := serve(t, sender, httptest.NewRequest(http.MethodGet, "/messages/export"+query, nil)); rec.Code != http.StatusBadRequest {
+			t.Errorf("status of %q = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxCallbackBodySize bounds the callback body buffered to verify its signature, delivery reports are a few hundred bytes
+const maxCallbackBodySize = 64 << 10
+
+var (
+	defaultCorsMethods = []string{http.MethodGet, http.MethodPost, http.MethodPatch}
+	defaultCorsHeaders = []string{"Content-Type", "Authorization", "X-API-Key", "Idempotency-Key", requestIDHeader}
+)
+
+type requestIDKey struct{}
+
+// RequestID returns the id of the http request the context belongs to, empty if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequests propagates the request id, generating one if the client didn't send it, and logs every request
+func (h *Handler) logRequests(c *gin.Context) {
+	start := time.Now()
+
+	id := c.GetHeader(requestIDHeader)
+	if id == "" {
+		id = uuid.NewString()
+	}
+	c.Header(requestIDHeader, id)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+
+	c.Next()
+
+	level := slog.LevelInfo
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	h.logger.Log(c.Request.Context(), level, "http request",
+		"request_id", id,
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"latency", time.Since(start),
+	)
+}
+
+// authenticate rejects requests that don't carry the configured api key
+func (h *Handler) authenticate(c *gin.Context) {
+	if h.apiKey == "" {
+		c.Next()
+		return
+	}
+
+	key := c.GetHeader("X-API-Key")
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		key = token
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(h.apiKey)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid api key"})
+		return
+	}
+	c.Next()
+}
+
+// verifySignature rejects callbacks whose X-Signature header isn't the hex encoded HMAC-SHA256 of the body signed
+// with the callback secret. Callbacks fall back to api key authentication if no secret is configured.
+// Bodies larger than the callback size limit are rejected before they are buffered.
+func (h *Handler) verifySignature(c *gin.Context) {
+	if h.callbackSecret == "" {
+		h.authenticate(c)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxCallbackBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body is too large"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+	// restore the body for the handler
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	signature, err := hex.DecodeString(c.GetHeader("X-Signature"))
+	mac := hmac.New(sha256.New, []byte(h.callbackSecret))
+	mac.Write(body)
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid signature"})
+		return
+	}
+	c.Next()
+}
+
+// cors sets the cross-origin headers for allowed origins and answers preflight requests.
+// Requests from origins that are not allowed are rejected.
+func (h *Handler) cors(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if len(h.corsOrigins) == 0 || origin == "" {
+		c.Next()
+		return
+	}
+
+	if !slices.Contains(h.corsOrigins, "*") && !slices.Contains(h.corsOrigins, origin) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", origin)
+	c.Header("Access-Control-Expose-Headers", requestIDHeader)
+	c.Writer.Header().Add("Vary", "Origin")
+
+	// answer preflight requests without hitting the routes
+	if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+		c.Header("Access-Control-Allow-Methods", strings.Join(h.corsMethods, ", "))
+		c.Header("Access-Control-Allow-Headers", strings.Join(h.corsHeaders, ", "))
+		c.Header("Access-Control-Max-Age", "600")
+		c.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiKey     string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{name: "authentication disabled", wantStatus: http.StatusOK},
+		{name: "valid api key", apiKey: "secret", header: "X-API-Key", value: "secret", wantStatus: http.StatusOK},
+		{name: "valid bearer token", apiKey: "secret", header: "Authorization", value: "Bearer secret", wantStatus: http.StatusOK},
+		{name: "invalid api key", apiKey: "secret", header: "X-API-Key", value: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "invalid bearer token", apiKey: "secret", header: "Authorization", value: "Bearer wrong", wantStatus: http.StatusUnauthorized},
+		{name: "token without bearer scheme", apiKey: "secret", header: "Authorization", value: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "missing key", apiKey: "secret", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{}
+			req := httptest.NewRequest(http.MethodPost, "/stop", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+
+			rec := serve(t, sender, req, WithAPIKey(tt.apiKey))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			wantStops := 0
+			if tt.wantStatus == http.StatusOK {
+				wantStops = 1
+			}
+			if sender.stops != wantStops {
+				t.Errorf("sender is stopped %d times, want %d", sender.stops, wantStops)
+			}
+		})
+	}
+}
+
+func TestReadOnlyRoutesDontRequireAPIKey(t *testing.T) {
+	rec := serve(t, &fakeSender{}, httptest.NewRequest(http.MethodGet, "/status", nil), WithAPIKey("secret"))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// requestLog is the log entry written for each http request
+type requestLog struct {
+	Msg       string `json:"msg"`
+	RequestID string `json:"request_id"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Status    int    `json:"status"`
+}
+
+func TestLogRequestsPropagatesRequestID(t *testing.T) {
+	for _, clientID := range []string{"", "client-request-1"} {
+		var logs strings.Builder
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if clientID != "" {
+			req.Header.Set("X-Request-ID", clientID)
+		}
+
+		rec := serve(t, &fakeSender{}, req, WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))))
+
+		id := rec.Header().Get("X-Request-ID")
+		if id == "" {
+			t.Fatal("response has no X-Request-ID header")
+		}
+		if clientID != "" && id != clientID {
+			t.Errorf("X-Request-ID = %q, want the client id %q", id, clientID)
+		}
+
+		var entry requestLog
+		if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil {
+			t.Fatalf("failed to decode log %q: %v", logs.String(), err)
+		}
+		want := requestLog{Msg: "http request", RequestID: id, Method: http.MethodGet, Path: "/status", Status: http.StatusOK}
+		if entry != want {
+			t.Errorf("log entry = %+v, want %+v", entry, want)
+		}
+	}
+}
+
+func TestRequestIDIsStoredInContext(t *testing.T) {
+	h := &Handler{logger: slog.New(slog.DiscardHandler)}
+	var got string
+	router := gin.New()
+	router.Use(h.logRequests)
+	router.GET("/", func(c *gin.Context) {
+		got = RequestID(c.Request.Context())
+	})
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got == "" || got != rec.Header().Get("X-Request-ID") {
+		t.Errorf("RequestID() = %q, want the response X-Request-ID %q", got, rec.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestCORS(t *testing.T) {
+	corsOpt := WithCORS([]string{"https://dashboard.example.com"}, []string{http.MethodGet, http.MethodPost}, nil)
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		opts        []Option
+		wantStatus  int
+		wantOrigin  string
+		wantMethods string
+	}{
+		{name: "allowed origin", method: http.MethodGet, origin: "https://dashboard.example.com", opts: []Option{corsOpt}, wantStatus: http.StatusOK, wantOrigin: "https://dashboard.example.com"},
+		{name: "preflight of allowed origin", method: http.MethodOptions, origin: "https://dashboard.example.com", preflight: true, opts: []Option{corsOpt}, wantStatus: http.StatusNoContent, wantOrigin: "https://dashboard.example.com", wantMethods: "GET, POST"},
+		{name: "disallowed origin", method: http.MethodGet, origin: "https://evil.example.com", opts: []Option{corsOpt}, wantStatus: http.StatusForbidden},
+		{name: "preflight of disallowed origin", method: http.MethodOptions, origin: "https://evil.example.com", preflight: true, opts: []Option{corsOpt}, wantStatus: http.StatusForbidden},
+		{name: "same origin request", method: http.MethodGet, opts: []Option{corsOpt}, wantStatus: http.StatusOK},
+		{name: "any origin", method: http.MethodGet, origin: "https://other.example.com", opts: []Option{WithCORS([]string{"*"}, nil, nil)}, wantStatus: http.StatusOK, wantOrigin: "https://other.example.com"},
+		{name: "cors disabled", method: http.MethodGet, origin: "https://dashboard.example.com", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/status", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+
+			rec := serve(t, &fakeSender{}, req, tt.opts...)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.wantMethods)
+			}
+		})
+	}
+}
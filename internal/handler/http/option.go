@@ -0,0 +1,50 @@
+package handler
+
+import "log/slog"
+
+type Option func(h *Handler)
+
+// WithAPIKey requires the given key on mutating routes, either as a bearer token or in the X-API-Key header.
+// Authentication is disabled if the key is empty.
+func WithAPIKey(key string) Option {
+	return func(h *Handler) {
+		h.apiKey = key
+	}
+}
+
+// WithCallbackSecret requires provider callbacks to carry the HMAC-SHA256 signature of their body, signed with
+// the given secret, in the X-Signature header. Callbacks require the api key instead if the secret is empty.
+func WithCallbackSecret(secret string) Option {
+	return func(h *Handler) {
+		h.callbackSecret = secret
+	}
+}
+
+// WithLogger sets the logger requests are logged to. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+// WithTLS serves https using the given certificate and key files. Plain http is served if either is empty.
+func WithTLS(certFile, keyFile string) Option {
+	return func(h *Handler) {
+		h.tlsCertFile = certFile
+		h.tlsKeyFile = keyFile
+	}
+}
+
+// WithCORS allows browsers on the given origins to call the api, "*" allows any origin.
+// Default methods and headers are used if methods or headers are empty. CORS is disabled if origins is empty.
+func WithCORS(origins, methods, headers []string) Option {
+	return func(h *Handler) {
+		h.corsOrigins = origins
+		if len(methods) > 0 {
+			h.corsMethods = methods
+		}
+		if len(headers) > 0 {
+			h.corsHeaders = headers
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "auto_messenger"
+
+var (
+	// MessagesSent counts messages that are successfully consumed by the webhook
+	MessagesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_sent_total",
+		Help:      "Total number of messages successfully sent to the webhook.",
+	})
+
+	// MessagesFailed counts messages that are rejected since retrying can't deliver them
+	MessagesFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_failed_total",
+		Help:      "Total number of messages rejected since retrying can't deliver them.",
+	})
+
+	// MessagesDeadLettered counts messages whose retries are exhausted
+	MessagesDeadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dead_lettered_total",
+		Help:      "Total number of messages moved to dead letter after exhausting retries.",
+	})
+
+	// MessagesRetried counts send attempts that failed and will be retried
+	MessagesRetried = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_retried_total",
+		Help:      "Total number of failed send attempts that are retried.",
+	})
+
+	// MessagesDryRun counts messages that are marked as sent in dry run mode without a webhook request
+	MessagesDryRun = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dry_run_total",
+		Help:      "Total number of messages marked as sent in dry run mode without a webhook request.",
+	})
+
+	// WebhookRequestDuration observes the latency of webhook requests in seconds
+	WebhookRequestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "webhook_request_duration_seconds",
+		Help:      "Latency of webhook requests in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
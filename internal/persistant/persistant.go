@@ -0,0 +1,63 @@
+package persistant
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Supported database drivers
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// ValidateDriver checks whether the given database driver is supported
+func ValidateDriver(driver string) error {
+	switch driver {
+	case DriverPostgres, DriverSQLite:
+		return nil
+	default:
+		return fmt.Errorf("unsupported database driver %q", driver)
+	}
+}
+
+// Migrate auto migrates the given models if run is true. Otherwise it only checks that the table of each model exists,
+// so a schema managed by external migration tooling that is not applied yet fails clearly.
+func Migrate(db *gorm.DB, models []any, run bool) error {
+	if run {
+		return db.AutoMigrate(models...)
+	}
+
+	for _, model := range models {
+		if !db.Migrator().HasTable(model) {
+			stmt := &gorm.Statement{DB: db}
+			if err := stmt.Parse(model); err != nil {
+				return err
+			}
+			return fmt.Errorf("table %q is missing, apply the migrations or enable run_migrations", stmt.Schema.Table)
+		}
+	}
+	return nil
+}
+
+// Ping verifies the connection to the database is still alive
+func Ping(ctx context.Context, db *gorm.DB) error {
+	sqlDb, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	return sqlDb.PingContext(ctx)
+}
+
+// Close closes every connection of the database
+func Close(db *gorm.DB) error {
+	sqlDb, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	return sqlDb.Close()
+}
@@ -0,0 +1,107 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LeaderElector elects a single leader among the instances sharing the same database using a session level advisory lock.
+// The lock is held on a dedicated connection, so leadership is lost as soon as the connection of the leader dies.
+type LeaderElector struct {
+	db       *gorm.DB
+	lockName string
+	interval time.Duration
+	logger   *slog.Logger
+	isLeader atomic.Bool
+}
+
+// NewLeaderElector creates a leader elector that contends for the lock with the given name every interval
+func NewLeaderElector(db *gorm.DB, lockName string, interval time.Duration, logger *slog.Logger) *LeaderElector {
+	return &LeaderElector{
+		db:       db,
+		lockName: lockName,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// IsLeader reports whether this instance currently holds the leadership
+func (e *LeaderElector) IsLeader() bool {
+	return e.isLeader.Load()
+}
+
+// Run contends for leadership until the context is done, then releases the lock if it is held
+func (e *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var conn *sql.Conn
+	for {
+		conn = e.campaign(ctx, conn)
+
+		select {
+		case <-ctx.Done():
+			if conn != nil {
+				e.resign(conn)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// campaign verifies the connection holding the lock is still alive if this instance is the leader,
+// otherwise tries to acquire the lock. The connection holding the lock is returned, nil if the lock is not held.
+func (e *LeaderElector) campaign(ctx context.Context, conn *sql.Conn) *sql.Conn {
+	if conn != nil {
+		if err := conn.PingContext(ctx); err == nil {
+			return conn
+		} else if ctx.Err() == nil {
+			e.logger.Warn("lost leadership", "error", err.Error())
+		}
+		conn.Close()
+		e.isLeader.Store(false)
+	}
+
+	sqlDb, err := e.db.DB()
+	if err != nil {
+		e.logger.Error("failed to get database connection for leader election", "error", err.Error())
+		return nil
+	}
+	conn, err = sqlDb.Conn(ctx)
+	if err != nil {
+		e.logger.Error("failed to get database connection for leader election", "error", err.Error())
+		return nil
+	}
+
+	var acquired bool
+	if err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", e.lockName).Scan(&acquired); err != nil {
+		e.logger.Error("failed to acquire leader lock", "error", err.Error())
+	}
+	if !acquired {
+		conn.Close()
+		return nil
+	}
+
+	e.isLeader.Store(true)
+	e.logger.Info("acquired leadership")
+	return conn
+}
+
+// resign releases the lock and returns the connection to the pool
+func (e *LeaderElector) resign(conn *sql.Conn) {
+	e.isLeader.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", e.lockName); err != nil {
+		e.logger.Error("failed to release leader lock", "error", err.Error())
+	}
+	conn.Close()
+}
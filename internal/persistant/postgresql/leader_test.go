@@ -0,0 +1,221 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// lockServer imitates the advisory locks of a postgres server shared by the connections opened to it.
+// Like session level advisory locks, a lock is released when the connection holding it is closed.
+type lockServer struct {
+	mtx     sync.Mutex
+	holders map[string]*lockConn
+}
+
+func newLockServer() *lockServer {
+	return &lockServer{holders: make(map[string]*lockConn)}
+}
+
+// holder returns the connection holding the lock with the given name, nil if it isn't held
+func (s *lockServer) holder(name string) *lockConn {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.holders[name]
+}
+
+// release drops the locks held by the connection
+func (s *lockServer) release(c *lockConn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for name, holder := range s.holders {
+		if holder == c {
+			delete(s.holders, name)
+		}
+	}
+}
+
+func (s *lockServer) Connect(ctx context.Context) (driver.Conn, error) {
+	return &lockConn{server: s}, nil
+}
+
+func (s *lockServer) Driver() driver.Driver {
+	return nil
+}
+
+type lockConn struct {
+	server *lockServer
+	// dead connections fail pings as if the server closed them
+	dead atomic.Bool
+}
+
+// kill drops the connection on the server side, releasing its locks
+func (c *lockConn) kill() {
+	c.dead.Store(true)
+	c.server.release(c)
+}
+
+func (c *lockConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.server.mtx.Lock()
+	defer c.server.mtx.Unlock()
+
+	name := args[0].Value.(string)
+	holder, held := c.server.holders[name]
+	if !held {
+		c.server.holders[name] = c
+	}
+	return &boolRows{val: !held || holder == c}, nil
+}
+
+func (c *lockConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.server.mtx.Lock()
+	defer c.server.mtx.Unlock()
+
+	name := args[0].Value.(string)
+	if c.server.holders[name] == c {
+		delete(c.server.holders, name)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c *lockConn) Ping(ctx context.Context) error {
+	if c.dead.Load() {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (c *lockConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *lockConn) Close() error {
+	c.server.release(c)
+	return nil
+}
+
+func (c *lockConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+// boolRows is the single boolean result of a query
+type boolRows struct {
+	val  bool
+	read bool
+}
+
+func (r *boolRows) Columns() []string {
+	return []string{"result"}
+}
+
+func (r *boolRows) Close() error {
+	return nil
+}
+
+func (r *boolRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	dest[0] = r.val
+	return nil
+}
+
+// newTestElector creates an elector of an instance connected to the given server
+func newTestElector(t *testing.T, server *lockServer) *LeaderElector {
+	t.Helper()
+
+	sqlDb := sql.OpenDB(server)
+	t.Cleanup(func() { sqlDb.Close() })
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDb}), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	return NewLeaderElector(db, "scheduler", 5*time.Millisecond, slog.New(slog.DiscardHandler))
+}
+
+// runElector runs the elector until the returned function is called
+func runElector(t *testing.T, e *LeaderElector) (stop func()) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(ctx)
+	}()
+	stop = sync.OnceFunc(func() {
+		cancel()
+		<-done
+	})
+	t.Cleanup(stop)
+	return stop
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLeaderElectionFailsOverWhenLeaderStops(t *testing.T) {
+	server := newLockServer()
+	first, second := newTestElector(t, server), newTestElector(t, server)
+
+	stopFirst := runElector(t, first)
+	waitFor(t, "the first instance to lead", first.IsLeader)
+	runElector(t, second)
+
+	// the second instance contends for the lock held by the first one for a few intervals
+	time.Sleep(50 * time.Millisecond)
+	if second.IsLeader() {
+		t.Fatal("both instances are leaders")
+	}
+
+	// the lock is released when the leader stops, so the other instance takes over
+	stopFirst()
+	if first.IsLeader() {
+		t.Error("stopped instance is still the leader")
+	}
+	waitFor(t, "the second instance to take over", second.IsLeader)
+}
+
+func TestLeaderElectionFailsOverWhenLeaderConnectionDies(t *testing.T) {
+	server := newLockServer()
+	first, second := newTestElector(t, server), newTestElector(t, server)
+
+	runElector(t, first)
+	waitFor(t, "the first instance to lead", first.IsLeader)
+	runElector(t, second)
+
+	// the connection of the leader dies, which releases its lock
+	server.holder("scheduler").kill()
+
+	// one of the instances holds the lock again, and only that one is the leader
+	waitFor(t, "a new leader", func() bool {
+		holder := server.holder("scheduler")
+		return holder != nil && first.IsLeader() != second.IsLeader()
+	})
+	time.Sleep(50 * time.Millisecond)
+	if first.IsLeader() == second.IsLeader() {
+		t.Errorf("first instance leader = %t, second instance leader = %t, want a single leader", first.IsLeader(), second.IsLeader())
+	}
+}
@@ -0,0 +1,61 @@
+package postgresql
+
+import "time"
+
+const (
+	defaultConnectRetries       = 5
+	defaultConnectRetryInterval = time.Second * 2
+)
+
+type settings struct {
+	connectRetries       int
+	connectRetryInterval time.Duration
+	runMigrations        bool
+	maxOpenConns         int
+	maxIdleConns         int
+	connMaxLifetime      time.Duration
+}
+
+type Option func(s *settings)
+
+// WithMaxOpenConns sets the maximum number of open connections to the database. Zero means unlimited.
+func WithMaxOpenConns(n int) Option {
+	return func(s *settings) {
+		s.maxOpenConns = n
+	}
+}
+
+// WithMaxIdleConns sets the maximum number of idle connections in the pool. Zero uses the driver default.
+func WithMaxIdleConns(n int) Option {
+	return func(s *settings) {
+		s.maxIdleConns = n
+	}
+}
+
+// WithConnMaxLifetime sets the maximum amount of time a connection may be reused. Zero means connections are reused forever.
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(s *settings) {
+		s.connMaxLifetime = d
+	}
+}
+
+// WithConnectRetry sets how many times connecting to the database is attempted and the interval between attempts.
+// Non-positive values keep the defaults of 5 attempts and 2 seconds.
+func WithConnectRetry(retries int, interval time.Duration) Option {
+	return func(s *settings) {
+		if retries > 0 {
+			s.connectRetries = retries
+		}
+		if interval > 0 {
+			s.connectRetryInterval = interval
+		}
+	}
+}
+
+// WithRunMigrations sets whether the models are auto migrated. If disabled, only the presence of their tables is checked.
+// Migrations are run by default.
+func WithRunMigrations(run bool) Option {
+	return func(s *settings) {
+		s.runMigrations = run
+	}
+}
@@ -1,39 +1,71 @@
 package postgresql
 
 import (
+	"database/sql"
+	"errors"
 	"time"
 
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-// Initialize initializes the db session and auto migrates given models
-func Initialize(connStr string, models []any) (db *gorm.DB, err error) {
-	retryTicker := time.NewTicker(time.Second * 2)
-	defer retryTicker.Stop()
+// Initialize initializes the db session, configures its connection pool and migrates given models
+func Initialize(connStr string, models []any, opts ...Option) (db *gorm.DB, err error) {
+	s := &settings{
+		connectRetries:       defaultConnectRetries,
+		connectRetryInterval: defaultConnectRetryInterval,
+		runMigrations:        true,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	if s.maxOpenConns < 0 || s.maxIdleConns < 0 || s.connMaxLifetime < 0 {
+		return nil, errors.New("connection pool settings must not be negative")
+	}
 
-	// retry connect
-	for range 5 {
-		db, err = gorm.Open(postgres.Open(connStr), &gorm.Config{})
-		if err == nil {
-			break
-		}
-		<-retryTicker.C
+	db, err = connect(s, func() (*gorm.DB, error) {
+		return gorm.Open(postgres.Open(connStr), &gorm.Config{})
+	})
+	if err != nil {
+		return
 	}
+
+	// configure connection pool
+	sqlDb, err := db.DB()
 	if err != nil {
 		return
 	}
+	configurePool(sqlDb, s)
 
-	err = db.AutoMigrate(models...)
+	err = persistant.Migrate(db, models, s.runMigrations)
 
 	return
 }
 
-func Close(db *gorm.DB) error {
-	sqlDb, err := db.DB()
-	if err != nil {
-		return err
+// connect opens the database, retrying failed attempts at the configured interval
+func connect(s *settings, open func() (*gorm.DB, error)) (db *gorm.DB, err error) {
+	retryTicker := time.NewTicker(s.connectRetryInterval)
+	defer retryTicker.Stop()
+
+	for range s.connectRetries {
+		if db, err = open(); err == nil {
+			return db, nil
+		}
+		<-retryTicker.C
 	}
+	return nil, err
+}
 
-	return sqlDb.Close()
+// configurePool applies the positive pool settings, the others keep the driver defaults
+func configurePool(sqlDb *sql.DB, s *settings) {
+	if s.maxOpenConns > 0 {
+		sqlDb.SetMaxOpenConns(s.maxOpenConns)
+	}
+	if s.maxIdleConns > 0 {
+		sqlDb.SetMaxIdleConns(s.maxIdleConns)
+	}
+	if s.connMaxLifetime > 0 {
+		sqlDb.SetConnMaxLifetime(s.connMaxLifetime)
+	}
 }
@@ -0,0 +1,139 @@
+package postgresql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// stubDriver opens connections that don't talk to a database, so the pool can be exercised without one
+type stubDriver struct{}
+
+func (stubDriver) Open(name string) (driver.Conn, error) {
+	return stubConn{}, nil
+}
+
+type stubConn struct{}
+
+func (stubConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (stubConn) Close() error {
+	return nil
+}
+
+func (stubConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func init() {
+	sql.Register("stub", stubDriver{})
+}
+
+func TestConfigurePool(t *testing.T) {
+	sqlDb, err := sql.Open("stub", "")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	t.Cleanup(func() { sqlDb.Close() })
+
+	configurePool(sqlDb, &settings{maxOpenConns: 3, maxIdleConns: 1, connMaxLifetime: 20 * time.Millisecond})
+
+	if got := sqlDb.Stats().MaxOpenConnections; got != 3 {
+		t.Errorf("max open connections = %d, want 3", got)
+	}
+
+	// only one of the released connections is kept idle
+	conns := make([]*sql.Conn, 3)
+	for i := range conns {
+		if conns[i], err = sqlDb.Conn(t.Context()); err != nil {
+			t.Fatalf("Conn() error = %v", err)
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if stats := sqlDb.Stats(); stats.Idle != 1 || stats.MaxIdleClosed != 2 {
+		t.Errorf("idle connections = %d with %d closed, want 1 with 2 closed", stats.Idle, stats.MaxIdleClosed)
+	}
+
+	// the idle connection isn't reused once its lifetime passes
+	time.Sleep(30 * time.Millisecond)
+	conn, err := sqlDb.Conn(t.Context())
+	if err != nil {
+		t.Fatalf("Conn() error = %v", err)
+	}
+	conn.Close()
+	if got := sqlDb.Stats().MaxLifetimeClosed; got != 1 {
+		t.Errorf("connections closed for their lifetime = %d, want 1", got)
+	}
+}
+
+func TestConfigurePoolKeepsDefaults(t *testing.T) {
+	sqlDb, err := sql.Open("stub", "")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	t.Cleanup(func() { sqlDb.Close() })
+
+	configurePool(sqlDb, &settings{})
+
+	if got := sqlDb.Stats().MaxOpenConnections; got != 0 {
+		t.Errorf("max open connections = %d, want unlimited", got)
+	}
+}
+
+func TestInitializeRejectsNegativePoolSettings(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"max open conns":    WithMaxOpenConns(-1),
+		"max idle conns":    WithMaxIdleConns(-1),
+		"conn max lifetime": WithConnMaxLifetime(-time.Second),
+	} {
+		if _, err := Initialize("postgres://localhost", nil, opt); err == nil {
+			t.Errorf("Initialize() with negative %s error = nil, want error", name)
+		}
+	}
+}
+
+func TestConnectRetriesTransientFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "first attempt succeeds", failures: 0, wantAttempts: 1},
+		{name: "recovers within retries", failures: 2, wantAttempts: 3},
+		{name: "fails every retry", failures: 4, wantAttempts: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &settings{}
+			WithConnectRetry(3, time.Millisecond)(s)
+
+			attempts := 0
+			db, err := connect(s, func() (*gorm.DB, error) {
+				attempts++
+				if attempts <= tt.failures {
+					return nil, errors.New("connection refused")
+				}
+				return &gorm.DB{}, nil
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("connect() error = %v, want error %t", err, tt.wantErr)
+			}
+			if (db == nil) != tt.wantErr {
+				t.Errorf("connect() db = %v, want db %t", db, !tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("connect() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package sqlite
+
+import (
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// Initialize opens the sqlite database with the given dsn and migrates given models.
+// If runMigrations is false, only the presence of the model tables is checked.
+//
+// Sqlite allows a single writer at a time and doesn't support row locks, so the pool is limited to
+// a single connection which serializes every transaction. The driver is pure Go, so builds don't need cgo.
+func Initialize(dsn string, models []any, runMigrations bool) (db *gorm.DB, err error) {
+	db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return
+	}
+
+	sqlDb, err := db.DB()
+	if err != nil {
+		return
+	}
+	sqlDb.SetMaxOpenConns(1)
+
+	err = persistant.Migrate(db, models, runMigrations)
+
+	return
+}
@@ -0,0 +1,57 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
+)
+
+func TestInitializeMigratesModels(t *testing.T) {
+	db, err := Initialize(filepath.Join(t.TempDir(), "messages.db"), []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	defer persistant.Close(db)
+
+	if !db.Migrator().HasTable(&domain.Message{}) {
+		t.Fatal("messages table is not created")
+	}
+
+	msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877"}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+	var count int64
+	if err := db.Model(&domain.Message{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("message count = %d, want 1", count)
+	}
+}
+
+func TestInitializeWithoutMigrationsRequiresTables(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "messages.db")
+
+	db, err := Initialize(dsn, []any{&domain.Message{}}, false)
+	if err == nil || !strings.Contains(err.Error(), `table "messages" is missing`) {
+		t.Fatalf("Initialize() error = %v, want missing table error", err)
+	}
+	persistant.Close(db)
+
+	// once migrated, the tables are only checked
+	db, err = Initialize(dsn, []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	persistant.Close(db)
+
+	db, err = Initialize(dsn, []any{&domain.Message{}}, false)
+	if err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	persistant.Close(db)
+}
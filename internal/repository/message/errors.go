@@ -0,0 +1,12 @@
+package repository
+
+import "errors"
+
+var (
+	// ErrMessageNotFound is returned when the requested message doesn't exist
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrConcurrentUpdate is returned when a message is changed by another process since it is read
+	ErrConcurrentUpdate = errors.New("message is updated concurrently")
+	// ErrMessageProcessing is returned when a message can't be changed because it is being processed
+	ErrMessageProcessing = errors.New("message is being processed")
+)
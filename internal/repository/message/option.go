@@ -0,0 +1,29 @@
+package repository
+
+import "time"
+
+type Option func(r *repo)
+
+// WithTxRetry sets how many times a transaction that failed with a serialization failure or a deadlock is
+// attempted and the delay between the attempts, which grows linearly. Non-positive values keep the defaults of
+// 3 attempts and 50 milliseconds.
+func WithTxRetry(attempts int, interval time.Duration) Option {
+	return func(r *repo) {
+		if attempts > 0 {
+			r.txAttempts = attempts
+		}
+		if interval > 0 {
+			r.txRetryInterval = interval
+		}
+	}
+}
+
+// WithInsertBatchSize sets the number of messages inserted by a single statement when messages are created in bulk.
+// All statements of a bulk insert run in one transaction. Non-positive values keep the default of 1000.
+func WithInsertBatchSize(n int) Option {
+	return func(r *repo) {
+		if n > 0 {
+			r.insertBatchSize = n
+		}
+	}
+}
@@ -2,9 +2,14 @@ package repository
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aniladanir/auto-messender-service/internal/cache"
 	"github.com/aniladanir/auto-messender-service/internal/domain"
@@ -12,29 +17,149 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+const (
+	// streamChunkSize is the number of messages read at once while streaming
+	streamChunkSize = 500
+	// defaultInsertBatchSize is the number of messages inserted by a single statement, it keeps a bulk insert
+	// well below the limit of 65535 bind parameters of postgres
+	defaultInsertBatchSize = 1000
+)
+
 type Repository interface {
-	FetchAndLockMessages(limit int) ([]domain.Message, error)
-	UpdateStatus(msg *domain.Message, status domain.MessageStatus) error
-	GetSentMessages() ([]domain.Message, error)
+	CreateMessage(msg *domain.Message) (created bool, err error)
+	CreateMessages(msgs []domain.Message) error
+	CreateBroadcast(broadcastID string, msgs []domain.Message) error
+	GetByID(id int) (*domain.Message, error)
+	FetchAndLockMessages(ctx context.Context, limit int, maxRetry int) ([]domain.Message, error)
+	UpdateStatuses(ctx context.Context, msgs []*domain.Message, status domain.MessageStatus) ([]*domain.Message, error)
+	RecordFailure(ctx context.Context, msg *domain.Message, lastError string) error
+	SetLastError(ctx context.Context, msg *domain.Message, lastError string) error
+	SetProviderMessageID(ctx context.Context, msg *domain.Message, providerMsgID string) error
+	UpdateDeliveryStatus(providerMsgID string, status domain.DeliveryStatus) error
+	RecoverStaleMessages(ctx context.Context, olderThan time.Duration) ([]domain.Message, error)
+	RequeueByStatus(status domain.MessageStatus) ([]domain.Message, error)
+	ResetToPending(id int) (*domain.Message, domain.MessageStatus, error)
+	GetSentMessages(ctx context.Context, limit, offset int) ([]domain.Message, int64, error)
+	GetMessagesByStatus(ctx context.Context, status domain.MessageStatus, limit, offset int) ([]domain.Message, int64, error)
+	StreamMessages(status domain.MessageStatus, fn func(domain.Message) error) error
+	GetMessagesByBroadcast(broadcastID string, status *domain.MessageStatus, limit, offset int) ([]domain.Message, int64, error)
+	CountByStatus() (map[domain.MessageStatus]int64, error)
 	CacheMessage(ctx context.Context, msgID string, sentTime time.Time) error
+	GetCachedMessage(ctx context.Context, msgID string) (*domain.CachedMessage, error)
+	UncacheMessage(ctx context.Context, msgID string) error
+	MarkRecentlySent(ctx context.Context, msg *domain.Message, ttl time.Duration) error
+	IsRecentlySent(ctx context.Context, msg *domain.Message) (bool, error)
+	SetLease(ctx context.Context, msgID int, owner string, ttl time.Duration) error
+	ReleaseLease(ctx context.Context, msgID int) error
+	RecoverExpiredLeases(ctx context.Context, olderThan time.Duration) ([]domain.Message, error)
 }
 
 type repo struct {
-	db    *gorm.DB
-	cache cache.Cache
+	db              *gorm.DB
+	cache           cache.Cache
+	txAttempts      int
+	txRetryInterval time.Duration
+	insertBatchSize int
+}
+
+func NewMessageRepository(db *gorm.DB, cache cache.Cache, opts ...Option) Repository {
+	r := &repo{
+		db:              db,
+		cache:           cache,
+		txAttempts:      defaultTxAttempts,
+		txRetryInterval: defaultTxRetryInterval,
+		insertBatchSize: defaultInsertBatchSize,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
 }
 
-func NewMessageRepository(db *gorm.DB, cache cache.Cache) Repository {
-	return &repo{db: db, cache: cache}
+// CreateMessage validates and inserts the given message.
+//
+// If the message has an idempotency key that already exists, nothing is inserted and msg is
+// overwritten with the existing message. Created reports whether a new message is inserted.
+func (r *repo) CreateMessage(msg *domain.Message) (created bool, err error) {
+	if err = msg.Validate(); err != nil {
+		return false, err
+	}
+	if msg.IdempotencyKey == nil {
+		return true, r.db.Create(msg).Error
+	}
+
+	result := r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "idempotency_key"}},
+		DoNothing: true,
+	}).Create(msg)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	// message is already enqueued with the same key
+	key := *msg.IdempotencyKey
+	*msg = domain.Message{}
+	return false, r.db.Where("idempotency_key = ?", key).First(msg).Error
 }
 
-// FetchAndLockMessages retrieves pending or failed messages and sets their status to processing
-func (r *repo) FetchAndLockMessages(limit int) ([]domain.Message, error) {
+// CreateMessages validates and inserts the given messages in chunks within a single transaction
+func (r *repo) CreateMessages(msgs []domain.Message) error {
+	for i := range msgs {
+		if err := msgs[i].Validate(); err != nil {
+			return fmt.Errorf("message at index %d: %w", i, err)
+		}
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return tx.CreateInBatches(&msgs, r.insertBatchSize).Error
+	})
+}
+
+// CreateBroadcast validates the given messages and inserts them in a single transaction, grouped under the broadcast id
+func (r *repo) CreateBroadcast(broadcastID string, msgs []domain.Message) error {
+	for i := range msgs {
+		msgs[i].BroadcastID = &broadcastID
+	}
+	return r.CreateMessages(msgs)
+}
+
+// GetByID returns the message with the given id. ErrMessageNotFound is returned if the message doesn't exist.
+func (r *repo) GetByID(id int) (*domain.Message, error) {
+	msg := new(domain.Message)
+	err := r.db.First(msg, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: id %d", ErrMessageNotFound, id)
+	} else if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// FetchAndLockMessages retrieves pending or failed messages that are due and sets their status to processing.
+// Failed messages are the retryable ones, rejected and dead lettered messages are never fetched.
+//
+// Messages whose retry count reached maxRetry are skipped. A non-positive maxRetry disables the check.
+func (r *repo) FetchAndLockMessages(ctx context.Context, limit int, maxRetry int) ([]domain.Message, error) {
 	var messages []domain.Message
-	err := r.db.Transaction(func(tx *gorm.DB) error {
-		// Select pending messages by locking selected rows
-		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
-			Where("status = ?", domain.StatusPending).Limit(limit).Find(&messages).Error; err != nil {
+	err := r.transaction(ctx, func(tx *gorm.DB) error {
+		// discard messages read by a failed attempt
+		messages = nil
+
+		// Select pending and failed messages by locking selected rows.
+		// Pending messages are ordered first so retries of failed messages can't starve new ones
+		query := tx.Where("status IN ?", []domain.MessageStatus{domain.StatusPending, domain.StatusFailed})
+		// sqlite doesn't support row locks, its transactions are serialized instead
+		if tx.Dialector.Name() != "sqlite" {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+		if maxRetry > 0 {
+			query = query.Where("retry_count < ?", maxRetry)
+		}
+		// skip messages that are scheduled to be sent later
+		query = query.Where("scheduled_at IS NULL OR scheduled_at <= ?", time.Now().UTC())
+		if err := query.Order("status ASC, id ASC").Limit(limit).Find(&messages).Error; err != nil {
 			return err
 		}
 
@@ -45,39 +170,394 @@ func (r *repo) FetchAndLockMessages(limit int) ([]domain.Message, error) {
 			ids = append(ids, m.ID)
 		}
 
-		return tx.Model(&domain.Message{}).
+		if err := tx.Model(&domain.Message{}).
 			Where("id IN ?", ids).
-			Update("status", domain.StatusProcessing).Error
+			Updates(map[string]any{"status": domain.StatusProcessing, "version": gorm.Expr("version + 1")}).Error; err != nil {
+			return err
+		}
+		for i := range messages {
+			messages[i].Version++
+		}
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return messages, err
+	return messages, nil
 }
 
-// UpdateStatus updates message status to provided status
-func (r *repo) UpdateStatus(msg *domain.Message, status domain.MessageStatus) error {
+// UpdateStatuses sets the status of the given messages that are in processing with a single statement.
+// Sent time is recorded when the status is success. A message is only updated if its version is unchanged since
+// it is locked, the updated messages are returned and kept in sync with their rows. ErrConcurrentUpdate is returned
+// along with them if any of the messages is changed by another process, e.g. recovered as stale, which is left untouched.
+func (r *repo) UpdateStatuses(ctx context.Context, msgs []*domain.Message, status domain.MessageStatus) ([]*domain.Message, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+
 	now := time.Now().UTC()
-	msg.UpdatedAt = &now
-	msg.Status = int(status)
-	return r.db.Save(msg).Error
+	updates := map[string]any{"status": status, "updated_at": now, "version": gorm.Expr("version + 1")}
+	if status == domain.StatusSuccess {
+		updates["sent_at"] = now
+	}
+
+	// each message is matched by the version it is locked with, the ids of the matched rows are returned
+	// to tell the messages changed meanwhile apart
+	keys := make([][]any, 0, len(msgs))
+	for _, msg := range msgs {
+		keys = append(keys, []any{msg.ID, msg.Version})
+	}
+	var rows []domain.Message
+	err := r.transaction(ctx, func(tx *gorm.DB) error {
+		rows = nil
+		return tx.Model(&rows).
+			Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+			Where("(id, version) IN ? AND status = ?", keys, domain.StatusProcessing).
+			Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the updated messages in sync with their rows
+	matched := make(map[int]bool, len(rows))
+	for _, row := range rows {
+		matched[row.ID] = true
+	}
+	updated := make([]*domain.Message, 0, len(rows))
+	for _, msg := range msgs {
+		if !matched[msg.ID] {
+			continue
+		}
+		msg.Version++
+		msg.UpdatedAt = &now
+		if _, ok := updates["sent_at"]; ok {
+			msg.SentAt = &now
+		}
+		msg.Status = status
+		updated = append(updated, msg)
+	}
+	if len(updated) < len(msgs) {
+		return updated, fmt.Errorf("%w: %d of %d messages are changed by another process", ErrConcurrentUpdate, len(msgs)-len(updated), len(msgs))
+	}
+	return updated, nil
 }
 
-// GetSentMessages returns messages with status 'sent'
-func (r *repo) GetSentMessages() ([]domain.Message, error) {
-	var messages []domain.Message
-	err := r.db.Where("status = ?", domain.StatusSuccess).Find(&messages).Error
-	return messages, err
+// RecordFailure increases the persisted retry count of the message by one and stores the error of the failed attempt
+func (r *repo) RecordFailure(ctx context.Context, msg *domain.Message, lastError string) error {
+	lastError = truncateError(lastError)
+	if err := r.db.WithContext(ctx).Model(&domain.Message{}).
+		Where("id = ?", msg.ID).
+		UpdateColumns(map[string]any{"retry_count": gorm.Expr("retry_count + ?", 1), "last_error": lastError}).Error; err != nil {
+		return err
+	}
+	msg.RetryCount++
+	msg.LastError = &lastError
+	return nil
+}
+
+// SetLastError stores the error of a failed attempt that isn't counted as a retry
+func (r *repo) SetLastError(ctx context.Context, msg *domain.Message, lastError string) error {
+	lastError = truncateError(lastError)
+	if err := r.db.WithContext(ctx).Model(&domain.Message{}).
+		Where("id = ?", msg.ID).
+		UpdateColumn("last_error", lastError).Error; err != nil {
+		return err
+	}
+	msg.LastError = &lastError
+	return nil
+}
+
+// SetProviderMessageID stores the id the webhook returned for the message. ErrMessageNotFound is returned if the message doesn't exist.
+func (r *repo) SetProviderMessageID(ctx context.Context, msg *domain.Message, providerMsgID string) error {
+	result := r.db.WithContext(ctx).Model(&domain.Message{}).
+		Where("id = ?", msg.ID).
+		UpdateColumn("provider_message_id", providerMsgID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: id %d", ErrMessageNotFound, msg.ID)
+	}
+	msg.ProviderMessageID = &providerMsgID
+	return nil
+}
+
+// UpdateDeliveryStatus sets the delivery status of the message with the given provider message id.
+// ErrMessageNotFound is returned if no message has the provider message id.
+func (r *repo) UpdateDeliveryStatus(providerMsgID string, status domain.DeliveryStatus) error {
+	result := r.db.Model(&domain.Message{}).
+		Where("provider_message_id = ?", providerMsgID).
+		Updates(map[string]any{"delivery_status": status, "updated_at": time.Now().UTC()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: provider message id %s", ErrMessageNotFound, providerMsgID)
+	}
+	return nil
+}
+
+// RecoverStaleMessages resets messages that are stuck in processing for longer than the given duration back to
+// pending, returning the recovered messages as they are after the reset
+func (r *repo) RecoverStaleMessages(ctx context.Context, olderThan time.Duration) ([]domain.Message, error) {
+	var recovered []domain.Message
+	threshold := time.Now().UTC().Add(-olderThan)
+	err := r.db.WithContext(ctx).Model(&recovered).
+		Clauses(clause.Returning{}).
+		Where("status = ?", domain.StatusProcessing).
+		Where("COALESCE(updated_at, created_at) < ?", threshold).
+		Updates(map[string]any{"status": domain.StatusPending, "version": gorm.Expr("version + 1")}).Error
+	if err != nil {
+		return nil, err
+	}
+	return recovered, nil
+}
+
+// RequeueByStatus resets messages with the given status back to pending with their retry count zeroed, returning
+// the requeued messages as they are after the reset. Messages in processing can't be requeued since they may be
+// being sent.
+func (r *repo) RequeueByStatus(status domain.MessageStatus) ([]domain.Message, error) {
+	if status == domain.StatusProcessing {
+		return nil, fmt.Errorf("messages in %s status can't be requeued", status)
+	}
+	var requeued []domain.Message
+	err := r.db.Model(&requeued).
+		Clauses(clause.Returning{}).
+		Where("status = ?", status).
+		Updates(map[string]any{"status": domain.StatusPending, "retry_count": 0, "version": gorm.Expr("version + 1")}).Error
+	if err != nil {
+		return nil, err
+	}
+	return requeued, nil
+}
+
+// ResetToPending resets the message with the given id back to pending with its retries, last error and the outcome
+// of a previous send cleared, whatever its status is. A resent message is sent again, so its previous sent time,
+// provider message id and delivery status no longer apply. The reset message is returned along with the status it
+// had. ErrMessageProcessing is returned if the message is being processed, ErrConcurrentUpdate if it is changed
+// meanwhile and ErrMessageNotFound if it doesn't exist.
+func (r *repo) ResetToPending(id int) (*domain.Message, domain.MessageStatus, error) {
+	msg, err := r.GetByID(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if msg.Status == domain.StatusProcessing {
+		return nil, 0, fmt.Errorf("%w: id %d is %s", ErrMessageProcessing, id, msg.Status)
+	}
+
+	// the version guard keeps the status read above the one that is reset
+	result := r.db.Model(&domain.Message{}).
+		Where("id = ? AND version = ?", id, msg.Version).
+		Updates(map[string]any{
+			"status":              domain.StatusPending,
+			"retry_count":         0,
+			"last_error":          nil,
+			"sent_at":             nil,
+			"provider_message_id": nil,
+			"delivery_status":     nil,
+			"updated_at":          time.Now().UTC(),
+			"version":             gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, 0, fmt.Errorf("%w: id %d", ErrConcurrentUpdate, id)
+	}
+	reset, err := r.GetByID(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return reset, msg.Status, nil
+}
+
+// GetSentMessages returns a page of messages with status 'sent' along with the total number of sent messages
+func (r *repo) GetSentMessages(ctx context.Context, limit, offset int) ([]domain.Message, int64, error) {
+	return r.GetMessagesByStatus(ctx, domain.StatusSuccess, limit, offset)
+}
+
+// GetMessagesByStatus returns a page of messages with the given status along with the total number of such messages
+func (r *repo) GetMessagesByStatus(ctx context.Context, status domain.MessageStatus, limit, offset int) ([]domain.Message, int64, error) {
+	var (
+		messages []domain.Message
+		total    int64
+	)
+	query := r.db.WithContext(ctx).Model(&domain.Message{}).Where("status = ?", status)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("id ASC").Limit(limit).Offset(offset).Find(&messages).Error
+	return messages, total, err
+}
+
+// StreamMessages calls fn for every message with the given status in id order. Messages are read in chunks by id
+// so the whole result is never held in memory. Iteration stops at the first error returned by fn.
+func (r *repo) StreamMessages(status domain.MessageStatus, fn func(domain.Message) error) error {
+	var chunk []domain.Message
+	return r.db.Model(&domain.Message{}).Where("status = ?", status).
+		FindInBatches(&chunk, streamChunkSize, func(tx *gorm.DB, batch int) error {
+			for _, msg := range chunk {
+				if err := fn(msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+// GetMessagesByBroadcast returns a page of messages of the given broadcast along with the total number of such messages.
+// Messages are filtered by status as well if it is not nil.
+func (r *repo) GetMessagesByBroadcast(broadcastID string, status *domain.MessageStatus, limit, offset int) ([]domain.Message, int64, error) {
+	var (
+		messages []domain.Message
+		total    int64
+	)
+	query := r.db.Model(&domain.Message{}).Where("broadcast_id = ?", broadcastID)
+	if status != nil {
+		query = query.Where("status = ?", *status)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("id ASC").Limit(limit).Offset(offset).Find(&messages).Error
+	return messages, total, err
+}
+
+// CountByStatus returns the number of messages in each status. Statuses without any message are omitted.
+func (r *repo) CountByStatus() (map[domain.MessageStatus]int64, error) {
+	var rows []struct {
+		Status domain.MessageStatus
+		Count  int64
+	}
+	if err := r.db.Model(&domain.Message{}).
+		Select("status, COUNT(*) AS count").
+		Group("status").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	counts := make(map[domain.MessageStatus]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
 }
 
 // CacheMessage writes given message attributes to cache
 func (r *repo) CacheMessage(ctx context.Context, msgID string, sentTime time.Time) error {
-	key := fmt.Sprintf("sent_msg:%s", msgID)
-
-	value := map[string]any{
-		"messageId": msgID,
-		"sentAt":    sentTime,
+	value := domain.CachedMessage{
+		MessageID: msgID,
+		SentAt:    sentTime,
 	}
 
 	jsonVal, _ := json.Marshal(value)
 	// Expire after 24 hours to keep memory clean
-	return r.cache.Set(ctx, key, string(jsonVal), 24*time.Hour)
+	return r.cache.Set(ctx, cachedMessageKey(msgID), string(jsonVal), 24*time.Hour)
+}
+
+// GetCachedMessage reads message attributes from cache. Nil is returned if the message is not cached or expired.
+func (r *repo) GetCachedMessage(ctx context.Context, msgID string) (*domain.CachedMessage, error) {
+	val, err := r.cache.Get(ctx, cachedMessageKey(msgID))
+	if errors.Is(err, cache.ErrCacheMiss) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cachedMsg := new(domain.CachedMessage)
+	if err = json.Unmarshal([]byte(val), cachedMsg); err != nil {
+		return nil, err
+	}
+	return cachedMsg, nil
+}
+
+// UncacheMessage evicts the message attributes from cache
+func (r *repo) UncacheMessage(ctx context.Context, msgID string) error {
+	return r.cache.Delete(ctx, cachedMessageKey(msgID))
+}
+
+// MarkRecentlySent records in cache that the message content is sent to its phone number for the given duration
+func (r *repo) MarkRecentlySent(ctx context.Context, msg *domain.Message, ttl time.Duration) error {
+	return r.cache.Set(ctx, sentHashKey(msg), strconv.Itoa(msg.ID), ttl)
+}
+
+// IsRecentlySent reports whether the same content is sent to the same phone number within the recorded duration
+func (r *repo) IsRecentlySent(ctx context.Context, msg *domain.Message) (bool, error) {
+	_, err := r.cache.Get(ctx, sentHashKey(msg))
+	if errors.Is(err, cache.ErrCacheMiss) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetLease records the owner processing the message until the ttl passes
+func (r *repo) SetLease(ctx context.Context, msgID int, owner string, ttl time.Duration) error {
+	return r.cache.Set(ctx, leaseKey(msgID), owner, ttl)
+}
+
+// ReleaseLease removes the processing lease of the message
+func (r *repo) ReleaseLease(ctx context.Context, msgID int) error {
+	return r.cache.Delete(ctx, leaseKey(msgID))
+}
+
+// RecoverExpiredLeases resets messages in processing whose lease is expired back to pending, returning the recovered
+// messages as they are after the reset. Only messages locked earlier than olderThan are considered, so messages
+// whose lease is not set yet are not recovered.
+func (r *repo) RecoverExpiredLeases(ctx context.Context, olderThan time.Duration) ([]domain.Message, error) {
+	var msgs []domain.Message
+	threshold := time.Now().UTC().Add(-olderThan)
+	if err := r.db.Select("id", "version").
+		Where("status = ?", domain.StatusProcessing).
+		Where("COALESCE(updated_at, created_at) < ?", threshold).
+		Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+
+	var recovered []domain.Message
+	for _, msg := range msgs {
+		_, err := r.cache.Get(ctx, leaseKey(msg.ID))
+		if err == nil {
+			// still owned by a running instance
+			continue
+		} else if !errors.Is(err, cache.ErrCacheMiss) {
+			return recovered, err
+		}
+
+		// the version guard skips messages that are finalized meanwhile
+		var rows []domain.Message
+		err = r.db.Model(&rows).
+			Clauses(clause.Returning{}).
+			Where("id = ? AND version = ? AND status = ?", msg.ID, msg.Version, domain.StatusProcessing).
+			Updates(map[string]any{"status": domain.StatusPending, "version": gorm.Expr("version + 1")}).Error
+		if err != nil {
+			return recovered, err
+		}
+		recovered = append(recovered, rows...)
+	}
+	return recovered, nil
+}
+
+func cachedMessageKey(msgID string) string {
+	return fmt.Sprintf("sent_msg:%s", msgID)
+}
+
+func leaseKey(msgID int) string {
+	return fmt.Sprintf("lease:%d", msgID)
+}
+
+func sentHashKey(msg *domain.Message) string {
+	hash := sha256.Sum256([]byte(msg.PhoneNumber + "\x00" + msg.Content))
+	return fmt.Sprintf("sent_hash:%s", hex.EncodeToString(hash[:]))
+}
+
+// truncateError cuts the error to the length of the last error column
+func truncateError(text string) string {
+	if utf8.RuneCountInString(text) <= domain.MaxLastErrorLength {
+		return text
+	}
+	return string([]rune(text)[:domain.MaxLastErrorLength-3]) + "..."
 }
@@ -0,0 +1,1074 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aniladanir/auto-messender-service/internal/cache/memory"
+	"github.com/aniladanir/auto-messender-service/internal/cache/redis"
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
+	"github.com/aniladanir/auto-messender-service/internal/persistant/sqlite"
+	"gorm.io/gorm"
+)
+
+// newTestRepo creates a repository on a private in-memory sqlite database and an in-memory cache
+func newTestRepo(t *testing.T, opts ...Option) (*repo, *gorm.DB) {
+	t.Helper()
+
+	db, err := sqlite.Initialize("file::memory:", []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { persistant.Close(db) })
+
+	return NewMessageRepository(db, memory.NewMemoryCache(t.Context()), opts...).(*repo), db
+}
+
+// seedMessages inserts the given messages as they are, without validation
+func seedMessages(t *testing.T, db *gorm.DB, msgs ...domain.Message) []domain.Message {
+	t.Helper()
+
+	for i := range msgs {
+		if msgs[i].Content == "" {
+			msgs[i].Content = "hello"
+		}
+		if msgs[i].PhoneNumber == "" {
+			msgs[i].PhoneNumber = "+905549998877"
+		}
+	}
+	if err := db.Create(&msgs).Error; err != nil {
+		t.Fatalf("failed to seed messages: %v", err)
+	}
+	return msgs
+}
+
+func getMessage(t *testing.T, db *gorm.DB, id int) domain.Message {
+	t.Helper()
+
+	var msg domain.Message
+	if err := db.First(&msg, id).Error; err != nil {
+		t.Fatalf("failed to read message %d: %v", id, err)
+	}
+	return msg
+}
+
+func messageIDs(msgs []domain.Message) []int {
+	ids := make([]int, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func TestFetchAndLockMessagesLocksPendingAndFailed(t *testing.T) {
+	r, db := newTestRepo(t)
+	seeded := seedMessages(t, db,
+		domain.Message{Status: domain.StatusFailed, RetryCount: 1},
+		domain.Message{Status: domain.StatusPending},
+		domain.Message{Status: domain.StatusSuccess},
+		domain.Message{Status: domain.StatusDeadLetter},
+		domain.Message{Status: domain.StatusProcessing},
+		domain.Message{Status: domain.StatusRejected},
+	)
+
+	msgs, err := r.FetchAndLockMessages(t.Context(), 10, 3)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+
+	// pending messages come first so retries can't starve new messages
+	ids := messageIDs(msgs)
+	if len(ids) != 2 || ids[0] != seeded[1].ID || ids[1] != seeded[0].ID {
+		t.Fatalf("fetched ids = %v, want [%d %d]", ids, seeded[1].ID, seeded[0].ID)
+	}
+	for _, id := range ids {
+		if got := getMessage(t, db, id).Status; got != domain.StatusProcessing {
+			t.Errorf("status of message %d = %s, want processing", id, got)
+		}
+	}
+
+	// locked messages are not fetched again
+	msgs, err = r.FetchAndLockMessages(t.Context(), 10, 3)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("fetched %d messages again, want none", len(msgs))
+	}
+}
+
+func TestFetchAndLockMessagesRespectsLimit(t *testing.T) {
+	r, db := newTestRepo(t)
+	seedMessages(t, db,
+		domain.Message{Status: domain.StatusPending},
+		domain.Message{Status: domain.StatusPending},
+		domain.Message{Status: domain.StatusPending},
+	)
+
+	msgs, err := r.FetchAndLockMessages(t.Context(), 2, 0)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Errorf("fetched %d messages, want 2", len(msgs))
+	}
+}
+
+func TestFetchAndLockMessagesSkipsExhaustedRetries(t *testing.T) {
+	r, db := newTestRepo(t)
+	seeded := seedMessages(t, db,
+		domain.Message{Status: domain.StatusFailed, RetryCount: 2},
+		domain.Message{Status: domain.StatusFailed, RetryCount: 3},
+	)
+
+	msgs, err := r.FetchAndLockMessages(t.Context(), 10, 3)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+	if ids := messageIDs(msgs); len(ids) != 1 || ids[0] != seeded[0].ID {
+		t.Fatalf("fetched ids = %v, want [%d]", ids, seeded[0].ID)
+	}
+	if got := getMessage(t, db, seeded[1].ID).Status; got != domain.StatusFailed {
+		t.Errorf("status of exhausted message = %s, want failed", got)
+	}
+}
+
+func TestFetchAndLockMessagesWithoutRetryLimit(t *testing.T) {
+	r, db := newTestRepo(t)
+	seedMessages(t, db, domain.Message{Status: domain.StatusFailed, RetryCount: 100})
+
+	msgs, err := r.FetchAndLockMessages(t.Context(), 10, 0)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Errorf("fetched %d messages, want 1 since the retry limit is disabled", len(msgs))
+	}
+}
+
+func TestUpdateStatusesSkipsConcurrentlyChangedMessages(t *testing.T) {
+	r, db := newTestRepo(t)
+	seedMessages(t, db,
+		domain.Message{Status: domain.StatusPending},
+		domain.Message{Status: domain.StatusPending},
+	)
+	msgs, err := r.FetchAndLockMessages(t.Context(), 10, 0)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+
+	// another process changes the second message after it is locked
+	if err := db.Model(&domain.Message{}).Where("id = ?", msgs[1].ID).
+		Update("version", gorm.Expr("version + 1")).Error; err != nil {
+		t.Fatalf("failed to change message: %v", err)
+	}
+
+	updated, err := r.UpdateStatuses(t.Context(), []*domain.Message{&msgs[0], &msgs[1]}, domain.StatusSuccess)
+	if !errors.Is(err, ErrConcurrentUpdate) {
+		t.Fatalf("UpdateStatuses() error = %v, want %v", err, ErrConcurrentUpdate)
+	}
+	if len(updated) != 1 || updated[0].ID != msgs[0].ID {
+		t.Fatalf("updated messages = %v, want only message %d", updated, msgs[0].ID)
+	}
+
+	first := getMessage(t, db, msgs[0].ID)
+	if first.Status != domain.StatusSuccess || first.SentAt == nil {
+		t.Errorf("first message status = %s, sent at = %v, want success with sent time", first.Status, first.SentAt)
+	}
+	if first.Version != msgs[0].Version {
+		t.Errorf("version of the updated message = %d, want %d as stored", msgs[0].Version, first.Version)
+	}
+	if got := getMessage(t, db, msgs[1].ID).Status; got != domain.StatusProcessing {
+		t.Errorf("status of the changed message = %s, want processing", got)
+	}
+}
+
+func TestUpdateStatusesRejectsSecondUpdateOfSameVersion(t *testing.T) {
+	r, db := newTestRepo(t)
+	seedMessages(t, db, domain.Message{Status: domain.StatusPending})
+	msgs, err := r.FetchAndLockMessages(t.Context(), 10, 0)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+
+	// two processes hold the same locked version of the message
+	first, second := msgs[0], msgs[0]
+	if _, err := r.UpdateStatuses(t.Context(), []*domain.Message{&first}, domain.StatusSuccess); err != nil {
+		t.Fatalf("first UpdateStatuses() error = %v", err)
+	}
+	updated, err := r.UpdateStatuses(t.Context(), []*domain.Message{&second}, domain.StatusFailed)
+	if !errors.Is(err, ErrConcurrentUpdate) {
+		t.Fatalf("second UpdateStatuses() error = %v, want %v", err, ErrConcurrentUpdate)
+	}
+	if len(updated) != 0 {
+		t.Errorf("second update changed %d messages, want none", len(updated))
+	}
+	if got := getMessage(t, db, first.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("status = %s, want success from the first update", got)
+	}
+}
+
+func TestSetProviderMessageID(t *testing.T) {
+	r, db := newTestRepo(t)
+	seeded := seedMessages(t, db, domain.Message{Status: domain.StatusProcessing})
+
+	msg := seeded[0]
+	if err := r.SetProviderMessageID(t.Context(), &msg, "provider-1"); err != nil {
+		t.Fatalf("SetProviderMessageID() error = %v", err)
+	}
+	if msg.ProviderMessageID == nil || *msg.ProviderMessageID != "provider-1" {
+		t.Errorf("provider message id of the message = %v, want provider-1", msg.ProviderMessageID)
+	}
+	if got := getMessage(t, db, msg.ID).ProviderMessageID; got == nil || *got != "provider-1" {
+		t.Errorf("stored provider message id = %v, want provider-1", got)
+	}
+
+	missing := domain.Message{ID: msg.ID + 1}
+	if err := r.SetProviderMessageID(t.Context(), &missing, "provider-2"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("SetProviderMessageID() of a missing message error = %v, want %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestFetchAndLockMessagesAbortsOnCancellation(t *testing.T) {
+	r, db := newTestRepo(t)
+	seeded := seedMessages(t, db, domain.Message{Status: domain.StatusPending}, domain.Message{Status: domain.StatusFailed})
+
+	// shutdown begins after the messages are selected, before they are locked
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	if err := db.Callback().Query().After("gorm:query").Register("test:cancel", func(tx *gorm.DB) {
+		cancel()
+	}); err != nil {
+		t.Fatalf("failed to register callback: %v", err)
+	}
+
+	msgs, err := r.FetchAndLockMessages(ctx, 10, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("FetchAndLockMessages() error = %v, want %v", err, context.Canceled)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("FetchAndLockMessages() = %d messages, want none", len(msgs))
+	}
+	// the transaction is rolled back, so no message is left in processing
+	for _, msg := range seeded {
+		if got := getMessage(t, db, msg.ID); got.Status != msg.Status || got.Version != msg.Version {
+			t.Errorf("message = %s at version %d, want %s at version %d", got.Status, got.Version, msg.Status, msg.Version)
+		}
+	}
+}
+
+func TestWritesRespectCancelledContext(t *testing.T) {
+	r, db := newTestRepo(t)
+	seeded := seedMessages(t, db, domain.Message{Status: domain.StatusProcessing})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	writes := map[string]func(msg *domain.Message) error{
+		"UpdateStatuses": func(msg *domain.Message) error {
+			_, err := r.UpdateStatuses(ctx, []*domain.Message{msg}, domain.StatusSuccess)
+			return err
+		},
+		"RecordFailure":        func(msg *domain.Message) error { return r.RecordFailure(ctx, msg, "failed") },
+		"SetLastError":         func(msg *domain.Message) error { return r.SetLastError(ctx, msg, "failed") },
+		"SetProviderMessageID": func(msg *domain.Message) error { return r.SetProviderMessageID(ctx, msg, "provider-1") },
+	}
+	for name, write := range writes {
+		t.Run(name, func(t *testing.T) {
+			msg := seeded[0]
+			if err := write(&msg); !errors.Is(err, context.Canceled) {
+				t.Fatalf("%s() error = %v, want %v", name, err, context.Canceled)
+			}
+
+			got := getMessage(t, db, msg.ID)
+			if got.Status != domain.StatusProcessing || got.RetryCount != 0 || got.LastError != nil || got.ProviderMessageID != nil {
+				t.Errorf("message is changed by a cancelled write: %+v", got)
+			}
+		})
+	}
+}
+
+func TestRecordFailurePersistsRetryCount(t *testing.T) {
+	r, db := newTestRepo(t)
+	seeded := seedMessages(t, db, domain.Message{Status: domain.StatusProcessing})
+
+	msg := seeded[0]
+	for _, reason := range []string{"first", "second"} {
+		if err := r.RecordFailure(t.Context(), &msg, reason); err != nil {
+			t.Fatalf("RecordFailure() error = %v", err)
+		}
+	}
+	if msg.RetryCount != 2 {
+		t.Errorf("retry count of the message = %d, want 2", msg.RetryCount)
+	}
+
+	// a repository created after a restart reads the persisted count
+	restarted := NewMessageRepository(db, memory.NewMemoryCache(t.Context()))
+	got, err := restarted.GetByID(msg.ID)
+	if err != nil {
+		t.Fatalf("GetByID() error = %v", err)
+	}
+	if got.RetryCount != 2 {
+		t.Errorf("persisted retry count = %d, want 2", got.RetryCount)
+	}
+	if got.LastError == nil || *got.LastError != "second" {
+		t.Errorf("last error = %v, want second", got.LastError)
+	}
+}
+
+func TestLastErrorIsTruncated(t *testing.T) {
+	r, db := newTestRepo(t)
+	msg := seedMessages(t, db, domain.Message{Status: domain.StatusProcessing})[0]
+
+	// the limit is in characters, so multi byte characters aren't split
+	reason := strings.Repeat("ğ", domain.MaxLastErrorLength+10)
+	if err := r.RecordFailure(t.Context(), &msg, reason); err != nil {
+		t.Fatalf("RecordFailure() error = %v", err)
+	}
+
+	want := strings.Repeat("ğ", domain.MaxLastErrorLength-3) + "..."
+	got := getMessage(t, db, msg.ID)
+	if got.LastError == nil || *got.LastError != want {
+		t.Errorf("last error = %v, want it truncated to %d characters", got.LastError, domain.MaxLastErrorLength)
+	}
+	if *msg.LastError != want {
+		t.Errorf("last error of the message = %q, want the truncated error", *msg.LastError)
+	}
+
+	// errors within the limit are stored as they are
+	if err := r.SetLastError(t.Context(), &msg, "webhook responded with status 500"); err != nil {
+		t.Fatalf("SetLastError() error = %v", err)
+	}
+	if got := getMessage(t, db, msg.ID); got.LastError == nil || *got.LastError != "webhook responded with status 500" {
+		t.Errorf("last error = %v, want it as it is", got.LastError)
+	}
+}
+
+func TestRecoverStaleMessages(t *testing.T) {
+	r, db := newTestRepo(t)
+	stale := time.Now().UTC().Add(-time.Hour)
+	seeded := seedMessages(t, db,
+		domain.Message{Status: domain.StatusProcessing, UpdatedAt: &stale},
+		domain.Message{Status: domain.StatusProcessing},
+		domain.Message{Status: domain.StatusSuccess, UpdatedAt: &stale},
+	)
+
+	recovered, err := r.RecoverStaleMessages(context.Background(), 10*time.Minute)
+	if err != nil {
+		t.Fatalf("RecoverStaleMessages() error = %v", err)
+	}
+	if len(recovered) != 1 || recovered[0].ID != seeded[0].ID || recovered[0].Status != domain.StatusPending {
+		t.Errorf("recovered %+v, want message %d as pending", recovered, seeded[0].ID)
+	}
+
+	want := []domain.MessageStatus{domain.StatusPending, domain.StatusProcessing, domain.StatusSuccess}
+	for i, msg := range seeded {
+		got := getMessage(t, db, msg.ID)
+		if got.Status != want[i] {
+			t.Errorf("status of message %d = %s, want %s", i, got.Status, want[i])
+		}
+		// recovered messages get a new version so a crashed sender can't finalize them
+		if i == 0 && got.Version != msg.Version+1 {
+			t.Errorf("version of the recovered message = %d, want %d", got.Version, msg.Version+1)
+		}
+	}
+}
+
+func TestRequeueByStatus(t *testing.T) {
+	r, db := newTestRepo(t)
+	lastError := "webhook responded with status 500"
+	seeded := seedMessages(t, db,
+		domain.Message{Status: domain.StatusFailed, RetryCount: 3, LastError: &lastError},
+		domain.Message{Status: domain.StatusFailed, RetryCount: 1},
+		domain.Message{Status: domain.StatusDeadLetter, RetryCount: 3},
+		domain.Message{Status: domain.StatusSuccess},
+	)
+
+	requeued, err := r.RequeueByStatus(domain.StatusFailed)
+	if err != nil {
+		t.Fatalf("RequeueByStatus() error = %v", err)
+	}
+	if len(requeued) != 2 {
+		t.Errorf("requeued %d messages, want 2", len(requeued))
+	}
+	for _, msg := range requeued {
+		if msg.Status != domain.StatusPending || msg.RetryCount != 0 {
+			t.Errorf("returned requeued message %d = %s with %d retries, want pending with 0 retries", msg.ID, msg.Status, msg.RetryCount)
+		}
+	}
+
+	for _, msg := range seeded[:2] {
+		got := getMessage(t, db, msg.ID)
+		if got.Status != domain.StatusPending || got.RetryCount != 0 || got.Version != msg.Version+1 {
+			t.Errorf("requeued message = %s with %d retries at version %d, want pending with 0 retries at version %d",
+				got.Status, got.RetryCount, got.Version, msg.Version+1)
+		}
+	}
+	for _, msg := range seeded[2:] {
+		if got := getMessage(t, db, msg.ID); got.Status != msg.Status || got.RetryCount != msg.RetryCount {
+			t.Errorf("message in %s status = %s with %d retries, want it unchanged", msg.Status, got.Status, got.RetryCount)
+		}
+	}
+}
+
+func TestRequeueByStatusRejectsProcessing(t *testing.T) {
+	r, db := newTestRepo(t)
+	msg := seedMessages(t, db, domain.Message{Status: domain.StatusProcessing})[0]
+
+	if _, err := r.RequeueByStatus(domain.StatusProcessing); err == nil {
+		t.Error("RequeueByStatus() of processing messages error = nil, want an error")
+	}
+	if got := getMessage(t, db, msg.ID); got.Status != domain.StatusProcessing {
+		t.Errorf("status = %s, want %s", got.Status, domain.StatusProcessing)
+	}
+}
+
+func TestProcessingLeases(t *testing.T) {
+	r, db := newTestRepo(t)
+	mr := miniredis.RunT(t)
+	r.cache = redisCacheOf(t, mr)
+
+	locked := time.Now().UTC().Add(-time.Hour)
+	recent := time.Now().UTC()
+	seeded := seedMessages(t, db,
+		domain.Message{Status: domain.StatusProcessing, UpdatedAt: &locked},
+		domain.Message{Status: domain.StatusProcessing, UpdatedAt: &locked},
+		domain.Message{Status: domain.StatusProcessing, UpdatedAt: &recent},
+		domain.Message{Status: domain.StatusPending, UpdatedAt: &locked},
+	)
+	leased, unleased, justLocked, pending := seeded[0], seeded[1], seeded[2], seeded[3]
+
+	// the lease records its owner until the ttl passes
+	if err := r.SetLease(t.Context(), leased.ID, "instance-1", time.Minute); err != nil {
+		t.Fatalf("SetLease() error = %v", err)
+	}
+	key := leaseKey(leased.ID)
+	if got, err := mr.Get(key); err != nil || got != "instance-1" {
+		t.Errorf("lease = %q, %v, want owner instance-1", got, err)
+	}
+	if got := mr.TTL(key); got != time.Minute {
+		t.Errorf("lease ttl = %s, want %s", got, time.Minute)
+	}
+
+	// only messages locked earlier than the threshold without a lease are recovered
+	recovered, err := r.RecoverExpiredLeases(t.Context(), 10*time.Minute)
+	if err != nil {
+		t.Fatalf("RecoverExpiredLeases() error = %v", err)
+	}
+	if len(recovered) != 1 || recovered[0].ID != unleased.ID || recovered[0].Status != domain.StatusPending {
+		t.Errorf("recovered %+v, want message %d as pending", recovered, unleased.ID)
+	}
+	want := map[int]domain.MessageStatus{
+		leased.ID:     domain.StatusProcessing,
+		unleased.ID:   domain.StatusPending,
+		justLocked.ID: domain.StatusProcessing,
+		pending.ID:    domain.StatusPending,
+	}
+	for id, status := range want {
+		if got := getMessage(t, db, id); got.Status != status {
+			t.Errorf("status of message %d = %s, want %s", id, got.Status, status)
+		}
+	}
+	if got := getMessage(t, db, unleased.ID); got.Version != unleased.Version+1 {
+		t.Errorf("version of the recovered message = %d, want %d", got.Version, unleased.Version+1)
+	}
+
+	// the message is recovered once its lease expires
+	mr.FastForward(2 * time.Minute)
+	if recovered, err := r.RecoverExpiredLeases(t.Context(), 10*time.Minute); err != nil || len(recovered) != 1 {
+		t.Errorf("RecoverExpiredLeases() after the lease expired = %d messages, %v, want 1, nil", len(recovered), err)
+	}
+	if got := getMessage(t, db, leased.ID); got.Status != domain.StatusPending {
+		t.Errorf("status of the message with an expired lease = %s, want %s", got.Status, domain.StatusPending)
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	r, mr := newRedisTestRepo(t)
+
+	if err := r.SetLease(t.Context(), 1, "instance-1", time.Minute); err != nil {
+		t.Fatalf("SetLease() error = %v", err)
+	}
+	if err := r.ReleaseLease(t.Context(), 1); err != nil {
+		t.Fatalf("ReleaseLease() error = %v", err)
+	}
+	if mr.Exists(leaseKey(1)) {
+		t.Error("lease exists after ReleaseLease()")
+	}
+
+	// releasing a lease that is gone is not an error
+	if err := r.ReleaseLease(t.Context(), 1); err != nil {
+		t.Errorf("ReleaseLease() of a missing lease error = %v", err)
+	}
+}
+
+func TestRecoverExpiredLeasesReportsCacheErrors(t *testing.T) {
+	r, db := newTestRepo(t)
+	mr := miniredis.RunT(t)
+	r.cache = redisCacheOf(t, mr)
+
+	locked := time.Now().UTC().Add(-time.Hour)
+	msg := seedMessages(t, db, domain.Message{Status: domain.StatusProcessing, UpdatedAt: &locked})[0]
+
+	// a lease that can't be read may still be held, so the message is not recovered
+	mr.Close()
+	if _, err := r.RecoverExpiredLeases(t.Context(), time.Minute); err == nil {
+		t.Error("RecoverExpiredLeases() error = nil, want the cache error")
+	}
+	if got := getMessage(t, db, msg.ID); got.Status != domain.StatusProcessing {
+		t.Errorf("status = %s, want %s", got.Status, domain.StatusProcessing)
+	}
+}
+
+func TestCreateMessageValidatesBeforeInsert(t *testing.T) {
+	r, db := newTestRepo(t)
+
+	msg := domain.Message{Content: strings.Repeat("a", domain.MaxContentLength+1), PhoneNumber: "+905549998877"}
+	if _, err := r.CreateMessage(&msg); !errors.Is(err, domain.ErrContentTooLong) {
+		t.Fatalf("CreateMessage() error = %v, want %v", err, domain.ErrContentTooLong)
+	}
+
+	var count int64
+	if err := db.Model(&domain.Message{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("%d messages are inserted, want 0", count)
+	}
+}
+
+// newRedisTestRepo creates a repository whose cache is a redis client connected to a miniredis instance
+func newRedisTestRepo(t *testing.T) (*repo, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	return NewMessageRepository(nil, redisCacheOf(t, mr)).(*repo), mr
+}
+
+// redisCacheOf creates a redis cache connected to the miniredis instance
+func redisCacheOf(t *testing.T, mr *miniredis.Miniredis) *redis.RedisCache {
+	t.Helper()
+
+	redisCache, err := redis.NewRedisCache(t.Context(), mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+	return redisCache
+}
+
+func TestGetCachedMessage(t *testing.T) {
+	r, mr := newRedisTestRepo(t)
+	sentAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := r.CacheMessage(t.Context(), "provider-1", sentAt); err != nil {
+		t.Fatalf("CacheMessage() error = %v", err)
+	}
+
+	got, err := r.GetCachedMessage(t.Context(), "provider-1")
+	if err != nil {
+		t.Fatalf("GetCachedMessage() error = %v", err)
+	}
+	if got == nil || got.MessageID != "provider-1" || !got.SentAt.Equal(sentAt) {
+		t.Errorf("GetCachedMessage() = %+v, want message provider-1 sent at %s", got, sentAt)
+	}
+
+	if got, err := r.GetCachedMessage(t.Context(), "unknown"); err != nil || got != nil {
+		t.Errorf("GetCachedMessage() of unknown id = %+v, %v, want nil, nil", got, err)
+	}
+
+	mr.FastForward(25 * time.Hour)
+	if got, err := r.GetCachedMessage(t.Context(), "provider-1"); err != nil || got != nil {
+		t.Errorf("GetCachedMessage() after expiry = %+v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestGetMessagesByStatus(t *testing.T) {
+	r, db := newTestRepo(t)
+	msgs := seedMessages(t, db,
+		domain.Message{Status: domain.StatusSuccess},
+		domain.Message{Status: domain.StatusFailed},
+		domain.Message{Status: domain.StatusSuccess},
+		domain.Message{Status: domain.StatusPending},
+	)
+
+	got, total, err := r.GetMessagesByStatus(t.Context(), domain.StatusSuccess, 10, 0)
+	if err != nil {
+		t.Fatalf("GetMessagesByStatus() error = %v", err)
+	}
+	if total != 2 || !slices.Equal(messageIDs(got), []int{msgs[0].ID, msgs[2].ID}) {
+		t.Errorf("GetMessagesByStatus() = %v of %d, want %v of 2", messageIDs(got), total, []int{msgs[0].ID, msgs[2].ID})
+	}
+}
+
+func TestUncacheMessage(t *testing.T) {
+	r, _ := newRedisTestRepo(t)
+
+	if err := r.CacheMessage(t.Context(), "provider-1", time.Now()); err != nil {
+		t.Fatalf("CacheMessage() error = %v", err)
+	}
+	if err := r.UncacheMessage(t.Context(), "provider-1"); err != nil {
+		t.Fatalf("UncacheMessage() error = %v", err)
+	}
+	if got, err := r.GetCachedMessage(t.Context(), "provider-1"); err != nil || got != nil {
+		t.Errorf("GetCachedMessage() after UncacheMessage() = %+v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestFetchAndLockMessagesSkipsScheduledMessagesUntilDue(t *testing.T) {
+	r, db := newTestRepo(t)
+	past := time.Now().UTC().Add(-time.Minute)
+	soon := time.Now().UTC().Add(100 * time.Millisecond)
+	later := time.Now().UTC().Add(time.Hour)
+	seeded := seedMessages(t, db,
+		domain.Message{Status: domain.StatusPending, ScheduledAt: &past},
+		domain.Message{Status: domain.StatusPending, ScheduledAt: &soon},
+		domain.Message{Status: domain.StatusPending, ScheduledAt: &later},
+	)
+
+	msgs, err := r.FetchAndLockMessages(t.Context(), 10, 3)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+	if ids := messageIDs(msgs); !slices.Equal(ids, []int{seeded[0].ID}) {
+		t.Fatalf("fetched ids = %v, want only the due message %d", ids, seeded[0].ID)
+	}
+
+	time.Sleep(time.Until(soon))
+	msgs, err = r.FetchAndLockMessages(t.Context(), 10, 3)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+	if ids := messageIDs(msgs); !slices.Equal(ids, []int{seeded[1].ID}) {
+		t.Errorf("fetched ids = %v, want the message %d once it is due", ids, seeded[1].ID)
+	}
+}
+
+func TestCreateMessageWithIdempotencyKey(t *testing.T) {
+	r, db := newTestRepo(t)
+	key := "request-1"
+
+	first := domain.Message{Content: "hello", PhoneNumber: "+905549998877", IdempotencyKey: &key}
+	created, err := r.CreateMessage(&first)
+	if err != nil || !created {
+		t.Fatalf("CreateMessage() = %t, %v, want created", created, err)
+	}
+
+	second := domain.Message{Content: "another content", PhoneNumber: "+905549998877", IdempotencyKey: &key}
+	created, err = r.CreateMessage(&second)
+	if err != nil {
+		t.Fatalf("CreateMessage() with the same key error = %v", err)
+	}
+	if created {
+		t.Error("CreateMessage() with the same key created a message")
+	}
+	if second.ID != first.ID || second.Content != "hello" {
+		t.Errorf("CreateMessage() with the same key = message %d %q, want the existing message %d", second.ID, second.Content, first.ID)
+	}
+
+	var count int64
+	if err := db.Model(&domain.Message{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("%d messages are stored, want 1", count)
+	}
+
+	// messages without a key are never deduplicated
+	for range 2 {
+		if created, err := r.CreateMessage(&domain.Message{Content: "hello", PhoneNumber: "+905549998877"}); err != nil || !created {
+			t.Errorf("CreateMessage() without key = %t, %v, want created", created, err)
+		}
+	}
+}
+
+func TestCountByStatus(t *testing.T) {
+	r, db := newTestRepo(t)
+	seedMessages(t, db,
+		domain.Message{Status: domain.StatusPending},
+		domain.Message{Status: domain.StatusPending},
+		domain.Message{Status: domain.StatusSuccess},
+		domain.Message{Status: domain.StatusFailed},
+		domain.Message{Status: domain.StatusPending},
+		domain.Message{Status: domain.StatusDeadLetter},
+	)
+
+	got, err := r.CountByStatus()
+	if err != nil {
+		t.Fatalf("CountByStatus() error = %v", err)
+	}
+	want := map[domain.MessageStatus]int64{
+		domain.StatusPending:    3,
+		domain.StatusSuccess:    1,
+		domain.StatusFailed:     1,
+		domain.StatusDeadLetter: 1,
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("CountByStatus() = %v, want %v", got, want)
+	}
+}
+
+func TestUpdateStatusesSetsSentAtOnlyOnSuccess(t *testing.T) {
+	for _, status := range []domain.MessageStatus{domain.StatusSuccess, domain.StatusFailed, domain.StatusRejected, domain.StatusDeadLetter} {
+		t.Run(status.String(), func(t *testing.T) {
+			r, db := newTestRepo(t)
+			seedMessages(t, db, domain.Message{Status: domain.StatusPending})
+			msgs, err := r.FetchAndLockMessages(t.Context(), 10, 0)
+			if err != nil {
+				t.Fatalf("FetchAndLockMessages() error = %v", err)
+			}
+
+			updated, err := r.UpdateStatuses(t.Context(), []*domain.Message{&msgs[0]}, status)
+			if err != nil {
+				t.Fatalf("UpdateStatuses() error = %v", err)
+			}
+
+			wantSent := status == domain.StatusSuccess
+			if got := getMessage(t, db, msgs[0].ID).SentAt; (got != nil) != wantSent {
+				t.Errorf("stored sent at = %v, want set %t", got, wantSent)
+			}
+			if got := updated[0].SentAt; (got != nil) != wantSent {
+				t.Errorf("sent at of the updated message = %v, want set %t", got, wantSent)
+			}
+		})
+	}
+}
+
+func TestCreateBroadcastGroupsMessages(t *testing.T) {
+	r, db := newTestRepo(t)
+	seedMessages(t, db, domain.Message{Status: domain.StatusPending})
+
+	msgs := []domain.Message{
+		{Content: "hello", PhoneNumber: "+905549998871", Status: domain.StatusPending},
+		{Content: "hello", PhoneNumber: "+905549998872", Status: domain.StatusPending},
+		{Content: "hello", PhoneNumber: "+905549998873", Status: domain.StatusPending},
+	}
+	if err := r.CreateBroadcast("broadcast-1", msgs); err != nil {
+		t.Fatalf("CreateBroadcast() error = %v", err)
+	}
+	if err := r.CreateBroadcast("broadcast-2", []domain.Message{{Content: "other", PhoneNumber: "+905549998874", Status: domain.StatusPending}}); err != nil {
+		t.Fatalf("CreateBroadcast() error = %v", err)
+	}
+	for _, msg := range msgs {
+		if got := getMessage(t, db, msg.ID).BroadcastID; got == nil || *got != "broadcast-1" {
+			t.Errorf("broadcast id of message %d = %v, want broadcast-1", msg.ID, got)
+		}
+	}
+
+	got, total, err := r.GetMessagesByBroadcast("broadcast-1", nil, 2, 0)
+	if err != nil {
+		t.Fatalf("GetMessagesByBroadcast() error = %v", err)
+	}
+	if total != 3 || !slices.Equal(messageIDs(got), messageIDs(msgs[:2])) {
+		t.Errorf("first page = %v of %d, want %v of 3", messageIDs(got), total, messageIDs(msgs[:2]))
+	}
+	got, _, err = r.GetMessagesByBroadcast("broadcast-1", nil, 2, 2)
+	if err != nil {
+		t.Fatalf("GetMessagesByBroadcast() error = %v", err)
+	}
+	if !slices.Equal(messageIDs(got), messageIDs(msgs[2:])) {
+		t.Errorf("second page = %v, want %v", messageIDs(got), messageIDs(msgs[2:]))
+	}
+
+	// filtering by status as well
+	if err := db.Model(&domain.Message{}).Where("id = ?", msgs[1].ID).Update("status", domain.StatusSuccess).Error; err != nil {
+		t.Fatalf("failed to update message: %v", err)
+	}
+	success := domain.StatusSuccess
+	got, total, err = r.GetMessagesByBroadcast("broadcast-1", &success, 10, 0)
+	if err != nil {
+		t.Fatalf("GetMessagesByBroadcast() error = %v", err)
+	}
+	if total != 1 || !slices.Equal(messageIDs(got), []int{msgs[1].ID}) {
+		t.Errorf("successful messages = %v of %d, want [%d] of 1", messageIDs(got), total, msgs[1].ID)
+	}
+}
+
+func TestCreateBroadcastValidatesBeforeInsert(t *testing.T) {
+	r, db := newTestRepo(t)
+
+	msgs := []domain.Message{
+		{Content: "hello", PhoneNumber: "+905549998871", Status: domain.StatusPending},
+		{Content: "hello", PhoneNumber: "", Status: domain.StatusPending},
+	}
+	if err := r.CreateBroadcast("broadcast-1", msgs); !errors.Is(err, domain.ErrEmptyPhoneNumber) {
+		t.Fatalf("CreateBroadcast() error = %v, want %v", err, domain.ErrEmptyPhoneNumber)
+	}
+	var count int64
+	if err := db.Model(&domain.Message{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("%d messages are created, want none", count)
+	}
+}
+
+func TestGetByID(t *testing.T) {
+	r, db := newTestRepo(t)
+	seeded := seedMessages(t, db, domain.Message{Status: domain.StatusSuccess})
+
+	msg, err := r.GetByID(seeded[0].ID)
+	if err != nil {
+		t.Fatalf("GetByID() error = %v", err)
+	}
+	if msg.ID != seeded[0].ID || msg.Status != domain.StatusSuccess {
+		t.Errorf("GetByID() = %+v, want the seeded message", msg)
+	}
+
+	if _, err := r.GetByID(seeded[0].ID + 1); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("GetByID() of a missing message error = %v, want %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestUpdateStatusesOnlyChangesStatusColumns(t *testing.T) {
+	r, db := newTestRepo(t)
+	seedMessages(t, db, domain.Message{Status: domain.StatusPending})
+	msgs, err := r.FetchAndLockMessages(t.Context(), 10, 0)
+	if err != nil {
+		t.Fatalf("FetchAndLockMessages() error = %v", err)
+	}
+	before := getMessage(t, db, msgs[0].ID)
+
+	// the in-memory message differs from its row, none of those fields may be written
+	msg := msgs[0]
+	msg.Content = "changed in memory"
+	msg.PhoneNumber = "+905549990000"
+	msg.RetryCount = 5
+	updated, err := r.UpdateStatuses(t.Context(), []*domain.Message{&msg}, domain.StatusFailed)
+	if err != nil || len(updated) != 1 {
+		t.Fatalf("UpdateStatuses() = %v, %v, want the message updated", updated, err)
+	}
+
+	after := getMessage(t, db, msg.ID)
+	if after.Status != domain.StatusFailed {
+		t.Errorf("status = %s, want failed", after.Status)
+	}
+	if after.UpdatedAt == nil || (before.UpdatedAt != nil && !after.UpdatedAt.After(*before.UpdatedAt)) {
+		t.Errorf("updated at = %v, want it later than %v", after.UpdatedAt, before.UpdatedAt)
+	}
+	// version is bumped along with the status so concurrent writers notice the change
+	if after.Version != before.Version+1 {
+		t.Errorf("version = %d, want %d", after.Version, before.Version+1)
+	}
+	if after.Content != before.Content || after.PhoneNumber != before.PhoneNumber || after.RetryCount != before.RetryCount ||
+		!after.CreatedAt.Equal(before.CreatedAt) || after.SentAt != nil {
+		t.Errorf("message after update = %+v, want only status columns changed from %+v", after, before)
+	}
+
+	// the in-memory message is kept in sync with the changed columns
+	if msg.Status != domain.StatusFailed || msg.Version != after.Version || msg.UpdatedAt == nil {
+		t.Errorf("in-memory message = %+v, want status, version and updated at in sync", msg)
+	}
+}
+
+func TestResetToPendingReturnsPreviousStatus(t *testing.T) {
+	r, db := newTestRepo(t)
+	msg := seedMessages(t, db, domain.Message{Status: domain.StatusDeadLetter, RetryCount: 3})[0]
+
+	reset, oldStatus, err := r.ResetToPending(msg.ID)
+	if err != nil {
+		t.Fatalf("ResetToPending() error = %v", err)
+	}
+	if oldStatus != domain.StatusDeadLetter {
+		t.Errorf("previous status = %s, want %s", oldStatus, domain.StatusDeadLetter)
+	}
+	if reset.Status != domain.StatusPending || reset.RetryCount != 0 || reset.Version != msg.Version+1 {
+		t.Errorf("reset message = %s with %d retries at version %d, want pending with 0 retries at version %d",
+			reset.Status, reset.RetryCount, reset.Version, msg.Version+1)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	r, db := newTestRepo(t)
+	seeded := seedMessages(t, db, domain.Message{Status: domain.StatusProcessing})
+	missingID := seeded[0].ID + 1
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{name: "get missing message", call: func() error { _, err := r.GetByID(missingID); return err }, want: ErrMessageNotFound},
+		{name: "reset missing message", call: func() error { _, _, err := r.ResetToPending(missingID); return err }, want: ErrMessageNotFound},
+		{name: "reset message in processing", call: func() error { _, _, err := r.ResetToPending(seeded[0].ID); return err }, want: ErrMessageProcessing},
+		{
+			name: "delivery of unknown provider id",
+			call: func() error { return r.UpdateDeliveryStatus("provider-1", domain.DeliveryDelivered) },
+			want: ErrMessageNotFound,
+		},
+		{
+			name: "status of a message changed by another process",
+			call: func() error {
+				stale := seeded[0]
+				stale.Version--
+				_, err := r.UpdateStatuses(t.Context(), []*domain.Message{&stale}, domain.StatusSuccess)
+				return err
+			},
+			want: ErrConcurrentUpdate,
+		},
+	}
+	sentinels := []error{ErrMessageNotFound, ErrConcurrentUpdate, ErrMessageProcessing}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			for _, sentinel := range sentinels {
+				if got, want := errors.Is(err, sentinel), sentinel == tt.want; got != want {
+					t.Errorf("errors.Is(%v, %v) = %t, want %t", err, sentinel, got, want)
+				}
+			}
+			// the sentinel is wrapped with the details of the failure
+			if err != nil && err.Error() == tt.want.Error() {
+				t.Errorf("error = %q, want details along with the sentinel", err)
+			}
+		})
+	}
+}
+
+func TestStreamMessages(t *testing.T) {
+	r, db := newTestRepo(t)
+	// more messages than a chunk, interleaved with messages of another status
+	msgs := make([]domain.Message, 0, 2*streamChunkSize+100)
+	for i := range cap(msgs) {
+		status := domain.StatusSuccess
+		if i%3 == 0 {
+			status = domain.StatusPending
+		}
+		msgs = append(msgs, domain.Message{Status: status})
+	}
+	seeded := seedMessages(t, db, msgs...)
+	var want []int
+	for _, msg := range seeded {
+		if msg.Status == domain.StatusSuccess {
+			want = append(want, msg.ID)
+		}
+	}
+
+	var visited []int
+	err := r.StreamMessages(domain.StatusSuccess, func(msg domain.Message) error {
+		visited = append(visited, msg.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamMessages() error = %v", err)
+	}
+	// every message is visited exactly once, in id order
+	if !slices.Equal(visited, want) {
+		t.Errorf("visited %d messages, want the %d successful messages in id order", len(visited), len(want))
+	}
+
+	// streaming stops at the first error
+	errStop := errors.New("stop")
+	visited = nil
+	err = r.StreamMessages(domain.StatusSuccess, func(msg domain.Message) error {
+		visited = append(visited, msg.ID)
+		if len(visited) == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("StreamMessages() error = %v, want %v", err, errStop)
+	}
+	if !slices.Equal(visited, want[:3]) {
+		t.Errorf("visited %v before stopping, want %v", visited, want[:3])
+	}
+}
+
+// countInserts counts the insert statements executed on the database, failing the statement with the given number
+// if it is positive
+func countInserts(t *testing.T, db *gorm.DB, failAt int) (inserts func() int) {
+	t.Helper()
+
+	count := 0
+	if err := db.Callback().Create().After("gorm:create").Register("test:count_inserts", func(tx *gorm.DB) {
+		count++
+		if count == failAt {
+			tx.AddError(errors.New("statement timeout"))
+		}
+	}); err != nil {
+		t.Fatalf("failed to register callback: %v", err)
+	}
+	return func() int { return count }
+}
+
+func newBulkMessages(n int) []domain.Message {
+	msgs := make([]domain.Message, n)
+	for i := range msgs {
+		msgs[i] = domain.Message{Content: fmt.Sprintf("hello %d", i), PhoneNumber: "+905549998877", Status: domain.StatusPending}
+	}
+	return msgs
+}
+
+func TestCreateMessagesInsertsInChunks(t *testing.T) {
+	r, db := newTestRepo(t, WithInsertBatchSize(10))
+	inserts := countInserts(t, db, 0)
+
+	msgs := newBulkMessages(95)
+	if err := r.CreateMessages(msgs); err != nil {
+		t.Fatalf("CreateMessages() error = %v", err)
+	}
+
+	if got := inserts(); got != 10 {
+		t.Errorf("%d insert statements are executed, want 10", got)
+	}
+	var count int64
+	if err := db.Model(&domain.Message{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != int64(len(msgs)) {
+		t.Errorf("%d messages are inserted, want %d", count, len(msgs))
+	}
+	// every message gets its id back regardless of its chunk
+	for i, msg := range msgs {
+		if msg.ID == 0 {
+			t.Fatalf("message at index %d has no id", i)
+		}
+	}
+}
+
+func TestCreateMessagesChunksAreAtomic(t *testing.T) {
+	r, db := newTestRepo(t, WithInsertBatchSize(10))
+	// the third chunk fails after the first two are inserted
+	countInserts(t, db, 3)
+
+	if err := r.CreateMessages(newBulkMessages(95)); err == nil {
+		t.Fatal("CreateMessages() error = nil, want the insert error")
+	}
+
+	var count int64
+	if err := db.Model(&domain.Message{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("%d messages are inserted, want none since a chunk failed", count)
+	}
+}
+
+func TestGetSentMessagesObservesCancellation(t *testing.T) {
+	r, db := newTestRepo(t)
+	seedMessages(t, db, domain.Message{Status: domain.StatusSuccess}, domain.Message{Status: domain.StatusSuccess})
+
+	// the client goes away after the count, while the page is being read
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	if err := db.Callback().Query().Before("gorm:query").Register("test:cancel", func(tx *gorm.DB) {
+		cancel()
+	}); err != nil {
+		t.Fatalf("failed to register callback: %v", err)
+	}
+
+	msgs, _, err := r.GetSentMessages(ctx, 10, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("GetSentMessages() error = %v, want %v", err, context.Canceled)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("GetSentMessages() = %d messages, want none", len(msgs))
+	}
+}
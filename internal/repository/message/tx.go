@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultTxAttempts      = 3
+	defaultTxRetryInterval = 50 * time.Millisecond
+)
+
+// postgres error codes of transactions that can succeed when they are retried
+const (
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+)
+
+// transaction runs fn in a transaction, retrying it if it fails with a serialization failure or a deadlock
+// due to contention with other instances. The transaction is rolled back and no longer retried once the context is done.
+func (r *repo) transaction(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	var err error
+	for attempt := 1; attempt <= r.txAttempts; attempt++ {
+		if err = r.db.WithContext(ctx).Transaction(fn); err == nil || !isRetryableTxError(err) {
+			return err
+		}
+		if attempt < r.txAttempts {
+			select {
+			case <-time.After(time.Duration(attempt) * r.txRetryInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return err
+}
+
+// isRetryableTxError reports whether the error is a serialization failure or a deadlock reported by the database
+func isRetryableTxError(err error) bool {
+	var sqlErr interface{ SQLState() string }
+	if !errors.As(err, &sqlErr) {
+		return false
+	}
+	code := sqlErr.SQLState()
+	return code == sqlStateSerializationFailure || code == sqlStateDeadlockDetected
+}
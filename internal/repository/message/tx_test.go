@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	"gorm.io/gorm"
+)
+
+// sqlStateError is a database error with a postgres error code
+type sqlStateError string
+
+func (e sqlStateError) Error() string {
+	return fmt.Sprintf("database error with sql state %s", string(e))
+}
+
+func (e sqlStateError) SQLState() string {
+	return string(e)
+}
+
+// failUpdates makes the given number of update statements fail with the error once they are executed,
+// so the transaction running them is rolled back. The number of failed statements is returned.
+func failUpdates(t *testing.T, db *gorm.DB, failures int, err error) (failed func() int) {
+	t.Helper()
+
+	count := 0
+	if regErr := db.Callback().Update().After("gorm:update").Register("test:fail_updates", func(tx *gorm.DB) {
+		if count < failures {
+			count++
+			tx.AddError(err)
+		}
+	}); regErr != nil {
+		t.Fatalf("failed to register callback: %v", regErr)
+	}
+	return func() int { return count }
+}
+
+func TestTransactionRetriesTransientFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		err        error
+		wantFailed int
+		wantErr    bool
+	}{
+		{name: "serialization failure", failures: 1, err: sqlStateError(sqlStateSerializationFailure), wantFailed: 1},
+		{name: "deadlock", failures: 2, err: sqlStateError(sqlStateDeadlockDetected), wantFailed: 2},
+		{name: "failures beyond the attempts", failures: 5, err: sqlStateError(sqlStateSerializationFailure), wantFailed: 3, wantErr: true},
+		{name: "unique violation is not retried", failures: 5, err: sqlStateError("23505"), wantFailed: 1, wantErr: true},
+		{name: "other errors are not retried", failures: 5, err: errors.New("connection refused"), wantFailed: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, db := newTestRepo(t, WithTxRetry(3, time.Millisecond))
+			seeded := seedMessages(t, db, domain.Message{Status: domain.StatusPending})
+			failed := failUpdates(t, db, tt.failures, tt.err)
+
+			msgs, err := r.FetchAndLockMessages(t.Context(), 10, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FetchAndLockMessages() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got := failed(); got != tt.wantFailed {
+				t.Errorf("transaction failed %d times, want %d", got, tt.wantFailed)
+			}
+
+			// failed attempts are rolled back, so the message is locked once if the transaction eventually succeeds
+			stored := getMessage(t, db, seeded[0].ID)
+			if tt.wantErr {
+				if stored.Status != domain.StatusPending || stored.Version != seeded[0].Version {
+					t.Errorf("message = %s at version %d, want it pending at version %d", stored.Status, stored.Version, seeded[0].Version)
+				}
+				return
+			}
+			if len(msgs) != 1 || msgs[0].Version != stored.Version {
+				t.Fatalf("locked messages = %v, want the message at version %d", msgs, stored.Version)
+			}
+			if stored.Status != domain.StatusProcessing || stored.Version != seeded[0].Version+1 {
+				t.Errorf("message = %s at version %d, want processing at version %d", stored.Status, stored.Version, seeded[0].Version+1)
+			}
+		})
+	}
+}
+
+func TestTransactionStopsRetryingWhenContextIsDone(t *testing.T) {
+	r, db := newTestRepo(t, WithTxRetry(5, time.Hour))
+	seedMessages(t, db, domain.Message{Status: domain.StatusPending})
+	failUpdates(t, db, 5, sqlStateError(sqlStateSerializationFailure))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := r.FetchAndLockMessages(ctx, 10, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("FetchAndLockMessages() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("FetchAndLockMessages() returned after %s, want it to stop waiting for the retry once the context is done", elapsed)
+	}
+}
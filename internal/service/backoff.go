@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// default retry backoff settings
+const (
+	defaultRetryBaseDelay  = time.Second
+	defaultRetryMaxDelay   = 32 * time.Second
+	defaultRetryMultiplier = 2
+)
+
+// backoff computes capped exponential delays between retries, randomized with full jitter if enabled
+type backoff struct {
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	multiplier int
+	jitter     bool
+	// randN returns a random duration in the half open interval [0,n)
+	randN func(n int64) int64
+}
+
+func newBackoff() backoff {
+	return backoff{
+		baseDelay:  defaultRetryBaseDelay,
+		maxDelay:   defaultRetryMaxDelay,
+		multiplier: defaultRetryMultiplier,
+		jitter:     true,
+		randN:      rand.Int64N,
+	}
+}
+
+func (b backoff) validate() error {
+	if b.baseDelay <= 0 {
+		return errors.New("retry base delay must be positive")
+	}
+	if b.maxDelay <= b.baseDelay {
+		return errors.New("retry max delay must be greater than the base delay")
+	}
+	if b.multiplier < 2 {
+		return errors.New("retry multiplier must be at least 2")
+	}
+	return nil
+}
+
+// delay returns the time to wait before the given retry, the first retry waits for the base delay.
+// With jitter, a random delay up to the backoff delay is returned so retries of concurrent sends are spread out.
+func (b backoff) delay(retry int) time.Duration {
+	d := b.baseDelay
+	for i := 1; i < retry && d < b.maxDelay; i++ {
+		d *= time.Duration(b.multiplier)
+	}
+	d = min(d, b.maxDelay)
+
+	if b.jitter {
+		return time.Duration(b.randN(int64(d)))
+	}
+	return d
+}
+
+// retry calls fn until it succeeds, waiting for the backoff delay between the attempts. False is returned once
+// maxAttempts attempts fail or the context is done. A non-positive maxAttempts retries until the context is done.
+func (b backoff) retry(ctx context.Context, maxAttempts int, fn func(attempt int) bool) bool {
+	for attempt := 1; ; attempt++ {
+		if fn(attempt) {
+			return true
+		}
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			return false
+		}
+
+		timer := time.NewTimer(b.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelayWithoutJitter(t *testing.T) {
+	b := backoff{baseDelay: 100 * time.Millisecond, maxDelay: time.Second, multiplier: 2}
+
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, w := range want {
+		// every call returns the same delay since nothing is randomized
+		for range 3 {
+			if got := b.delay(i + 1); got != w {
+				t.Fatalf("delay(%d) = %s, want %s", i+1, got, w)
+			}
+		}
+	}
+}
+
+func TestBackoffDelayDoesNotOverflow(t *testing.T) {
+	b := backoff{baseDelay: time.Second, maxDelay: time.Minute, multiplier: 10}
+
+	if got := b.delay(1000); got != time.Minute {
+		t.Errorf("delay(1000) = %s, want %s", got, time.Minute)
+	}
+}
+
+func TestBackoffDelayWithJitter(t *testing.T) {
+	b := newBackoff()
+	b.baseDelay = 100 * time.Millisecond
+	b.maxDelay = time.Second
+
+	for retry := 1; retry <= 10; retry++ {
+		upper := min(b.baseDelay<<(retry-1), b.maxDelay)
+		for range 100 {
+			if got := b.delay(retry); got < 0 || got >= upper {
+				t.Fatalf("delay(%d) = %s, want in [0, %s)", retry, got, upper)
+			}
+		}
+	}
+}
+
+func TestBackoffRetryStopsAfterMaxAttempts(t *testing.T) {
+	b := backoff{baseDelay: time.Millisecond, maxDelay: 2 * time.Millisecond, multiplier: 2}
+
+	var attempts []int
+	ok := b.retry(t.Context(), 3, func(attempt int) bool {
+		attempts = append(attempts, attempt)
+		return false
+	})
+	if ok {
+		t.Error("retry() = true, want false")
+	}
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+		t.Errorf("attempts = %v, want [1 2 3]", attempts)
+	}
+}
+
+func TestBackoffRetryStopsOnSuccess(t *testing.T) {
+	b := backoff{baseDelay: time.Millisecond, maxDelay: 2 * time.Millisecond, multiplier: 2}
+
+	calls := 0
+	ok := b.retry(t.Context(), 0, func(attempt int) bool {
+		calls++
+		return attempt == 2
+	})
+	if !ok || calls != 2 {
+		t.Errorf("retry() = %t after %d calls, want true after 2 calls", ok, calls)
+	}
+}
+
+func TestBackoffRetryStopsWhenContextIsDone(t *testing.T) {
+	b := backoff{baseDelay: time.Hour, maxDelay: 2 * time.Hour, multiplier: 2}
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if b.retry(ctx, 0, func(int) bool { return false }) {
+		t.Error("retry() = true, want false")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retry() returned after %s, want it to stop once the context is done", elapsed)
+	}
+}
+
+func TestBackoffValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff backoff
+		wantErr bool
+	}{
+		{"default", newBackoff(), false},
+		{"zero base delay", backoff{maxDelay: time.Second, multiplier: 2}, true},
+		{"max not above base", backoff{baseDelay: time.Second, maxDelay: time.Second, multiplier: 2}, true},
+		{"multiplier below two", backoff{baseDelay: time.Second, maxDelay: time.Minute, multiplier: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.backoff.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,64 +3,289 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
+	"maps"
+	"math"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/aniladanir/auto-messender-service/internal/domain"
+	"github.com/aniladanir/auto-messender-service/internal/metrics"
 	messageRepo "github.com/aniladanir/auto-messender-service/internal/repository/message"
-	"github.com/aniladanir/retry"
 	"github.com/google/uuid"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
+var tracer = otel.Tracer("github.com/aniladanir/auto-messender-service/internal/service")
+
 type MessageSender interface {
 	Start()
-	Stop()
-	GetSentMessages() ([]domain.Message, error)
+	Stop(ctx context.Context) error
+	GetMessage(id int) (*domain.Message, error)
+	GetSentMessages(ctx context.Context, limit, offset int) (*domain.MessagePage, error)
+	GetMessagesByStatus(ctx context.Context, status domain.MessageStatus, limit, offset int) (*domain.MessagePage, error)
+	ExportMessages(status domain.MessageStatus, fn func(domain.Message) error) error
+	GetStatus() Status
+	GetStats() Stats
+	SetInterval(d time.Duration) error
+	SetBatchSize(n int) error
+	TriggerBatch(ctx context.Context) (int, error)
+	GetStatusSummary() (map[string]int64, error)
+	GetCachedMessage(ctx context.Context, msgID string) (*domain.CachedMessage, error)
+	RecordDelivery(providerMsgID string, status domain.DeliveryStatus) error
+	RequeueMessages(status domain.MessageStatus) (int64, error)
+	ResendMessage(id int) (*domain.Message, error)
+	CreateMessage(msg domain.Message) (created *domain.Message, isNew bool, err error)
+	CreateMessages(msgs []domain.Message) ([]CreateResult, error)
+	CreateBroadcast(content string, phoneNumbers []string, scheduledAt *time.Time) (*Broadcast, error)
+	GetBroadcastMessages(broadcastID string, status *domain.MessageStatus, limit, offset int) (*domain.MessagePage, error)
+}
+
+var (
+	ErrBatchTooLarge    = errors.New("batch size exceeds the limit")
+	ErrInvalidMessage   = errors.New("invalid message")
+	ErrBatchInProgress  = errors.New("a batch is already in progress")
+	ErrCircuitOpen      = errors.New("circuit breaker is open")
+	ErrInvalidInterval  = errors.New("invalid send interval")
+	ErrInvalidBatchSize = errors.New("invalid batch size")
+	ErrNotRequeueable   = errors.New("messages in this status can't be requeued")
+
+	errMalformedResponse = errors.New("malformed webhook response")
+	errBatchTimeout      = errors.New("batch timed out")
+	errResponseTooLarge  = errors.New("webhook response exceeds the size limit")
+)
+
+// defaultMaxResponseSize is the default limit of webhook response bodies that are read
+const defaultMaxResponseSize = 1 << 20
+
+// defaults of the webhook connection pool, the per host limit is raised from the transport default of two
+// since all requests go to the same few webhook hosts
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// defaultErrorSnippetSize is the default number of bytes of an error response body that are logged and stored
+const defaultErrorSnippetSize = 512
+
+// cacheTimeout bounds the time spent on a single cache operation done after a batch, e.g. publishing an event
+const cacheTimeout = 2 * time.Second
+
+// dbWriteTimeout bounds the database writes that must complete even if sending is cancelled, e.g. the final statuses
+const dbWriteTimeout = 5 * time.Second
+
+// writeBoundKey is the context key of the context that bounds the detached writes of a scheduler run
+type writeBoundKey struct{}
+
+// defaultCompressMinSize is the default size of request bodies from which on they are compressed
+const defaultCompressMinSize = 1 << 10
+
+// defaultUserAgent identifies the requests of the service to the webhook
+const defaultUserAgent = "auto-messenger/1.0"
+
+// bounds of the send interval that can be set at runtime
+const (
+	minSendInterval = time.Second
+	maxSendInterval = 24 * time.Hour
+)
+
+// CreateResult represents the outcome of creating a single message of a batch
+type CreateResult struct {
+	Index int    `json:"index"`
+	ID    int    `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Broadcast represents the messages created for each recipient of the same content
+type Broadcast struct {
+	BroadcastID string           `json:"broadcast_id"`
+	Messages    []domain.Message `json:"messages"`
+}
+
+// Status represents the current state of the sender service scheduler
+type Status struct {
+	IsRunning    bool   `json:"is_running"`
+	SendInterval string `json:"send_interval"`
+	BatchSize    int    `json:"batch_size"`
+	// IsLeader reports whether this instance schedules batches, always true if leader election is disabled
+	IsLeader bool `json:"is_leader"`
 }
 
 type service struct {
-	messageRepo  messageRepo.Repository
-	webhookURL   string
-	stopChan     chan struct{}
-	isRunning    bool
-	mtx          sync.Mutex
-	retrier      *retry.Retrier
-	httpClient   *http.Client
-	logger       *slog.Logger
-	msgBatchSize int
-	sendInterval time.Duration
-}
-
-func NewMessageSenderService(messageRepo messageRepo.Repository, logger *slog.Logger, webhookURL string, maxRetryOnFail *int, msgBatchSize int, sendInterval time.Duration) (MessageSender, error) {
-	// initialize retrier
-	retrierOpts := make([]retry.Option, 0)
-	if maxRetryOnFail != nil {
-		retrierOpts = append(retrierOpts, retry.WithMaxAttemps(*maxRetryOnFail))
-	}
-	retrier, err := retry.New(retrierOpts...)
-	if err != nil {
-		return nil, fmt.Errorf("encountered error when initializing retrier: %w", err)
-	}
+	messageRepo messageRepo.Repository
+	webhookURL  string
+	stopChan    chan struct{}
+	doneChan    chan struct{}
+	// cancelRun cancels the writes the scheduler of the current run makes after its sends are cancelled
+	cancelRun  context.CancelFunc
+	isRunning  bool
+	ticker     *time.Ticker
+	mtx        sync.Mutex
+	backoff    backoff
+	httpClient *http.Client
+	logger     *slog.Logger
+	// msgBatchSize is read by each batch without locking mtx since Stop holds it while the last batch drains
+	msgBatchSize        atomic.Int64
+	sendInterval        time.Duration
+	maxRetry            int
+	staleTimeout        time.Duration
+	successCodes        []int
+	drainTimeout        time.Duration
+	maxConcurrency      int
+	signingSecret       string
+	webhookHeaders      map[string]string
+	userAgent           string
+	fallbackURLs        []string
+	breaker             *gobreaker.TwoStepCircuitBreaker
+	limiter             *rate.Limiter
+	payloadTemplateText string
+	payloadTemplate     *template.Template
+	maxCreateBatch      int
+	maxResponseSize     int64
+	maxRedirects        int
+	compressPayload     bool
+	compressMinSize     int
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	leader              LeaderElector
+	dedupeWindow        time.Duration
+	messageTimeout      time.Duration
+	batchTimeout        time.Duration
+	dryRun              bool
+	stats               *sendStats
+	onStatusChange      StatusChangeHook
+	publisher           EventPublisher
+	eventChannel        string
+	leaseTTL            time.Duration
+	errorSnippetSize    int
+	defaultRegion       string
+	instanceID          string
+	// batchMtx prevents a manually triggered batch from overlapping with a scheduled one
+	batchMtx sync.Mutex
+}
 
-	return &service{
+// StatusChangeHook is called after the new status of a message is persisted. It's called synchronously once the
+// batch of the message completes, or by the requeue, resend or recovery that changed the status, so it should
+// return quickly.
+type StatusChangeHook func(msg domain.Message, oldStatus, newStatus domain.MessageStatus)
+
+// EventPublisher publishes events to the subscribers of a channel
+type EventPublisher interface {
+	Publish(ctx context.Context, channel, payload string) error
+}
+
+// LeaderElector reports whether this instance is elected to schedule batches among the other instances
+type LeaderElector interface {
+	IsLeader() bool
+}
+
+func NewMessageSenderService(messageRepo messageRepo.Repository, logger *slog.Logger, webhookURL string, maxRetryOnFail *int, msgBatchSize int, sendInterval time.Duration, opts ...Option) (MessageSender, error) {
+	s := &service{
 		messageRepo: messageRepo,
 		webhookURL:  webhookURL,
-		stopChan:    make(chan struct{}),
 		mtx:         sync.Mutex{},
-		retrier:     retrier,
 		logger:      logger,
 		httpClient: &http.Client{
 			Timeout: time.Second * 5,
 		},
-		msgBatchSize: msgBatchSize,
-		sendInterval: sendInterval,
-	}, nil
+		sendInterval:        sendInterval,
+		successCodes:        []int{http.StatusAccepted},
+		maxResponseSize:     defaultMaxResponseSize,
+		compressMinSize:     defaultCompressMinSize,
+		maxIdleConns:        defaultMaxIdleConns,
+		maxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		idleConnTimeout:     defaultIdleConnTimeout,
+		stats:               newSendStats(),
+		errorSnippetSize:    defaultErrorSnippetSize,
+		userAgent:           defaultUserAgent,
+		backoff:             newBackoff(),
+	}
+	s.msgBatchSize.Store(int64(msgBatchSize))
+	for _, o := range opts {
+		o(s)
+	}
+
+	if s.httpClient.Timeout <= 0 {
+		return nil, errors.New("webhook timeout must be positive")
+	}
+	if s.maxResponseSize <= 0 {
+		return nil, errors.New("max response size must be positive")
+	}
+	if s.maxRedirects < 0 {
+		return nil, errors.New("max redirects must not be negative")
+	}
+
+	// keep enough idle connections to reuse them across concurrent sends to the same webhook
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = s.maxIdleConns
+	transport.MaxIdleConnsPerHost = s.maxIdleConnsPerHost
+	transport.IdleConnTimeout = s.idleConnTimeout
+	s.httpClient.Transport = transport
+
+	// don't follow redirects beyond the limit so a misconfigured webhook can't forward messages to another host
+	s.httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > s.maxRedirects {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+
+	// parse payload template
+	if s.payloadTemplateText != "" {
+		tmpl, err := parsePayloadTemplate(s.payloadTemplateText)
+		if err != nil {
+			return nil, err
+		}
+		s.payloadTemplate = tmpl
+	}
+
+	// validate success status codes
+	for _, code := range s.successCodes {
+		if code < http.StatusOK || code >= http.StatusMultipleChoices {
+			return nil, fmt.Errorf("success status code %d is not in the 2xx range", code)
+		}
+	}
+
+	// identify this instance as the owner of the processing leases
+	if s.leaseTTL > 0 {
+		if minTTL := max(MinProcessingLeaseTTL, s.messageTimeout); s.leaseTTL < minTTL {
+			return nil, fmt.Errorf("processing lease ttl must be at least %s, got %s", minTTL, s.leaseTTL)
+		}
+		hostname, _ := os.Hostname()
+		s.instanceID = fmt.Sprintf("%s-%s", hostname, uuid.NewString()[:8])
+	}
+
+	// validate retry backoff
+	if maxRetryOnFail != nil {
+		s.maxRetry = *maxRetryOnFail
+	}
+	if err := s.backoff.validate(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
 // Start initializes sender service scheduler
@@ -68,149 +293,1130 @@ func (s *service) Start() {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	if s.isRunning {
+	// a scheduler that exited after a panic is started again
+	if s.schedulerRunning() {
 		return
 	}
 
-	// run scheduler
+	// create channels for this run so that a stopped scheduler can be started again
+	s.stopChan = make(chan struct{})
+	s.doneChan = make(chan struct{})
+	s.isRunning = true
+
+	// the writes that outlive the cancellation of the sends are bounded by the run, which Stop cancels at its deadline
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	s.cancelRun = cancelRun
+
+	// run scheduler, the ticker is kept so the interval can be changed while running
 	ticker := time.NewTicker(s.sendInterval)
-	go func(t *time.Ticker) {
-		processCtx, processCtxCancel := context.WithCancel(context.Background())
-		defer processCtxCancel()
+	s.ticker = ticker
+	go func(t *time.Ticker, stop <-chan struct{}, done chan<- struct{}) {
+		processCtx, processCtxCancel := context.WithCancel(context.WithValue(runCtx, writeBoundKey{}, runCtx))
+
+		// once stop is requested, give the in-flight batch the drain timeout to finish before cancelling it
+		drainWg := new(sync.WaitGroup)
+		drainWg.Go(func() {
+			select {
+			case <-stop:
+			case <-processCtx.Done():
+				// the scheduler exited without a stop request
+				return
+			}
+			drainTimer := time.NewTimer(s.drainTimeout)
+			defer drainTimer.Stop()
+
+			select {
+			case <-drainTimer.C:
+				processCtxCancel()
+			case <-processCtx.Done():
+			}
+		})
+
+		// release every resource of this run before reporting completion so nothing outlives the scheduler.
+		// A panic is recovered so that Stop doesn't wait for a scheduler that is gone.
+		defer func() {
+			if r := recover(); r != nil {
+				s.logger.Error("scheduler panicked and stopped", "panic", fmt.Sprint(r))
+			}
+			t.Stop()
+			processCtxCancel()
+			cancelRun()
+			drainWg.Wait()
+			close(done)
+		}()
+
+		// reset messages left in processing by a previous run
+		s.recoverStaleMessages(processCtx)
 
 		// initial run
-		s.processBatch(processCtx, s.msgBatchSize)
+		s.runScheduledBatch(processCtx)
 
 		for {
 			select {
 			case <-t.C:
-				s.processBatch(processCtx, s.msgBatchSize)
-			case <-s.stopChan:
-				t.Stop()
-				processCtxCancel()
+				// don't start a new batch if stop was requested while the previous one was draining
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.runScheduledBatch(processCtx)
+			case <-stop:
 				return
 			}
 		}
-	}(ticker)
+	}(ticker, s.stopChan, s.doneChan)
+}
+
+// schedulerRunning reports whether the scheduler goroutine of the current run is alive. mtx must be held.
+func (s *service) schedulerRunning() bool {
+	if !s.isRunning {
+		return false
+	}
+	select {
+	case <-s.doneChan:
+		return false
+	default:
+		return true
+	}
 }
 
-// Stop pauses the sender service scheduler
-func (s *service) Stop() {
+// Stop pauses the sender service scheduler and waits for the scheduler goroutine to exit.
+// An in-flight batch is given the drain timeout to complete before its sends are cancelled. The statuses written
+// after the sends are cancelled are bounded by the deadline of the context, Stop returns once it is done even if
+// the scheduler hasn't exited yet. Stop returns immediately if the scheduler is not running or has already exited,
+// and can be called repeatedly.
+func (s *service) Stop(ctx context.Context) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
 	if !s.isRunning {
-		return
+		return nil
 	}
 
-	s.stopChan <- struct{}{}
+	// stop is only closed once per run since isRunning is reset below, done is already closed if the scheduler exited
+	close(s.stopChan)
+	stopWrites := context.AfterFunc(ctx, s.cancelRun)
+	defer stopWrites()
+
+	var err error
+	select {
+	case <-s.doneChan:
+	case <-ctx.Done():
+		err = fmt.Errorf("scheduler did not stop in time: %w", ctx.Err())
+	}
 	s.isRunning = false
+	s.ticker = nil
+
+	// close kept-alive webhook connections so their goroutines don't linger while stopped
+	s.httpClient.CloseIdleConnections()
+	return err
+}
+
+// GetMessage returns the message with the given id
+func (s *service) GetMessage(id int) (*domain.Message, error) {
+	return s.messageRepo.GetByID(id)
+}
+
+// GetSentMessages returns a page of messages that are successfuly consumed by the external api
+func (s *service) GetSentMessages(ctx context.Context, limit, offset int) (*domain.MessagePage, error) {
+	return s.GetMessagesByStatus(ctx, domain.StatusSuccess, limit, offset)
+}
+
+// GetMessagesByStatus returns a page of messages with the given status
+func (s *service) GetMessagesByStatus(ctx context.Context, status domain.MessageStatus, limit, offset int) (*domain.MessagePage, error) {
+	msgs, total, err := s.messageRepo.GetMessagesByStatus(ctx, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMessagePage(msgs, total, offset), nil
+}
+
+// ExportMessages calls fn for every message with the given status in id order without loading them all at once.
+// Iteration stops at the first error returned by fn.
+func (s *service) ExportMessages(status domain.MessageStatus, fn func(domain.Message) error) error {
+	return s.messageRepo.StreamMessages(status, fn)
+}
+
+// GetBroadcastMessages returns a page of messages of the given broadcast, filtered by status if it is not nil
+func (s *service) GetBroadcastMessages(broadcastID string, status *domain.MessageStatus, limit, offset int) (*domain.MessagePage, error) {
+	msgs, total, err := s.messageRepo.GetMessagesByBroadcast(broadcastID, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMessagePage(msgs, total, offset), nil
+}
+
+func newMessagePage(msgs []domain.Message, total int64, offset int) *domain.MessagePage {
+	page := &domain.MessagePage{
+		Messages: msgs,
+		Total:    total,
+	}
+	if next := offset + len(msgs); int64(next) < total {
+		page.NextOffset = &next
+	}
+	return page
+}
+
+// GetStatusSummary returns the number of messages in each status keyed by the status name
+func (s *service) GetStatusSummary() (map[string]int64, error) {
+	counts, err := s.messageRepo.CountByStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := make(map[string]int64)
+	for _, status := range domain.MessageStatuses() {
+		summary[status.String()] = counts[status]
+	}
+	return summary, nil
+}
+
+// CreateMessage validates the given message and enqueues it as pending.
+// If an idempotency key is given and a message with the same key exists, the existing message is returned instead.
+func (s *service) CreateMessage(msg domain.Message) (created *domain.Message, isNew bool, err error) {
+	if err = msg.Validate(); err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+	phoneNumber, err := domain.NormalizePhoneNumber(msg.PhoneNumber, s.defaultRegion)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	created = &domain.Message{
+		Content:        msg.Content,
+		Template:       msg.Template,
+		Variables:      msg.Variables,
+		PhoneNumber:    phoneNumber,
+		Status:         domain.StatusPending,
+		ScheduledAt:    msg.ScheduledAt,
+		IdempotencyKey: msg.IdempotencyKey,
+	}
+	if isNew, err = s.messageRepo.CreateMessage(created); err != nil {
+		return nil, false, err
+	}
+	return created, isNew, nil
+}
+
+// CreateMessages validates the given messages and enqueues the valid ones as pending in a single transaction.
+// A result is returned for each message in the same order, either with the created id or the validation error.
+func (s *service) CreateMessages(msgs []domain.Message) ([]CreateResult, error) {
+	if s.maxCreateBatch > 0 && len(msgs) > s.maxCreateBatch {
+		return nil, fmt.Errorf("%w: %d > %d", ErrBatchTooLarge, len(msgs), s.maxCreateBatch)
+	}
+
+	results := make([]CreateResult, len(msgs))
+	valid := make([]domain.Message, 0, len(msgs))
+	validIndexes := make([]int, 0, len(msgs))
+	for i, msg := range msgs {
+		results[i].Index = i
+		if err := msg.Validate(); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		phoneNumber, err := domain.NormalizePhoneNumber(msg.PhoneNumber, s.defaultRegion)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		valid = append(valid, domain.Message{
+			Content:     msg.Content,
+			Template:    msg.Template,
+			Variables:   msg.Variables,
+			PhoneNumber: phoneNumber,
+			Status:      domain.StatusPending,
+			ScheduledAt: msg.ScheduledAt,
+		})
+		validIndexes = append(validIndexes, i)
+	}
+
+	if len(valid) == 0 {
+		return results, nil
+	}
+	if err := s.messageRepo.CreateMessages(valid); err != nil {
+		return nil, err
+	}
+	for i, idx := range validIndexes {
+		results[idx].ID = valid[i].ID
+	}
+
+	return results, nil
+}
+
+// CreateBroadcast enqueues the content for each of the given phone numbers in a single transaction.
+// Duplicate numbers are sent to once. Nothing is created if any of the numbers is invalid.
+func (s *service) CreateBroadcast(content string, phoneNumbers []string, scheduledAt *time.Time) (*Broadcast, error) {
+	if len(phoneNumbers) == 0 {
+		return nil, fmt.Errorf("%w: no phone numbers given", ErrInvalidMessage)
+	}
+	if s.maxCreateBatch > 0 && len(phoneNumbers) > s.maxCreateBatch {
+		return nil, fmt.Errorf("%w: %d > %d", ErrBatchTooLarge, len(phoneNumbers), s.maxCreateBatch)
+	}
+
+	msgs := make([]domain.Message, 0, len(phoneNumbers))
+	seen := make(map[string]struct{}, len(phoneNumbers))
+	for i, number := range phoneNumbers {
+		msg := domain.Message{Content: content, PhoneNumber: number}
+		if err := msg.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: phone number at index %d: %w", ErrInvalidMessage, i, err)
+		}
+		phoneNumber, err := domain.NormalizePhoneNumber(number, s.defaultRegion)
+		if err != nil {
+			return nil, fmt.Errorf("%w: phone number at index %d: %w", ErrInvalidMessage, i, err)
+		}
+		if _, ok := seen[phoneNumber]; ok {
+			continue
+		}
+		seen[phoneNumber] = struct{}{}
+
+		msgs = append(msgs, domain.Message{
+			Content:     content,
+			PhoneNumber: phoneNumber,
+			Status:      domain.StatusPending,
+			ScheduledAt: scheduledAt,
+		})
+	}
+
+	broadcastID := uuid.NewString()
+	if err := s.messageRepo.CreateBroadcast(broadcastID, msgs); err != nil {
+		return nil, err
+	}
+	return &Broadcast{BroadcastID: broadcastID, Messages: msgs}, nil
 }
 
-// GetSentMessages returns messages that are successfuly consumed by the external api
-func (s *service) GetSentMessages() ([]domain.Message, error) {
-	return s.messageRepo.GetSentMessages()
+// RecordDelivery stores the delivery status the provider reported for the message with the given provider message id
+func (s *service) RecordDelivery(providerMsgID string, status domain.DeliveryStatus) error {
+	if providerMsgID == "" {
+		return fmt.Errorf("%w: message id is empty", ErrInvalidMessage)
+	}
+	if err := status.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+	return s.messageRepo.UpdateDeliveryStatus(providerMsgID, status)
 }
 
-func (s *service) processBatch(ctx context.Context, batch int) {
-	msgs, err := s.messageRepo.FetchAndLockMessages(batch)
+// RequeueMessages resets the failed, dead lettered or rejected messages back to pending with their retries zeroed,
+// so they are sent again, e.g. once a webhook outage is resolved. The number of requeued messages is returned.
+func (s *service) RequeueMessages(status domain.MessageStatus) (int64, error) {
+	if status != domain.StatusFailed && status != domain.StatusDeadLetter && status != domain.StatusRejected {
+		return 0, fmt.Errorf("%w: %s", ErrNotRequeueable, status)
+	}
+
+	requeued, err := s.messageRepo.RequeueByStatus(status)
 	if err != nil {
-		log.Printf("Error fetching messages: %v", err)
+		return 0, err
+	}
+	s.logger.Info("messages are requeued", "status", status.String(), "count", len(requeued))
+	s.notifyStatusChanges(requeued, status)
+	return int64(len(requeued)), nil
+}
+
+// ResendMessage resets a single message back to pending so it is sent again in a later batch, whatever its status is.
+// A message that is being processed can't be resent.
+func (s *service) ResendMessage(id int) (*domain.Message, error) {
+	msg, oldStatus, err := s.messageRepo.ResetToPending(id)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("message is queued to be resent", "id", id)
+	s.notifyStatusChange(*msg, oldStatus, domain.StatusPending)
+	return msg, nil
+}
+
+// GetCachedMessage returns cached metadata of a sent message by the message id returned from the webhook
+func (s *service) GetCachedMessage(ctx context.Context, msgID string) (*domain.CachedMessage, error) {
+	return s.messageRepo.GetCachedMessage(ctx, msgID)
+}
+
+// GetStatus returns the scheduler state along with its configured interval and batch size
+func (s *service) GetStatus() Status {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return Status{
+		IsRunning:    s.schedulerRunning(),
+		IsLeader:     s.leader == nil || s.leader.IsLeader(),
+		SendInterval: s.sendInterval.String(),
+		BatchSize:    s.batchSize(),
+	}
+}
+
+// GetStats returns the rolling send statistics of this instance over the last minute and hour
+func (s *service) GetStats() Stats {
+	return s.stats.snapshot()
+}
+
+// SetInterval changes the send interval. A running scheduler processes its next batch after the new interval.
+func (s *service) SetInterval(d time.Duration) error {
+	if d < minSendInterval || d > maxSendInterval {
+		return fmt.Errorf("%w: must be between %s and %s, got %s", ErrInvalidInterval, minSendInterval, maxSendInterval, d)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.sendInterval = d
+	if s.ticker != nil {
+		s.ticker.Reset(d)
+	}
+	s.logger.Info("send interval is changed", "interval", d.String())
+	return nil
+}
+
+// SetBatchSize changes the number of messages fetched in each batch, starting with the next batch
+func (s *service) SetBatchSize(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("%w: must be positive, got %d", ErrInvalidBatchSize, n)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.msgBatchSize.Store(int64(n))
+	s.logger.Info("batch size is changed", "batch", n)
+	return nil
+}
+
+func (s *service) batchSize() int {
+	return int(s.msgBatchSize.Load())
+}
+
+func (s *service) recoverStaleMessages(ctx context.Context) {
+	if s.staleTimeout <= 0 {
 		return
 	}
 
-	if len(msgs) == 0 {
+	recovered, err := s.messageRepo.RecoverStaleMessages(ctx, s.staleTimeout)
+	if err != nil {
+		s.logger.Error("failed to recover stale messages", "error", err.Error())
+		return
+	}
+	if len(recovered) > 0 {
+		s.logger.Info("recovered stale messages", "count", len(recovered))
+	}
+	s.notifyStatusChanges(recovered, domain.StatusProcessing)
+}
+
+// recoverExpiredLeases resets messages whose processing lease is expired, e.g. since the instance processing
+// them crashed, back to pending
+func (s *service) recoverExpiredLeases(ctx context.Context) {
+	if s.leaseTTL <= 0 {
+		return
+	}
+
+	recovered, err := s.messageRepo.RecoverExpiredLeases(ctx, s.leaseTTL)
+	if err != nil {
+		s.logger.Error("failed to recover messages with expired leases", "error", err.Error())
+		return
+	}
+	if len(recovered) > 0 {
+		s.logger.Info("recovered messages with expired leases", "count", len(recovered))
+	}
+	s.notifyStatusChanges(recovered, domain.StatusProcessing)
+}
+
+// runScheduledBatch processes a batch on behalf of the scheduler, waiting for a manually triggered batch to complete first
+func (s *service) runScheduledBatch(ctx context.Context) {
+	// only the leader fetches batches when leader election is enabled
+	if s.leader != nil && !s.leader.IsLeader() {
+		s.logger.Debug("not the leader, skipping batch", "batch", s.batchSize())
 		return
 	}
 
+	s.batchMtx.Lock()
+	defer s.batchMtx.Unlock()
+
+	s.recoverExpiredLeases(ctx)
+	s.processBatch(ctx, s.batchSize())
+}
+
+// TriggerBatch processes a batch immediately, out of the schedule, and returns the number of messages handled.
+// Sends in flight are cancelled and their messages released if the context is cancelled.
+func (s *service) TriggerBatch(ctx context.Context) (int, error) {
+	if !s.batchMtx.TryLock() {
+		return 0, ErrBatchInProgress
+	}
+	defer s.batchMtx.Unlock()
+
+	return s.processBatch(ctx, s.batchSize())
+}
+
+// processBatch fetches a batch of messages and sends them, returning the number of messages handled
+func (s *service) processBatch(ctx context.Context, batch int) (int, error) {
+	// don't lock any messages if the scheduler is already shutting down
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// skip the batch while the webhook is considered down, so messages stay pending
+	if s.breaker != nil && s.breaker.State() == gobreaker.StateOpen {
+		s.logger.Warn("circuit breaker is open, skipping batch", "batch", batch)
+		return 0, ErrCircuitOpen
+	}
+
+	ctx, span := tracer.Start(ctx, "processBatch", trace.WithAttributes(attribute.Int("batch.size", batch)))
+	defer span.End()
+
+	// abandon a stuck batch so the next one can start fresh
+	if s.batchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, s.batchTimeout, errBatchTimeout)
+		defer cancel()
+	}
+
+	msgs, err := s.messageRepo.FetchAndLockMessages(ctx, batch, s.maxRetry)
+	if err != nil {
+		s.logger.Error("failed to fetch messages", "batch", batch, "error", err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to fetch messages")
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int("batch.messages", len(msgs)))
+
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	// record the ownership of the messages so they are recovered once the lease expires if this instance crashes,
+	// the leases are renewed until the sends complete so a batch running longer than the ttl keeps its messages
+	stopRenewal := func() {}
+	if s.leaseTTL > 0 {
+		ids := make([]int, 0, len(msgs))
+		for _, msg := range msgs {
+			ids = append(ids, msg.ID)
+		}
+		s.setLeases(ctx, ids)
+		stopRenewal = s.renewLeases(ctx, ids)
+	}
+
+	// bound the number of concurrent sends, defaults to the batch size
+	concurrency := s.maxConcurrency
+	if concurrency <= 0 {
+		concurrency = len(msgs)
+	}
+	sem := make(chan struct{}, concurrency)
+
 	wg := new(sync.WaitGroup)
-	for _, msg := range msgs {
+	for i := range msgs {
+		sem <- struct{}{}
 		wg.Go(func() {
-			s.sendMessage(ctx, &msg)
+			defer func() { <-sem }()
+			s.sendMessage(ctx, &msgs[i])
 		})
 	}
 	wg.Wait()
+	stopRenewal()
+
+	// persist the statuses even if the batch is cancelled, so released and failed messages aren't left in processing
+	flushCtx, cancel := detachedContext(ctx)
+	defer cancel()
+	s.flushStatuses(flushCtx, msgs)
+
+	if errors.Is(context.Cause(ctx), errBatchTimeout) {
+		// the sends cut off by the timeout are flushed above, messages whose flush failed stay in processing
+		// until they are stale, reset the ones that already are
+		s.logger.Warn("batch timed out", "batch", batch, "timeout", s.batchTimeout.String())
+		span.SetStatus(codes.Error, "batch timed out")
+		s.recoverStaleMessages(flushCtx)
+	}
+
+	return len(msgs), nil
+}
+
+// flushStatuses persists the final statuses the sends set on the messages with a single transaction per status
+func (s *service) flushStatuses(ctx context.Context, msgs []domain.Message) {
+	groups := make(map[domain.MessageStatus][]*domain.Message)
+	for i := range msgs {
+		// messages without a final status are left to stale message recovery
+		if msgs[i].Status == domain.StatusProcessing {
+			s.logger.Warn("message has no final status after sending", "dbMessageId", msgs[i].ID)
+			continue
+		}
+		groups[msgs[i].Status] = append(groups[msgs[i].Status], &msgs[i])
+	}
+
+	for status, group := range groups {
+		updated, err := s.messageRepo.UpdateStatuses(ctx, group, status)
+		if err != nil {
+			// messages changed by another process since they are locked are left to it
+			s.logger.Error("failed to update message statuses", "status", status.String(), "count", len(group)-len(updated), "error", err.Error())
+		}
+		for _, msg := range updated {
+			s.releaseLease(msg.ID)
+			s.notifyStatusChange(*msg, domain.StatusProcessing, status)
+			if status == domain.StatusSuccess {
+				s.publishSentEvent(msg)
+			}
+		}
+	}
+}
+
+// setLeases records this instance as the owner of the messages with the given ids for the lease ttl
+func (s *service) setLeases(ctx context.Context, ids []int) {
+	for _, id := range ids {
+		if err := s.messageRepo.SetLease(ctx, id, s.instanceID, s.leaseTTL); err != nil {
+			s.logger.Warn("failed to set processing lease", "dbMessageId", id, "error", err.Error())
+		}
+	}
+}
+
+// renewLeases sets the leases of the messages again every third of the lease ttl, so a lease survives two failed
+// renewals. The returned function stops the renewal and waits for it to exit.
+func (s *service) renewLeases(ctx context.Context, ids []int) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(s.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.setLeases(ctx, ids)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// detachedContext returns a context that outlives the cancellation of the given context, bounded by the
+// database write timeout. Within a scheduler run it is also cancelled once the deadline of Stop passes.
+func detachedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), dbWriteTimeout)
+	bound, ok := ctx.Value(writeBoundKey{}).(context.Context)
+	if !ok {
+		return writeCtx, cancel
+	}
+	stop := context.AfterFunc(bound, cancel)
+	return writeCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// releaseLease removes the processing lease of a message whose final status is persisted
+func (s *service) releaseLease(msgID int) {
+	if s.leaseTTL <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	if err := s.messageRepo.ReleaseLease(ctx, msgID); err != nil {
+		s.logger.Warn("failed to release processing lease", "dbMessageId", msgID, "error", err.Error())
+	}
+}
+
+// publishSentEvent publishes an event for the sent message if an event channel is configured
+func (s *service) publishSentEvent(msg *domain.Message) {
+	if s.publisher == nil || s.eventChannel == "" {
+		return
+	}
+
+	event := domain.MessageSentEvent{ID: msg.ID, ProviderMessageID: msg.ProviderMessageID, SentAt: time.Now().UTC()}
+	if msg.SentAt != nil {
+		event.SentAt = *msg.SentAt
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		s.logger.Error("failed to encode message sent event", "dbMessageId", msg.ID, "error", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheTimeout)
+	defer cancel()
+	if err := s.publisher.Publish(ctx, s.eventChannel, string(payload)); err != nil {
+		s.logger.Error("failed to publish message sent event", "dbMessageId", msg.ID, "error", err.Error())
+	}
+}
+
+// notifyStatusChange calls the status change hook if one is registered. A panicking hook is recovered
+// so it can't take down the scheduler.
+func (s *service) notifyStatusChange(msg domain.Message, oldStatus, newStatus domain.MessageStatus) {
+	if s.onStatusChange == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("status change hook panicked", "dbMessageId", msg.ID, "panic", fmt.Sprint(r))
+		}
+	}()
+	s.onStatusChange(msg, oldStatus, newStatus)
+}
+
+// notifyStatusChanges calls the status change hook for each of the messages reset from the given status to pending
+func (s *service) notifyStatusChanges(msgs []domain.Message, oldStatus domain.MessageStatus) {
+	for _, msg := range msgs {
+		s.notifyStatusChange(msg, oldStatus, domain.StatusPending)
+	}
 }
 
 func (s *service) sendMessage(ctx context.Context, msg *domain.Message) {
-	// create a logger with message id
-	msgLogger := s.logger.With(slog.Int("dbMessageId", msg.ID))
+	ctx, span := tracer.Start(ctx, "sendMessage", trace.WithAttributes(attribute.Int("message.id", msg.ID)))
+	defer span.End()
 
-	retryFunc := func(attempt int) (terminate bool) {
-		retryLogger := msgLogger.With(slog.Int("attempt", attempt))
+	// every attempt carries the same request id, so the provider can deduplicate retries of a delivered message
+	requestID := uuid.NewString()
 
-		resp, err := s.doMsgRequest(ctx, msg)
+	// create a logger with message id and request id
+	msgLogger := s.logger.With(slog.Int("dbMessageId", msg.ID), slog.String("requestId", requestID))
+
+	// the final status is set on the message by the send path and persisted once the batch completes
+	msg.Status = domain.StatusProcessing
+
+	// bound the time spent on this message, including retries
+	processCtx := ctx
+	if s.messageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.messageTimeout)
+		defer cancel()
+	}
+
+	// validate phone number so malformed numbers never reach the webhook
+	phoneNumber, err := domain.NormalizePhoneNumber(msg.PhoneNumber, s.defaultRegion)
+	if err != nil {
+		msgLogger.Error("message has invalid phone number", "error", err.Error())
+		s.rejectMessage(ctx, msg, err.Error(), msgLogger)
+		return
+	}
+	msg.PhoneNumber = phoneNumber
+
+	// interpolate the template so the rendered content is sent, the stored message keeps its template
+	if msg.Template != "" {
+		content, err := msg.RenderContent()
+		if err != nil {
+			msgLogger.Error("failed to render message template", "error", err.Error())
+			s.rejectMessage(ctx, msg, err.Error(), msgLogger)
+			return
+		}
+		msg.Content = content
+	}
+
+	// log the payload instead of sending it in dry run mode
+	if s.dryRun {
+		s.dryRunMessage(ctx, msg, msgLogger)
+		return
+	}
+
+	// skip messages whose content is already sent to the same number within the dedupe window
+	if s.dedupeWindow > 0 {
+		sent, err := s.messageRepo.IsRecentlySent(ctx, msg)
 		if err != nil {
-			retryLogger.Error("failed to send request", "error", err.Error())
-			return false
+			msgLogger.Warn("failed to check whether message is recently sent", "error", err.Error())
+		} else if sent {
+			// the message itself isn't sent, so it's rejected with the reason instead of getting a sent time and event
+			msgLogger.Info("same message is recently sent to the phone number, skipping")
+			s.rejectMessage(ctx, msg, fmt.Sprintf("same message is already sent to the phone number within %s", s.dedupeWindow), msgLogger)
+			return
 		}
-		defer resp.Body.Close()
+	}
+
+	attempted := false
+	retryFunc := func(attempt int) (terminate bool) {
+		for {
+			// don't start a new attempt once sending is cancelled
+			if ctx.Err() != nil {
+				return false
+			}
+			attempted = true
 
-		if resp.StatusCode == http.StatusAccepted {
-			// request was successful
-			if err := s.messageRepo.UpdateStatus(msg, domain.StatusSuccess); err != nil {
-				retryLogger.Error("failed to update message status to success", "error", err.Error())
+			retryLogger := msgLogger.With(slog.Int("attempt", attempt))
+
+			terminate, retryAfter := s.attemptSend(ctx, msg, requestID, retryLogger)
+			if terminate || retryAfter <= 0 {
+				return terminate
 			}
-			retryLogger.Info("message is successfuly sent", "requestId", resp.Header.Get("X-Request-ID"))
 
-			// save response
-			if err = s.saveResponse(ctx, resp.Body); err != nil {
-				retryLogger.Error("failed to save message response", "error", err.Error())
+			// a delay longer than the backoff allows would hold the batch, leave the message for a later batch instead
+			if retryAfter > s.backoff.maxDelay {
+				retryLogger.Warn("provider requested a delay longer than the max retry delay, leaving message for a later batch",
+					"retryAfter", retryAfter.String(), "maxDelay", s.backoff.maxDelay.String())
+				s.releaseMessage(msg)
+				return true
 			}
-		} else if resp.StatusCode >= http.StatusInternalServerError {
-			// 5XX status code indicates server error, try retry
-			retryLogger.Error("response indicates error",
-				"requestId", resp.Header.Get("X-Request-ID"),
-				"statusCode", resp.StatusCode)
-			return false
-		} else if resp.StatusCode >= http.StatusBadRequest {
-			// 4XX indicates client error, no need to retry
-			retryLogger.Error("response indicates error",
-				"requestId", resp.Header.Get("X-Request-ID"),
-				"statusCode", resp.StatusCode)
-			if err = s.messageRepo.UpdateStatus(msg, domain.StatusFailed); err != nil {
-				retryLogger.Error("failed to update message status to failed", "error", err.Error())
+
+			// provider asked us to wait, so honor its delay instead of the backoff delay
+			retryLogger.Info("waiting before next attempt as requested by provider", "retryAfter", retryAfter.String())
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(retryAfter):
 			}
+			attempt++
 		}
-
-		return true
 	}
 
-	retrySuccess := <-s.retrier.Retry(ctx, retryFunc, true)
+	retrySuccess := s.backoff.retry(ctx, s.maxRetry, retryFunc)
 
 	if !retrySuccess {
-		// retrying failed
-		if err := s.messageRepo.UpdateStatus(msg, domain.StatusFailed); err != nil {
-			msgLogger.Error("failed to update message status to failed", "error", err.Error())
+		if errors.Is(context.Cause(processCtx), errBatchTimeout) && attempted {
+			// the batch timed out while sending, count it as a failed attempt so a message that stalls every batch
+			// can't be retried forever
+			msgLogger.Warn("message sending is cancelled by the batch timeout", "timeout", s.batchTimeout.String())
+			writeCtx, cancel := detachedContext(ctx)
+			defer cancel()
+			if !s.recordFailedAttempt(writeCtx, msg, fmt.Sprintf("batch timed out after %s", s.batchTimeout), msgLogger) {
+				msg.Status = domain.StatusFailed
+			}
+			return
+		}
+		if processCtx.Err() != nil {
+			// sending is interrupted by shutdown or by the batch timeout before it is attempted,
+			// release the message so it's picked up again
+			msgLogger.Warn("message sending is cancelled", "error", context.Cause(processCtx).Error())
+			s.releaseMessage(msg)
+			return
+		}
+		if ctx.Err() != nil {
+			// message timeout is exceeded, count it as a failed attempt so a slow message can't be retried forever
+			msgLogger.Warn("message sending timed out", "timeout", s.messageTimeout.String())
+			writeCtx, cancel := detachedContext(ctx)
+			defer cancel()
+			if !s.recordFailedAttempt(writeCtx, msg, fmt.Sprintf("sending timed out after %s", s.messageTimeout), msgLogger) {
+				msg.Status = domain.StatusFailed
+			}
+			return
 		}
 
+		// retries are exhausted
+		s.deadLetterMessage(msg, msgLogger)
+	}
+}
+
+// dryRunMessage logs the payload that would be sent and marks the message as sent without a webhook request
+func (s *service) dryRunMessage(ctx context.Context, msg *domain.Message, logger *slog.Logger) {
+	payload, err := renderPayload(s.payloadTemplate, msg)
+	if err != nil {
+		logger.Error("failed to render message payload", "error", err.Error())
+		s.rejectMessage(ctx, msg, err.Error(), logger)
+		return
 	}
+
+	logger.Info("dry run, message is not sent", "webhook", s.webhookURL, "payload", string(payload))
+	metrics.MessagesDryRun.Inc()
+	msg.Status = domain.StatusSuccess
 }
 
-func (s *service) doMsgRequest(ctx context.Context, msg *domain.Message) (*http.Response, error) {
-	payload := map[string]string{
-		"to":      msg.PhoneNumber,
-		"content": msg.Content,
+// attemptSend sends the message once and reports whether retrying should terminate.
+// A positive retryAfter indicates the provider requested a specific delay before the next attempt.
+func (s *service) attemptSend(ctx context.Context, msg *domain.Message, requestID string, logger *slog.Logger) (terminate bool, retryAfter time.Duration) {
+	// wait for the outbound rate limit, only fails if sending is cancelled meanwhile
+	if s.limiter != nil {
+		if err := s.limiter.Wait(ctx); err != nil {
+			return false, 0
+		}
 	}
-	jsonPayload, _ := json.Marshal(payload)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.webhookURL, bytes.NewBuffer(jsonPayload))
+	var breakerDone func(success bool)
+	if s.breaker != nil {
+		done, err := s.breaker.Allow()
+		if err != nil {
+			// webhook is considered down, leave the message pending until the breaker closes
+			logger.Warn("circuit breaker rejected the request", "error", err.Error())
+			s.releaseMessage(msg)
+			return true, 0
+		}
+		breakerDone = done
+	}
+
+	requestStart := time.Now()
+	resp, webhookURL, err := s.doMsgRequest(ctx, msg, requestID)
+	requestLatency := time.Since(requestStart)
+	metrics.WebhookRequestDuration.Observe(requestLatency.Seconds())
+	s.stats.recordRequest(requestLatency)
+	if breakerDone != nil {
+		// cancellation is not a webhook failure, client errors indicate the webhook is up
+		breakerDone(ctx.Err() != nil || (err == nil && resp.StatusCode < http.StatusInternalServerError))
+	}
+	logger = logger.With(slog.String("webhook", webhookURL))
+	if err != nil {
+		if ctx.Err() != nil {
+			// request is aborted by cancellation, which is not a webhook failure
+			return false, 0
+		}
+		logger.Error("failed to send request", "error", err.Error())
+		return s.recordFailedAttempt(ctx, msg, err.Error(), logger), 0
+	}
+	defer s.closeBody(resp.Body)
+
+	// keep the start of error responses since providers usually explain the error in the body
+	var snippet string
+	success := slices.Contains(s.successCodes, resp.StatusCode)
+	if !success {
+		snippet = s.readBodySnippet(resp.Body)
+	}
+
+	if success {
+		// request was successful
+		metrics.MessagesSent.Inc()
+		s.stats.recordSent()
+		msg.Status = domain.StatusSuccess
+		sentAt := time.Now().UTC()
+		msg.SentAt = &sentAt
+		logger.Info("message is successfuly sent")
+
+		if s.dedupeWindow > 0 {
+			if err := s.messageRepo.MarkRecentlySent(ctx, msg, s.dedupeWindow); err != nil {
+				logger.Error("failed to mark message as recently sent", "error", err.Error())
+			}
+		}
+
+		// save response, the message is delivered so its provider id is stored even if sending is cancelled meanwhile
+		saveCtx, cancel := detachedContext(ctx)
+		defer cancel()
+		if err = s.saveResponse(saveCtx, msg, resp.Body); errors.Is(err, errMalformedResponse) || errors.Is(err, errResponseTooLarge) {
+			logger.Warn("message is sent but webhook response is malformed", "error", err.Error())
+		} else if err != nil && ctx.Err() != nil {
+			// the response body can't be read once sending is cancelled by shutdown or a timeout
+			logger.Debug("message response is not saved since sending is cancelled", "error", err.Error())
+		} else if err != nil {
+			logger.Error("failed to save message response", "error", err.Error())
+		}
+	} else if resp.StatusCode >= http.StatusInternalServerError {
+		// 5XX status code indicates server error, try retry
+		logger.Error("response indicates error",
+			"statusCode", resp.StatusCode,
+			"body", snippet)
+		return s.recordFailedAttempt(ctx, msg, responseError(resp, snippet), logger), 0
+	} else if resp.StatusCode == http.StatusTooManyRequests {
+		// 429 indicates rate limiting, try retry after the delay requested by the provider
+		logger.Error("response indicates rate limiting",
+			"statusCode", resp.StatusCode,
+			"body", snippet)
+		if s.recordFailedAttempt(ctx, msg, responseError(resp, snippet), logger) {
+			return true, 0
+		}
+		return false, parseRetryAfter(resp.Header.Get("Retry-After"))
+	} else if resp.StatusCode >= http.StatusBadRequest {
+		// 4XX indicates client error, no need to retry
+		logger.Error("response indicates error",
+			"statusCode", resp.StatusCode,
+			"body", snippet)
+		s.rejectMessage(ctx, msg, responseError(resp, snippet), logger)
+	} else {
+		// any other status code is unexpected, the message may or may not be delivered so don't retry
+		logger.Error("response has unexpected status code",
+			"statusCode", resp.StatusCode,
+			"location", resp.Header.Get("Location"),
+			"body", snippet)
+		if err := s.messageRepo.SetLastError(ctx, msg, responseError(resp, snippet)); err != nil {
+			logger.Error("failed to store message error", "error", err.Error())
+		}
+		metrics.MessagesFailed.Inc()
+		s.stats.recordFailed()
+		msg.Status = domain.StatusRejected
+	}
+
+	return true, 0
+}
+
+// closeBody drains what is left of the response body before closing it, since the connection can't be reused
+// for another request unless the body is read to the end. Bodies larger than the max response size are not
+// drained, closing the connection is cheaper than reading them.
+func (s *service) closeBody(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, s.maxResponseSize))
+	body.Close()
+}
+
+// responseError describes an unsuccessful webhook response to be stored on the message
+func responseError(resp *http.Response, snippet string) string {
+	if snippet == "" {
+		return fmt.Sprintf("webhook responded with status %d", resp.StatusCode)
+	}
+	return fmt.Sprintf("webhook responded with status %d: %s", resp.StatusCode, snippet)
+}
+
+// readBodySnippet reads the start of the response body up to the error snippet size
+func (s *service) readBodySnippet(body io.Reader) string {
+	data, _ := io.ReadAll(io.LimitReader(body, int64(s.errorSnippetSize)+1))
+
+	truncated := len(data) > s.errorSnippetSize
+	if truncated {
+		data = data[:s.errorSnippetSize]
+	}
+	snippet := strings.ToValidUTF8(strings.TrimSpace(string(data)), "")
+	if truncated {
+		snippet += "..."
+	}
+	return snippet
+}
+
+// releaseMessage sets the message back to pending so it is fetched again in a later batch
+func (s *service) releaseMessage(msg *domain.Message) {
+	msg.Status = domain.StatusPending
+}
+
+// rejectMessage records a failed attempt and marks the message as rejected for errors that retrying can't fix.
+// Rejected messages are never fetched again unless they are requeued.
+func (s *service) rejectMessage(ctx context.Context, msg *domain.Message, reason string, logger *slog.Logger) {
+	if err := s.messageRepo.RecordFailure(ctx, msg, reason); err != nil {
+		logger.Error("failed to record message failure", "error", err.Error())
+	}
+	metrics.MessagesFailed.Inc()
+	s.stats.recordFailed()
+	msg.Status = domain.StatusRejected
+}
+
+// recordFailedAttempt persists a failed send attempt along with its reason and reports whether the message has run
+// out of retries. Exhausted messages are dead lettered so they are no longer fetched.
+func (s *service) recordFailedAttempt(ctx context.Context, msg *domain.Message, reason string, logger *slog.Logger) (exhausted bool) {
+	if err := s.messageRepo.RecordFailure(ctx, msg, reason); err != nil {
+		logger.Error("failed to record message failure", "error", err.Error())
+	}
+
+	if s.maxRetry <= 0 || msg.RetryCount < s.maxRetry {
+		metrics.MessagesRetried.Inc()
+		return false
+	}
+
+	s.deadLetterMessage(msg, logger)
+	return true
+}
+
+// deadLetterMessage marks the message as dead letter after its retries are exhausted due to transient errors
+func (s *service) deadLetterMessage(msg *domain.Message, logger *slog.Logger) {
+	logger.Error("message retries are exhausted, moving it to dead letter")
+	metrics.MessagesDeadLettered.Inc()
+	s.stats.recordFailed()
+	msg.Status = domain.StatusDeadLetter
+}
+
+// doMsgRequest sends the message to the webhook. Fallback webhooks are tried in order if a webhook
+// is unreachable or responds with a server error. Every request carries the given request id.
+// The url of the webhook that responded last is returned.
+func (s *service) doMsgRequest(ctx context.Context, msg *domain.Message, requestID string) (*http.Response, string, error) {
+	jsonPayload, err := renderPayload(s.payloadTemplate, msg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	webhookURLs := append([]string{s.webhookURL}, s.fallbackURLs...)
+	for i, webhookURL := range webhookURLs {
+		resp, err := s.doWebhookRequest(ctx, webhookURL, jsonPayload, requestID)
+		if i == len(webhookURLs)-1 || ctx.Err() != nil {
+			return resp, webhookURL, err
+		}
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, webhookURL, nil
+		}
+
+		// try the next webhook
+		if err == nil {
+			s.logger.Warn("webhook responded with server error, trying next webhook",
+				"webhook", webhookURL, "statusCode", resp.StatusCode)
+			s.closeBody(resp.Body)
+		} else {
+			s.logger.Warn("webhook request failed, trying next webhook",
+				"webhook", webhookURL, "error", err.Error())
+		}
+	}
+
+	return nil, "", errors.New("no webhook url is configured")
+}
+
+func (s *service) doWebhookRequest(ctx context.Context, webhookURL string, jsonPayload []byte, requestID string) (*http.Response, error) {
+	ctx, span := tracer.Start(ctx, "webhookRequest", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	// compress large payloads, the signature below is still computed over the uncompressed payload
+	body := jsonPayload
+	compressed := s.compressPayload && len(jsonPayload) >= s.compressMinSize
+	if compressed {
+		var err error
+		if body, err = gzipPayload(jsonPayload); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("X-Request-ID", uuid.NewString())
+	// apply configured headers first so reserved headers below take precedence
+	for _, key := range slices.Sorted(maps.Keys(s.webhookHeaders)) {
+		req.Header.Set(key, s.webhookHeaders[key])
+	}
+	req.Header.Set("User-Agent", s.userAgent)
+	req.Header.Set("X-Request-ID", requestID)
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	// sign the payload so the webhook can verify the request originates from this service
+	if s.signingSecret != "" {
+		mac := hmac.New(sha256.New, []byte(s.signingSecret))
+		mac.Write(jsonPayload)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
 
-	return s.httpClient.Do(req)
+	// propagate the trace context to the webhook
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	span.SetAttributes(
+		attribute.String("http.request_id", requestID),
+		attribute.String("url.full", webhookURL),
+	)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "webhook request failed")
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, nil
 }
 
-func (s *service) saveResponse(ctx context.Context, body io.ReadCloser) error {
+// saveResponse stores the message id returned by the webhook on the message and caches it.
+// An empty body is treated as a response without a message id. Bodies larger than the max response size are not decoded.
+func (s *service) saveResponse(ctx context.Context, msg *domain.Message, body io.ReadCloser) error {
+	data, err := io.ReadAll(io.LimitReader(body, s.maxResponseSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > s.maxResponseSize {
+		return fmt.Errorf("%w of %d bytes", errResponseTooLarge, s.maxResponseSize)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
 	var result domain.WebhookResponse
-	if err := json.NewDecoder(body).Decode(&result); err != nil {
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("%w: %w", errMalformedResponse, err)
+	} else if result.MessageID == "" {
+		return nil
+	}
+
+	if err := s.messageRepo.SetProviderMessageID(ctx, msg, result.MessageID); err != nil {
 		return err
-	} else if result.MessageID != "" {
-		if err = s.messageRepo.CacheMessage(ctx, result.MessageID, time.Now().UTC()); err != nil {
-			return err
-		}
 	}
-	return nil
+	return s.messageRepo.CacheMessage(ctx, result.MessageID, time.Now().UTC())
+}
+
+// parseRetryAfter parses the Retry-After header value which is either delay seconds or an http date.
+// Zero is returned if the value is empty or malformed, delays too long for a duration are clamped.
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(val); err == nil {
+		return time.Duration(min(max(seconds, 0), math.MaxInt64/int(time.Second))) * time.Second
+	}
+	if date, err := http.ParseTime(val); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
 }
@@ -0,0 +1,2809 @@
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aniladanir/auto-messender-service/internal/cache/memory"
+	redisCache "github.com/aniladanir/auto-messender-service/internal/cache/redis"
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+	"github.com/aniladanir/auto-messender-service/internal/persistant"
+	"github.com/aniladanir/auto-messender-service/internal/persistant/sqlite"
+	messageRepo "github.com/aniladanir/auto-messender-service/internal/repository/message"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/goleak"
+	"gorm.io/gorm"
+)
+
+// newTestService creates a sender on a private in-memory sqlite database that sends to a test server
+// serving the given webhook handler. Only the initial batch runs when the sender is started.
+func newTestService(t *testing.T, webhook http.HandlerFunc, opts ...Option) (*service, *gorm.DB) {
+	t.Helper()
+
+	db, err := sqlite.Initialize("file::memory:", []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { persistant.Close(db) })
+
+	srv := httptest.NewServer(webhook)
+	t.Cleanup(srv.Close)
+
+	return newTestSender(t, db, srv.URL, opts...), db
+}
+
+// newTestSender creates a sender with a retry limit of 3 on the given database, as an instance of the service
+// would be created on start
+func newTestSender(t *testing.T, db *gorm.DB, webhookURL string, opts ...Option) *service {
+	t.Helper()
+
+	repo := messageRepo.NewMessageRepository(db, memory.NewMemoryCache(t.Context()))
+	maxRetry := 3
+	s, err := NewMessageSenderService(repo, slog.New(slog.DiscardHandler), webhookURL, &maxRetry, 10, time.Hour, opts...)
+	if err != nil {
+		t.Fatalf("NewMessageSenderService() error = %v", err)
+	}
+	return s.(*service)
+}
+
+// withFastRetries retries without jitter after a millisecond so retries don't slow the tests down
+func withFastRetries() Option {
+	return func(s *service) {
+		s.backoff.baseDelay = time.Millisecond
+		s.backoff.maxDelay = 2 * time.Millisecond
+		s.backoff.jitter = false
+	}
+}
+
+// seedMessage inserts a pending message as it is, without validation
+func seedMessage(t *testing.T, db *gorm.DB) domain.Message {
+	t.Helper()
+
+	msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusPending}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+	return msg
+}
+
+func getMessage(t *testing.T, db *gorm.DB, id int) domain.Message {
+	t.Helper()
+
+	var msg domain.Message
+	if err := db.First(&msg, id).Error; err != nil {
+		t.Fatalf("failed to read message %d: %v", id, err)
+	}
+	return msg
+}
+
+// stopWithin fails the test if Stop doesn't return within the given duration
+func stopWithin(t *testing.T, s *service, d time.Duration) {
+	t.Helper()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := s.Stop(context.Background()); err != nil {
+			t.Errorf("Stop() error = %v", err)
+		}
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(d):
+		t.Fatalf("Stop() did not return within %s", d)
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	s, _ := newTestService(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	s.Start()
+	if !s.GetStatus().IsRunning {
+		t.Fatal("service is not running after Start()")
+	}
+	stopWithin(t, s, time.Second)
+	if s.GetStatus().IsRunning {
+		t.Fatal("service is running after Stop()")
+	}
+}
+
+func TestStartAfterStop(t *testing.T) {
+	s, _ := newTestService(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	s.Start()
+	stopWithin(t, s, time.Second)
+
+	s.Start()
+	if !s.GetStatus().IsRunning {
+		t.Fatal("service is not running after it is started again")
+	}
+	stopWithin(t, s, time.Second)
+}
+
+func TestDoubleStart(t *testing.T) {
+	s, _ := newTestService(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	s.Start()
+	s.Start()
+	if !s.GetStatus().IsRunning {
+		t.Fatal("service is not running after Start()")
+	}
+	stopWithin(t, s, time.Second)
+	if s.GetStatus().IsRunning {
+		t.Fatal("service is running after Stop()")
+	}
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	s, _ := newTestService(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	stopWithin(t, s, time.Second)
+	stopWithin(t, s, time.Second)
+}
+
+// panickingRepo panics on fetching messages, as a bug in the batch processing would
+type panickingRepo struct {
+	messageRepo.Repository
+}
+
+func (panickingRepo) FetchAndLockMessages(ctx context.Context, limit int, maxRetry int) ([]domain.Message, error) {
+	panic("fetch failed")
+}
+
+func TestStopAfterSchedulerExited(t *testing.T) {
+	s, _ := newTestService(t, func(w http.ResponseWriter, r *http.Request) {})
+	s.messageRepo = panickingRepo{Repository: s.messageRepo}
+
+	// the initial batch panics, so the scheduler exits on its own
+	s.Start()
+	s.mtx.Lock()
+	done := s.doneChan
+	s.mtx.Unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("scheduler did not exit after the panic")
+	}
+
+	stopWithin(t, s, time.Second)
+	if s.GetStatus().IsRunning {
+		t.Error("service is running after Stop()")
+	}
+	stopWithin(t, s, time.Second)
+}
+
+func TestRejectedMessageIsSentOnce(t *testing.T) {
+	var hits atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	msg := seedMessage(t, db)
+
+	// the rejected message must not be fetched by the later batches
+	for range 3 {
+		if _, err := s.TriggerBatch(t.Context()); err != nil {
+			t.Fatalf("TriggerBatch() error = %v", err)
+		}
+	}
+
+	if got := hits.Load(); got != 1 {
+		t.Errorf("webhook is hit %d times, want 1", got)
+	}
+	got := getMessage(t, db, msg.ID)
+	if got.Status != domain.StatusRejected {
+		t.Errorf("status = %s, want rejected", got.Status)
+	}
+	if got.RetryCount != 1 {
+		t.Errorf("retry count = %d, want 1", got.RetryCount)
+	}
+}
+
+func TestRequeueRejectedMessages(t *testing.T) {
+	var hits atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	msg := seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+	requeued, err := s.RequeueMessages(domain.StatusRejected)
+	if err != nil {
+		t.Fatalf("RequeueMessages() error = %v", err)
+	}
+	if requeued != 1 {
+		t.Fatalf("requeued %d messages, want 1", requeued)
+	}
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("status = %s, want success", got)
+	}
+}
+
+func TestBatchTimeoutCountsAsFailedAttempt(t *testing.T) {
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		// hang until the send is cancelled, the body is read so the server notices the client going away
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}, WithBatchTimeout(50*time.Millisecond))
+	msg := seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	got := getMessage(t, db, msg.ID)
+	if got.Status != domain.StatusFailed {
+		t.Errorf("status = %s, want failed", got.Status)
+	}
+	if got.RetryCount != 1 {
+		t.Errorf("retry count = %d, want 1", got.RetryCount)
+	}
+	if got.LastError == nil || !strings.Contains(*got.LastError, "batch timed out") {
+		t.Errorf("last error = %v, want batch timeout", got.LastError)
+	}
+}
+
+func TestCancelledBatchReleasesMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		// cancel the batch like a shutdown while the request is in flight
+		cancel()
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	})
+	msg := seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(ctx); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	got := getMessage(t, db, msg.ID)
+	if got.Status != domain.StatusPending {
+		t.Errorf("status = %s, want pending", got.Status)
+	}
+	if got.RetryCount != 0 {
+		t.Errorf("retry count = %d, want 0 since a cancelled send isn't a failed attempt", got.RetryCount)
+	}
+}
+
+func TestLeasesAreRenewedWhileSending(t *testing.T) {
+	const leaseTTL = 60 * time.Millisecond
+
+	started, proceed := make(chan struct{}), make(chan struct{})
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-proceed
+		w.WriteHeader(http.StatusAccepted)
+	}, WithProcessingLease(MinProcessingLeaseTTL))
+	// shorter than allowed so the test doesn't wait for the renewals
+	s.leaseTTL = leaseTTL
+	msg := seedMessage(t, db)
+
+	batchDone := make(chan error)
+	go func() {
+		_, err := s.TriggerBatch(t.Context())
+		batchDone <- err
+	}()
+
+	// another instance looks for expired leases while the send outlives the initial lease
+	<-started
+	time.Sleep(3 * leaseTTL)
+	recovered, err := s.messageRepo.RecoverExpiredLeases(t.Context(), 0)
+	if err != nil {
+		t.Fatalf("RecoverExpiredLeases() error = %v", err)
+	}
+	if len(recovered) != 0 {
+		t.Errorf("recovered %d messages whose lease is renewed, want none", len(recovered))
+	}
+
+	close(proceed)
+	if err := <-batchDone; err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("status = %s, want success", got)
+	}
+}
+
+func TestExpiredLeasesAreRecoveredByScheduledBatch(t *testing.T) {
+	const leaseTTL = time.Minute
+
+	var sent atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		sent.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}, WithProcessingLease(leaseTTL))
+
+	// messages left in processing by crashed instances, one of which is still owned by a running instance
+	locked := time.Now().UTC().Add(-time.Hour)
+	crashed := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusProcessing, UpdatedAt: &locked}
+	owned := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusProcessing, UpdatedAt: &locked}
+	for _, msg := range []*domain.Message{&crashed, &owned} {
+		if err := db.Create(msg).Error; err != nil {
+			t.Fatalf("failed to seed message: %v", err)
+		}
+	}
+	if err := s.messageRepo.SetLease(t.Context(), owned.ID, "other-instance", leaseTTL); err != nil {
+		t.Fatalf("SetLease() error = %v", err)
+	}
+
+	s.runScheduledBatch(t.Context())
+
+	// the message whose lease is expired is sent by the same batch
+	if got := getMessage(t, db, crashed.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("status of the message with an expired lease = %s, want %s", got, domain.StatusSuccess)
+	}
+	if got := getMessage(t, db, owned.ID).Status; got != domain.StatusProcessing {
+		t.Errorf("status of the message with a lease = %s, want %s", got, domain.StatusProcessing)
+	}
+	if sent.Load() != 1 {
+		t.Errorf("sent %d messages, want 1", sent.Load())
+	}
+}
+
+func TestLeasesAreReleasedAfterSending(t *testing.T) {
+	started, proceed := make(chan struct{}), make(chan struct{})
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-proceed
+		w.WriteHeader(http.StatusAccepted)
+	}, WithProcessingLease(time.Minute))
+	msg := seedMessage(t, db)
+
+	batchDone := make(chan error)
+	go func() {
+		_, err := s.TriggerBatch(t.Context())
+		batchDone <- err
+	}()
+
+	// the message is leased while it is sent, so it isn't recovered even if its lock is old enough
+	<-started
+	if recovered, err := s.messageRepo.RecoverExpiredLeases(t.Context(), 0); err != nil || len(recovered) != 0 {
+		t.Errorf("RecoverExpiredLeases() while sending = %d messages, %v, want 0, nil", len(recovered), err)
+	}
+	close(proceed)
+	if err := <-batchDone; err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	// a message left in processing afterwards has no lease anymore
+	if err := db.Model(&domain.Message{}).Where("id = ?", msg.ID).Update("status", domain.StatusProcessing).Error; err != nil {
+		t.Fatalf("failed to update message: %v", err)
+	}
+	if recovered, err := s.messageRepo.RecoverExpiredLeases(t.Context(), 0); err != nil || len(recovered) != 1 {
+		t.Errorf("RecoverExpiredLeases() after sending = %d messages, %v, want 1, nil", len(recovered), err)
+	}
+}
+
+func TestRetriesContinueFromPersistedCount(t *testing.T) {
+	var hits atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}, withFastRetries())
+
+	// a previous run of the service used two of the three retries before it is restarted
+	msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusFailed, RetryCount: 2}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	if got := hits.Load(); got != 1 {
+		t.Errorf("webhook is hit %d times, want 1", got)
+	}
+	got := getMessage(t, db, msg.ID)
+	if got.RetryCount != 3 {
+		t.Errorf("retry count = %d, want 3", got.RetryCount)
+	}
+	if got.Status != domain.StatusDeadLetter {
+		t.Errorf("status = %s, want dead_letter", got.Status)
+	}
+}
+
+func TestStartRecoversStaleMessages(t *testing.T) {
+	sent := make(chan struct{}, 1)
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		sent <- struct{}{}
+	}, WithStaleMessageTimeout(10*time.Minute), WithDrainTimeout(time.Second))
+
+	// a crashed run left the message in processing
+	stale := time.Now().UTC().Add(-time.Hour)
+	msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusProcessing, UpdatedAt: &stale}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+
+	s.Start()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("stale message is not sent by the initial batch")
+	}
+	stopWithin(t, s, time.Second)
+
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("status = %s, want success", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		val  string
+		min  time.Duration
+		max  time.Duration
+	}{
+		{name: "empty", val: "", min: 0, max: 0},
+		{name: "seconds", val: "3", min: 3 * time.Second, max: 3 * time.Second},
+		{name: "negative seconds", val: "-1", min: 0, max: 0},
+		{name: "http date", val: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), min: 8 * time.Second, max: 10 * time.Second},
+		{name: "past http date", val: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), min: 0, max: 0},
+		{name: "malformed", val: "soon", min: 0, max: 0},
+		{name: "too long", val: "99999999999999", min: math.MaxInt64 / time.Second * time.Second, max: math.MaxInt64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.val); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", tt.val, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRateLimitedSendHonorsRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		minGap     time.Duration
+		maxGap     time.Duration
+	}{
+		// the backoff delay of a millisecond is used without the header
+		{name: "without header", minGap: 0, maxGap: 500 * time.Millisecond},
+		{name: "with header", retryAfter: "1", minGap: time.Second, maxGap: 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mtx      sync.Mutex
+				requests []time.Time
+			)
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				mtx.Lock()
+				requests = append(requests, time.Now())
+				first := len(requests) == 1
+				mtx.Unlock()
+				if first {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+			}, withFastRetries(), WithRetryMaxDelay(5*time.Second))
+			msg := seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			if len(requests) != 2 {
+				t.Fatalf("webhook is hit %d times, want 2", len(requests))
+			}
+			if gap := requests[1].Sub(requests[0]); gap < tt.minGap || gap > tt.maxGap {
+				t.Errorf("gap between the attempts = %s, want between %s and %s", gap, tt.minGap, tt.maxGap)
+			}
+			got := getMessage(t, db, msg.ID)
+			if got.Status != domain.StatusSuccess || got.RetryCount != 1 {
+				t.Errorf("status = %s, retry count = %d, want success after one retry", got.Status, got.RetryCount)
+			}
+		})
+	}
+}
+
+func TestRetryAfterBeyondMaxDelayLeavesMessageForLaterBatch(t *testing.T) {
+	var requests atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}, withFastRetries())
+	msg := seedMessage(t, db)
+
+	start := time.Now()
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("batch took %s, want it not to wait for the requested delay", elapsed)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("webhook is hit %d times, want 1", n)
+	}
+	got := getMessage(t, db, msg.ID)
+	if got.Status != domain.StatusPending || got.RetryCount != 1 {
+		t.Errorf("status = %s, retry count = %d, want pending with the attempt recorded", got.Status, got.RetryCount)
+	}
+}
+
+func TestSuccessStatusCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		successCodes []int
+		respond      int
+		want         domain.MessageStatus
+	}{
+		{name: "default accepted", respond: http.StatusAccepted, want: domain.StatusSuccess},
+		{name: "configured ok", successCodes: []int{http.StatusOK}, respond: http.StatusOK, want: domain.StatusSuccess},
+		{name: "ok is not configured", respond: http.StatusOK, want: domain.StatusRejected},
+		{name: "accepted is not configured", successCodes: []int{http.StatusOK, http.StatusCreated}, respond: http.StatusAccepted, want: domain.StatusRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.successCodes != nil {
+				opts = append(opts, WithSuccessStatusCodes(tt.successCodes))
+			}
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.respond)
+			}, opts...)
+			msg := seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+			if got := getMessage(t, db, msg.ID).Status; got != tt.want {
+				t.Errorf("status = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuccessStatusCodesMustBe2xx(t *testing.T) {
+	repo := messageRepo.NewMessageRepository(nil, memory.NewMemoryCache(t.Context()))
+	for _, code := range []int{http.StatusMultipleChoices, http.StatusBadRequest, 199} {
+		_, err := NewMessageSenderService(repo, slog.New(slog.DiscardHandler), "http://localhost", nil, 10, time.Hour,
+			WithSuccessStatusCodes([]int{code}))
+		if err == nil {
+			t.Errorf("NewMessageSenderService() with success code %d error = nil, want error", code)
+		}
+	}
+}
+
+func TestProcessingLeaseTTLFloor(t *testing.T) {
+	repo := messageRepo.NewMessageRepository(nil, memory.NewMemoryCache(t.Context()))
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "disabled", opts: []Option{WithProcessingLease(0)}},
+		{name: "below a second", opts: []Option{WithProcessingLease(time.Nanosecond)}, wantErr: true},
+		{name: "below message timeout", opts: []Option{WithProcessingLease(5 * time.Second), WithMessageTimeout(10 * time.Second)}, wantErr: true},
+		{name: "at message timeout", opts: []Option{WithProcessingLease(10 * time.Second), WithMessageTimeout(10 * time.Second)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMessageSenderService(repo, slog.New(slog.DiscardHandler), "http://localhost", nil, 10, time.Hour, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMessageSenderService() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateMessageWithDefaultCountryCode(t *testing.T) {
+	// national numbers are only accepted with a default region to parse them for
+	s, _ := newTestService(t, nil)
+	if _, _, err := s.CreateMessage(domain.Message{Content: "hello", PhoneNumber: "05549998877"}); !errors.Is(err, domain.ErrInvalidPhoneNumber) {
+		t.Errorf("CreateMessage() with national number and no default error = %v, want %v", err, domain.ErrInvalidPhoneNumber)
+	}
+
+	s, _ = newTestService(t, nil, WithDefaultCountryCode("TR"))
+	for _, number := range []string{"05549998877", "554 999 88 77", "+905549998877"} {
+		created, _, err := s.CreateMessage(domain.Message{Content: "hello " + number, PhoneNumber: number})
+		if err != nil {
+			t.Fatalf("CreateMessage() with %q error = %v", number, err)
+		}
+		if created.PhoneNumber != "+905549998877" {
+			t.Errorf("phone number of %q = %q, want %q", number, created.PhoneNumber, "+905549998877")
+		}
+	}
+}
+
+func TestCreateMessageNormalizesPhoneNumber(t *testing.T) {
+	s, _ := newTestService(t, nil)
+
+	created, _, err := s.CreateMessage(domain.Message{Content: "hello", PhoneNumber: "+90 554 999 88 77"})
+	if err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+	if created.PhoneNumber != "+905549998877" {
+		t.Errorf("phone number = %q, want %q", created.PhoneNumber, "+905549998877")
+	}
+
+	_, _, err = s.CreateMessage(domain.Message{Content: "hello", PhoneNumber: "12ab"})
+	if !errors.Is(err, ErrInvalidMessage) || !errors.Is(err, domain.ErrInvalidPhoneNumber) {
+		t.Errorf("CreateMessage() with invalid phone number error = %v, want %v", err, domain.ErrInvalidPhoneNumber)
+	}
+}
+
+func TestInvalidPhoneNumberIsRejectedBeforeSending(t *testing.T) {
+	var requests atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	msg := domain.Message{Content: "hello", PhoneNumber: "12ab", Status: domain.StatusPending}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	if n := requests.Load(); n != 0 {
+		t.Errorf("webhook received %d requests, want 0", n)
+	}
+	got := getMessage(t, db, msg.ID)
+	if got.Status != domain.StatusRejected {
+		t.Errorf("status = %s, want %s", got.Status, domain.StatusRejected)
+	}
+	if got.LastError == nil {
+		t.Error("last error is not set")
+	}
+}
+
+func TestStopDrainsInFlightSend(t *testing.T) {
+	const sendDuration = 200 * time.Millisecond
+
+	started := make(chan struct{})
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(sendDuration)
+		w.WriteHeader(http.StatusAccepted)
+	}, WithDrainTimeout(5*time.Second))
+	msg := seedMessage(t, db)
+
+	s.Start()
+	<-started
+	stopStart := time.Now()
+	stopWithin(t, s, 5*time.Second)
+
+	if elapsed := time.Since(stopStart); elapsed < sendDuration/2 {
+		t.Errorf("Stop() returned after %s, want it to wait for the in-flight send", elapsed)
+	}
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("status = %s, want success since the send is drained", got)
+	}
+}
+
+func TestStopCancelsSendAfterDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}, WithDrainTimeout(50*time.Millisecond))
+	msg := seedMessage(t, db)
+
+	s.Start()
+	<-started
+	stopWithin(t, s, 2*time.Second)
+
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusPending {
+		t.Errorf("status = %s, want pending since the cancelled send is released", got)
+	}
+}
+
+// stallingRepo blocks status updates until their context is done
+type stallingRepo struct {
+	messageRepo.Repository
+}
+
+func (stallingRepo) UpdateStatuses(ctx context.Context, msgs []*domain.Message, status domain.MessageStatus) ([]*domain.Message, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestStopDeadlineBoundsFinalWrites(t *testing.T) {
+	started := make(chan struct{})
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}, WithDrainTimeout(50*time.Millisecond))
+	s.messageRepo = stallingRepo{Repository: s.messageRepo}
+	seedMessage(t, db)
+
+	s.Start()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	stopStart := time.Now()
+	s.Stop(ctx)
+
+	if elapsed := time.Since(stopStart); elapsed >= dbWriteTimeout {
+		t.Errorf("Stop() returned after %s, want the final writes to be cut short by its deadline", elapsed)
+	}
+	select {
+	case <-s.doneChan:
+	case <-time.After(time.Second):
+		t.Error("scheduler did not exit after the deadline of Stop")
+	}
+}
+
+func TestMaxConcurrencyBoundsInFlightSends(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			peak := maxInFlight.Load()
+			if n <= peak || maxInFlight.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	}, WithMaxConcurrency(2))
+	for range 6 {
+		seedMessage(t, db)
+	}
+
+	handled, err := s.TriggerBatch(t.Context())
+	if err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+	if handled != 6 {
+		t.Fatalf("handled %d messages, want 6", handled)
+	}
+	if peak := maxInFlight.Load(); peak > 2 {
+		t.Errorf("webhook saw %d simultaneous requests, want at most 2", peak)
+	}
+}
+
+func TestWebhookRequestSignature(t *testing.T) {
+	for _, secret := range []string{"", "signing-secret"} {
+		var signature atomic.Pointer[[]string]
+		var body atomic.Pointer[[]byte]
+		s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			values := r.Header.Values("X-Signature")
+			body.Store(&b)
+			signature.Store(&values)
+			w.WriteHeader(http.StatusAccepted)
+		}, WithSigningSecret(secret))
+		seedMessage(t, db)
+
+		if _, err := s.TriggerBatch(t.Context()); err != nil {
+			t.Fatalf("TriggerBatch() error = %v", err)
+		}
+
+		got := *signature.Load()
+		if secret == "" {
+			if len(got) != 0 {
+				t.Errorf("X-Signature = %q without a secret, want no header", got)
+			}
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(*body.Load())
+		if want := hex.EncodeToString(mac.Sum(nil)); len(got) != 1 || got[0] != want {
+			t.Errorf("X-Signature = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWebhookHeaders(t *testing.T) {
+	var header atomic.Pointer[http.Header]
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Clone()
+		header.Store(&h)
+		w.WriteHeader(http.StatusAccepted)
+	}, WithWebhookHeaders(map[string]string{
+		"Authorization": "Bearer token",
+		"X-Tenant":      "tenant-1",
+		"X-Request-ID":  "configured",
+	}))
+	seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	got := *header.Load()
+	if v := got.Get("Authorization"); v != "Bearer token" {
+		t.Errorf("Authorization = %q, want %q", v, "Bearer token")
+	}
+	if v := got.Get("X-Tenant"); v != "tenant-1" {
+		t.Errorf("X-Tenant = %q, want %q", v, "tenant-1")
+	}
+	if v := got.Values("X-Request-ID"); len(v) != 1 || v[0] == "configured" {
+		t.Errorf("X-Request-ID = %q, want the generated request id", v)
+	}
+}
+
+func TestWebhookUserAgent(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{name: "default", want: "auto-messenger/1.0"},
+		{name: "custom", opts: []Option{WithUserAgent("acme-notifier/2.3")}, want: "acme-notifier/2.3"},
+		{name: "empty keeps default", opts: []Option{WithUserAgent("")}, want: "auto-messenger/1.0"},
+		// the user agent is reserved, so configured headers can't override it
+		{
+			name: "configured header",
+			opts: []Option{WithWebhookHeaders(map[string]string{"User-Agent": "configured"}), WithUserAgent("acme-notifier/2.3")},
+			want: "acme-notifier/2.3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var userAgent atomic.Pointer[[]string]
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				v := r.Header.Values("User-Agent")
+				userAgent.Store(&v)
+				w.WriteHeader(http.StatusAccepted)
+			}, tt.opts...)
+			seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			if got := *userAgent.Load(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("User-Agent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestIDIsReusedAcrossAttempts(t *testing.T) {
+	var (
+		mtx        sync.Mutex
+		requestIDs = make(map[string][]string)
+	)
+	// the first two attempts of each message fail
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		content := payload["content"]
+		requestIDs[content] = append(requestIDs[content], r.Header.Get("X-Request-ID"))
+		if len(requestIDs[content]) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}, withFastRetries(), WithMaxConcurrency(1))
+	var logs strings.Builder
+	s.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	for _, content := range []string{"first", "second"} {
+		msg := domain.Message{Content: content, PhoneNumber: "+905549998877", Status: domain.StatusPending}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to seed message: %v", err)
+		}
+	}
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	first, second := requestIDs["first"], requestIDs["second"]
+	if len(first) != 3 || len(second) != 3 {
+		t.Fatalf("attempts = %d and %d, want 3 for each message", len(first), len(second))
+	}
+	for _, ids := range [][]string{first, second} {
+		if ids[0] == "" || ids[1] != ids[0] || ids[2] != ids[0] {
+			t.Errorf("request ids of the attempts = %q, want the same id on every attempt", ids)
+		}
+	}
+	if first[0] == second[0] {
+		t.Errorf("both messages are sent with request id %q, want a distinct id per message", first[0])
+	}
+
+	// the logs of the attempts carry the id the provider sees
+	for line := range strings.Lines(logs.String()) {
+		var entry struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"requestId"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("failed to decode log line %q: %v", line, err)
+		}
+		if entry.RequestID != "" && entry.RequestID != first[0] && entry.RequestID != second[0] {
+			t.Errorf("log %q has request id %q, want one of the sent ids", entry.Msg, entry.RequestID)
+		}
+	}
+}
+
+func TestRequestIDIsReusedAcrossFallbackWebhooks(t *testing.T) {
+	var (
+		mtx        sync.Mutex
+		requestIDs []string
+	)
+	record := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			requestIDs = append(requestIDs, r.Header.Get("X-Request-ID"))
+			mtx.Unlock()
+			w.WriteHeader(status)
+		}
+	}
+	fallback := httptest.NewServer(record(http.StatusAccepted))
+	t.Cleanup(fallback.Close)
+	s, db := newTestService(t, record(http.StatusServiceUnavailable), WithFallbackWebhookURLs([]string{fallback.URL}))
+	seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	if len(requestIDs) != 2 || requestIDs[0] == "" || requestIDs[1] != requestIDs[0] {
+		t.Errorf("request ids = %q, want the same id sent to the primary and fallback webhooks", requestIDs)
+	}
+}
+
+// scrapeMetric returns the value of the given unlabelled metric from the /metrics handler
+func scrapeMetric(t *testing.T, name string) float64 {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for line := range strings.Lines(rec.Body.String()) {
+		value, ok := strings.CutPrefix(strings.TrimSpace(line), name+" ")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("failed to parse metric %s value %q: %v", name, value, err)
+		}
+		return v
+	}
+	t.Fatalf("metric %s is not exposed", name)
+	return 0
+}
+
+func TestSendMetrics(t *testing.T) {
+	const (
+		sent    = "auto_messenger_messages_sent_total"
+		failed  = "auto_messenger_messages_failed_total"
+		retried = "auto_messenger_messages_retried_total"
+		latency = "auto_messenger_webhook_request_duration_seconds_count"
+	)
+	sentBefore, failedBefore, retriedBefore := scrapeMetric(t, sent), scrapeMetric(t, failed), scrapeMetric(t, retried)
+	latencyBefore := scrapeMetric(t, latency)
+
+	// the first message fails, is retried and rejected, the second message is sent
+	var hits atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch hits.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}, withFastRetries())
+	seedMessage(t, db)
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+	seedMessage(t, db)
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	if got := scrapeMetric(t, sent) - sentBefore; got != 1 {
+		t.Errorf("%s increased by %v, want 1", sent, got)
+	}
+	if got := scrapeMetric(t, failed) - failedBefore; got != 1 {
+		t.Errorf("%s increased by %v, want 1", failed, got)
+	}
+	if got := scrapeMetric(t, retried) - retriedBefore; got != 1 {
+		t.Errorf("%s increased by %v, want 1", retried, got)
+	}
+	if got := scrapeMetric(t, latency) - latencyBefore; got != 3 {
+		t.Errorf("%s increased by %v, want 3", latency, got)
+	}
+}
+
+func TestGetSentMessagesPages(t *testing.T) {
+	s, db := newTestService(t, nil)
+	for range 5 {
+		msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusSuccess}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to seed message: %v", err)
+		}
+	}
+
+	page, err := s.GetSentMessages(t.Context(), 2, 2)
+	if err != nil {
+		t.Fatalf("GetSentMessages() error = %v", err)
+	}
+	if len(page.Messages) != 2 || page.Total != 5 || page.NextOffset == nil || *page.NextOffset != 4 {
+		t.Errorf("page has %d messages of %d with next offset %v, want 2 of 5 with next offset 4",
+			len(page.Messages), page.Total, page.NextOffset)
+	}
+
+	page, err = s.GetSentMessages(t.Context(), 2, 4)
+	if err != nil {
+		t.Fatalf("GetSentMessages() error = %v", err)
+	}
+	if len(page.Messages) != 1 || page.NextOffset != nil {
+		t.Errorf("last page has %d messages with next offset %v, want 1 without next offset", len(page.Messages), page.NextOffset)
+	}
+}
+
+func TestGetSentMessagesWithCancelledContext(t *testing.T) {
+	s, db := newTestService(t, nil)
+	msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: domain.StatusSuccess}
+	if err := db.Create(&msg).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := s.GetSentMessages(ctx, 10, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetSentMessages() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestStopLeavesNoGoroutines(t *testing.T) {
+	// registered first so it runs after the cleanups of the test server and the database
+	ignoreCurrent := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignoreCurrent) })
+
+	sent := make(chan struct{}, 1)
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		sent <- struct{}{}
+	}, WithDrainTimeout(time.Second))
+	msg := seedMessage(t, db)
+
+	s.Start()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("message is not sent by the initial batch")
+	}
+	stopWithin(t, s, time.Second)
+
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("status = %s, want success", got)
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		delay     time.Duration
+		wantHits  int32
+		want      domain.MessageStatus
+		wantError bool
+	}{
+		{name: "fast webhook", delay: 0, wantHits: 1, want: domain.StatusSuccess},
+		// a timed out request is retried until retries are exhausted
+		{name: "slow webhook", delay: 200 * time.Millisecond, wantHits: 3, want: domain.StatusDeadLetter, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				io.Copy(io.Discard, r.Body)
+				select {
+				case <-time.After(tt.delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+			}, WithWebhookTimeout(50*time.Millisecond), withFastRetries())
+			msg := seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			got := getMessage(t, db, msg.ID)
+			if got.Status != tt.want {
+				t.Errorf("status = %s, want %s", got.Status, tt.want)
+			}
+			if n := hits.Load(); n != tt.wantHits {
+				t.Errorf("webhook received %d requests, want %d", n, tt.wantHits)
+			}
+			if (got.LastError != nil) != tt.wantError {
+				t.Errorf("last error = %v, want error %t", got.LastError, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestLastErrorIsStored(t *testing.T) {
+	tests := []struct {
+		name       string
+		webhook    http.HandlerFunc
+		wantStatus domain.MessageStatus
+		wantError  string
+	}{
+		{
+			name: "client error",
+			webhook: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("invalid phone number\n"))
+			},
+			wantStatus: domain.StatusRejected,
+			wantError:  "webhook responded with status 400: invalid phone number",
+		},
+		{
+			name: "server error",
+			webhook: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			wantStatus: domain.StatusDeadLetter,
+			wantError:  "webhook responded with status 503",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t, tt.webhook, withFastRetries())
+			msg := seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			got := getMessage(t, db, msg.ID)
+			if got.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got.Status, tt.wantStatus)
+			}
+			if got.LastError == nil || *got.LastError != tt.wantError {
+				t.Errorf("last error = %v, want %q", got.LastError, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestTransportErrorIsStored(t *testing.T) {
+	// the webhook is gone, so requests fail before any response
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	db, err := sqlite.Initialize("file::memory:", []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { persistant.Close(db) })
+	s := newTestSender(t, db, srv.URL, withFastRetries())
+	msg := seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	got := getMessage(t, db, msg.ID)
+	if got.Status != domain.StatusDeadLetter {
+		t.Errorf("status = %s, want %s", got.Status, domain.StatusDeadLetter)
+	}
+	if got.LastError == nil || !strings.Contains(*got.LastError, "connection refused") {
+		t.Errorf("last error = %v, want the connection error", got.LastError)
+	}
+
+	// the error is part of the message returned by the api
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	if !strings.Contains(string(data), `"last_error":`) {
+		t.Errorf("message json = %s, want the last error", data)
+	}
+}
+
+func TestCreateMessages(t *testing.T) {
+	tests := []struct {
+		name        string
+		msgs        []domain.Message
+		wantInvalid []int
+	}{
+		{
+			name: "all valid",
+			msgs: []domain.Message{
+				{Content: "first", PhoneNumber: "+905549998877"},
+				{Content: "second", PhoneNumber: "+905549998878"},
+			},
+		},
+		{
+			name: "partially invalid",
+			msgs: []domain.Message{
+				{Content: "first", PhoneNumber: "+905549998877"},
+				{Content: "", PhoneNumber: "+905549998877"},
+				{Content: "third", PhoneNumber: "+905549998879"},
+				{Content: "fourth", PhoneNumber: "12ab"},
+			},
+			wantInvalid: []int{1, 3},
+		},
+		{
+			name: "all invalid",
+			msgs: []domain.Message{
+				{Content: strings.Repeat("a", domain.MaxContentLength+1), PhoneNumber: "+905549998877"},
+			},
+			wantInvalid: []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t, nil)
+
+			results, err := s.CreateMessages(tt.msgs)
+			if err != nil {
+				t.Fatalf("CreateMessages() error = %v", err)
+			}
+			if len(results) != len(tt.msgs) {
+				t.Fatalf("got %d results, want %d", len(results), len(tt.msgs))
+			}
+			for i, result := range results {
+				invalid := slices.Contains(tt.wantInvalid, i)
+				if result.Index != i {
+					t.Errorf("result %d has index %d", i, result.Index)
+				}
+				if invalid && (result.Error == "" || result.ID != 0) {
+					t.Errorf("result %d = %+v, want a validation error", i, result)
+				}
+				if !invalid && (result.Error != "" || result.ID == 0) {
+					t.Errorf("result %d = %+v, want a created message", i, result)
+				}
+			}
+
+			var count int64
+			if err := db.Model(&domain.Message{}).Where("status = ?", domain.StatusPending).Count(&count).Error; err != nil {
+				t.Fatalf("failed to count messages: %v", err)
+			}
+			if want := int64(len(tt.msgs) - len(tt.wantInvalid)); count != want {
+				t.Errorf("%d pending messages are created, want %d", count, want)
+			}
+		})
+	}
+}
+
+func TestCreateMessagesBatchLimit(t *testing.T) {
+	s, db := newTestService(t, nil, WithMaxCreateBatchSize(1))
+
+	msgs := []domain.Message{
+		{Content: "first", PhoneNumber: "+905549998877"},
+		{Content: "second", PhoneNumber: "+905549998877"},
+	}
+	if _, err := s.CreateMessages(msgs); !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("CreateMessages() error = %v, want %v", err, ErrBatchTooLarge)
+	}
+
+	var count int64
+	if err := db.Model(&domain.Message{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("%d messages are created, want 0", count)
+	}
+}
+
+// failingRepo fails to fetch messages, the embedded interface panics for the other methods
+type failingRepo struct {
+	messageRepo.Repository
+}
+
+func (failingRepo) FetchAndLockMessages(ctx context.Context, limit int, maxRetry int) ([]domain.Message, error) {
+	return nil, errors.New("database is unreachable")
+}
+
+func TestFetchFailureIsLoggedWithFields(t *testing.T) {
+	var logs strings.Builder
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	maxRetry := 3
+	s, err := NewMessageSenderService(failingRepo{}, logger, "http://localhost", &maxRetry, 7, time.Hour)
+	if err != nil {
+		t.Fatalf("NewMessageSenderService() error = %v", err)
+	}
+
+	if _, err := s.TriggerBatch(t.Context()); err == nil {
+		t.Fatal("TriggerBatch() error = nil, want the fetch error")
+	}
+
+	var entry struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+		Batch int    `json:"batch"`
+		Error string `json:"error"`
+	}
+	for line := range strings.Lines(logs.String()) {
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("failed to decode log line %q: %v", line, err)
+		}
+		if entry.Msg == "failed to fetch messages" {
+			break
+		}
+	}
+	if entry.Msg != "failed to fetch messages" {
+		t.Fatalf("fetch failure is not logged, logs:\n%s", logs.String())
+	}
+	if entry.Level != "ERROR" || entry.Batch != 7 || entry.Error != "database is unreachable" {
+		t.Errorf("log entry = %+v, want error level with batch 7 and the fetch error", entry)
+	}
+}
+
+func TestStopCancelsInitialBatchPromptly(t *testing.T) {
+	tests := []struct {
+		name    string
+		webhook http.HandlerFunc
+		opts    []Option
+	}{
+		{
+			name: "during request",
+			webhook: func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				<-r.Context().Done()
+			},
+		},
+		{
+			// the failed attempt is followed by a backoff much longer than the test
+			name: "between attempts",
+			webhook: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			opts: []Option{WithRetryBaseDelay(time.Hour), WithRetryMaxDelay(2 * time.Hour)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			started := make(chan struct{}, 1)
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				if hits.Add(1) == 1 {
+					started <- struct{}{}
+				}
+				tt.webhook(w, r)
+			}, tt.opts...)
+			msg := seedMessage(t, db)
+
+			s.Start()
+			<-started
+			stopWithin(t, s, time.Second)
+
+			if n := hits.Load(); n != 1 {
+				t.Errorf("webhook received %d requests, want 1", n)
+			}
+			if got := getMessage(t, db, msg.ID).Status; got != domain.StatusPending {
+				t.Errorf("status = %s, want pending since the cancelled message is released", got)
+			}
+		})
+	}
+}
+
+func TestFallbackWebhookURLs(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryStatus int
+		wantFallback  int32
+		want          domain.MessageStatus
+	}{
+		{name: "primary server error", primaryStatus: http.StatusInternalServerError, wantFallback: 1, want: domain.StatusSuccess},
+		// a client error is the answer of a reachable webhook so it isn't failed over
+		{name: "primary client error", primaryStatus: http.StatusBadRequest, wantFallback: 0, want: domain.StatusRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var primaryHits, fallbackHits atomic.Int32
+			fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fallbackHits.Add(1)
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			t.Cleanup(fallback.Close)
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				primaryHits.Add(1)
+				w.WriteHeader(tt.primaryStatus)
+			}, WithFallbackWebhookURLs([]string{fallback.URL}))
+			msg := seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			if got := getMessage(t, db, msg.ID).Status; got != tt.want {
+				t.Errorf("status = %s, want %s", got, tt.want)
+			}
+			if n := primaryHits.Load(); n != 1 {
+				t.Errorf("primary webhook received %d requests, want 1", n)
+			}
+			if n := fallbackHits.Load(); n != tt.wantFallback {
+				t.Errorf("fallback webhook received %d requests, want %d", n, tt.wantFallback)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 100 * time.Millisecond
+
+	var hits atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}, WithCircuitBreaker(2, cooldown), withFastRetries())
+	msg := seedMessage(t, db)
+
+	// two consecutive failures open the breaker, the third attempt is short-circuited
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("webhook received %d requests, want 2 before the breaker opens", n)
+	}
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusPending {
+		t.Errorf("status = %s, want pending while the breaker is open", got)
+	}
+
+	// batches are skipped while the breaker is open
+	if _, err := s.TriggerBatch(t.Context()); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("TriggerBatch() error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("webhook received %d requests, want none while the breaker is open", n-2)
+	}
+
+	// after the cooldown a trial request is let through and its success closes the breaker
+	down.Store(false)
+	time.Sleep(cooldown + 20*time.Millisecond)
+	if state := s.breaker.State(); state != gobreaker.StateHalfOpen {
+		t.Errorf("breaker state after cooldown = %s, want half-open", state)
+	}
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() after cooldown error = %v", err)
+	}
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("status = %s, want success after the breaker recovers", got)
+	}
+	if state := s.breaker.State(); state != gobreaker.StateClosed {
+		t.Errorf("breaker state = %s, want closed", state)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const (
+		rps      = 20
+		burst    = 2
+		messages = 8
+	)
+
+	var mtx sync.Mutex
+	var timestamps []time.Time
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		timestamps = append(timestamps, time.Now())
+		mtx.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}, WithRateLimit(rps, burst))
+	for range messages {
+		seedMessage(t, db)
+	}
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(timestamps) != messages {
+		t.Fatalf("webhook received %d requests, want %d", len(timestamps), messages)
+	}
+	slices.SortFunc(timestamps, func(a, b time.Time) int { return a.Compare(b) })
+	// after the burst, each request waits for a token to be refilled, allowing for timer slack
+	const tolerance = 10 * time.Millisecond
+	for i := burst; i < messages; i++ {
+		want := time.Duration(i-burst+1) * time.Second / rps
+		if got := timestamps[i].Sub(timestamps[0]); got < want-tolerance {
+			t.Errorf("request %d is sent %s after the first, want at least %s", i+1, got, want)
+		}
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	// the package tracer delegates to the first provider that is set globally
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var header atomic.Pointer[http.Header]
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Clone()
+		header.Store(&h)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	msg := seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	batchSpan, sendSpan, requestSpan := spans["processBatch"], spans["sendMessage"], spans["webhookRequest"]
+	if batchSpan == nil || sendSpan == nil || requestSpan == nil {
+		t.Fatalf("recorded spans = %v, want processBatch, sendMessage and webhookRequest", slices.Collect(maps.Keys(spans)))
+	}
+	if sendSpan.Parent().SpanID() != batchSpan.SpanContext().SpanID() {
+		t.Error("sendMessage is not a child of processBatch")
+	}
+	if requestSpan.Parent().SpanID() != sendSpan.SpanContext().SpanID() {
+		t.Error("webhookRequest is not a child of sendMessage")
+	}
+	if requestSpan.SpanKind() != trace.SpanKindClient {
+		t.Errorf("webhookRequest kind = %s, want client", requestSpan.SpanKind())
+	}
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range append(sendSpan.Attributes(), requestSpan.Attributes()...) {
+		attrs[kv.Key] = kv.Value
+	}
+	got := *header.Load()
+	if v := attrs["message.id"].AsInt64(); v != int64(msg.ID) {
+		t.Errorf("message.id = %d, want %d", v, msg.ID)
+	}
+	if v := attrs["http.request_id"].AsString(); v == "" || v != got.Get("X-Request-ID") {
+		t.Errorf("http.request_id = %q, want the X-Request-ID %q", v, got.Get("X-Request-ID"))
+	}
+	if v := attrs["http.response.status_code"].AsInt64(); v != http.StatusAccepted {
+		t.Errorf("http.response.status_code = %d, want %d", v, http.StatusAccepted)
+	}
+
+	// the webhook receives the context of the request span
+	sc := requestSpan.SpanContext()
+	if want := fmt.Sprintf("00-%s-%s-01", sc.TraceID(), sc.SpanID()); got.Get("traceparent") != want {
+		t.Errorf("traceparent = %q, want %q", got.Get("traceparent"), want)
+	}
+}
+
+func TestExhaustedRetriesDeadLetter(t *testing.T) {
+	tests := []struct {
+		name    string
+		webhook http.HandlerFunc
+	}{
+		{
+			name: "server error",
+			webhook: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		},
+		{
+			name: "transport error",
+			webhook: func(w http.ResponseWriter, r *http.Request) {
+				// drop the connection without a response
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				tt.webhook(w, r)
+			}, withFastRetries())
+			msg := seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			if n := hits.Load(); n != 3 {
+				t.Errorf("webhook received %d requests, want 3", n)
+			}
+			got := getMessage(t, db, msg.ID)
+			if got.Status != domain.StatusDeadLetter {
+				t.Errorf("status = %s, want dead_letter", got.Status)
+			}
+			if got.RetryCount != 3 {
+				t.Errorf("retry count = %d, want 3", got.RetryCount)
+			}
+
+			page, err := s.GetMessagesByStatus(t.Context(), domain.StatusDeadLetter, 10, 0)
+			if err != nil {
+				t.Fatalf("GetMessagesByStatus() error = %v", err)
+			}
+			if len(page.Messages) != 1 || page.Messages[0].ID != msg.ID {
+				t.Errorf("dead lettered messages = %v, want message %d", page.Messages, msg.ID)
+			}
+		})
+	}
+}
+
+func TestGetStatusSummary(t *testing.T) {
+	s, db := newTestService(t, nil)
+	for _, status := range []domain.MessageStatus{domain.StatusPending, domain.StatusSuccess, domain.StatusSuccess, domain.StatusRejected} {
+		msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: status}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to seed message: %v", err)
+		}
+	}
+
+	got, err := s.GetStatusSummary()
+	if err != nil {
+		t.Fatalf("GetStatusSummary() error = %v", err)
+	}
+	// every status is listed by its name, including the ones without messages
+	want := map[string]int64{"pending": 1, "processing": 0, "success": 2, "failed": 0, "dead_letter": 0, "rejected": 1}
+	if !maps.Equal(got, want) {
+		t.Errorf("GetStatusSummary() = %v, want %v", got, want)
+	}
+}
+
+func TestCreateBroadcast(t *testing.T) {
+	s, db := newTestService(t, nil)
+
+	broadcast, err := s.CreateBroadcast("hello", []string{"+905549998871", "+90 554 999 88 72", "+905549998871"}, nil)
+	if err != nil {
+		t.Fatalf("CreateBroadcast() error = %v", err)
+	}
+	// the duplicate number is sent to once
+	if len(broadcast.Messages) != 2 {
+		t.Fatalf("broadcast has %d messages, want 2", len(broadcast.Messages))
+	}
+	for i, want := range []string{"+905549998871", "+905549998872"} {
+		msg := getMessage(t, db, broadcast.Messages[i].ID)
+		if msg.PhoneNumber != want || msg.Content != "hello" || msg.Status != domain.StatusPending {
+			t.Errorf("message %d = %+v, want pending hello to %s", i, msg, want)
+		}
+		if msg.BroadcastID == nil || *msg.BroadcastID != broadcast.BroadcastID {
+			t.Errorf("broadcast id of message %d = %v, want %s", i, msg.BroadcastID, broadcast.BroadcastID)
+		}
+	}
+
+	page, err := s.GetBroadcastMessages(broadcast.BroadcastID, nil, 10, 0)
+	if err != nil {
+		t.Fatalf("GetBroadcastMessages() error = %v", err)
+	}
+	if page.Total != 2 || len(page.Messages) != 2 {
+		t.Errorf("broadcast page has %d of %d messages, want 2 of 2", len(page.Messages), page.Total)
+	}
+
+	// nothing is created if any of the numbers is invalid
+	if _, err := s.CreateBroadcast("hello", []string{"+905549998873", "12ab"}, nil); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("CreateBroadcast() error = %v, want %v", err, ErrInvalidMessage)
+	}
+	var count int64
+	if err := db.Model(&domain.Message{}).Count(&count).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("%d messages exist after the invalid broadcast, want 2", count)
+	}
+}
+
+func TestSaveResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		wantErr        error
+		wantProviderID string
+	}{
+		{name: "empty body", body: ""},
+		{name: "whitespace body", body: " \n"},
+		{name: "valid json", body: `{"messageId":"provider-1","message":"Accepted"}`, wantProviderID: "provider-1"},
+		{name: "json without message id", body: `{"message":"Accepted"}`},
+		{name: "garbage body", body: "<html>Accepted</html>", wantErr: errMalformedResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t, nil)
+			msg := seedMessage(t, db)
+
+			err := s.saveResponse(t.Context(), &msg, io.NopCloser(strings.NewReader(tt.body)))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("saveResponse() error = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("saveResponse() error = %v", err)
+			}
+
+			stored := getMessage(t, db, msg.ID)
+			if got := stored.ProviderMessageID; (got == nil && tt.wantProviderID != "") || (got != nil && *got != tt.wantProviderID) {
+				t.Errorf("provider message id = %v, want %q", got, tt.wantProviderID)
+			}
+			if tt.wantProviderID != "" {
+				if cached, err := s.GetCachedMessage(t.Context(), tt.wantProviderID); err != nil || cached == nil {
+					t.Errorf("GetCachedMessage() = %v, %v, want the cached message", cached, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveResponseSizeLimit(t *testing.T) {
+	const limit = 64
+	body := fmt.Sprintf(`{"messageId":"provider-1","message":"%s"}`, strings.Repeat("a", limit))
+
+	s, db := newTestService(t, nil, WithMaxResponseSize(limit))
+	msg := seedMessage(t, db)
+	if err := s.saveResponse(t.Context(), &msg, io.NopCloser(strings.NewReader(body))); !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("saveResponse() error = %v, want %v", err, errResponseTooLarge)
+	}
+	if got := getMessage(t, db, msg.ID).ProviderMessageID; got != nil {
+		t.Errorf("provider message id = %q, want none from the oversized response", *got)
+	}
+
+	// a body of exactly the limit is decoded
+	body = `{"messageId":"provider-2"}`
+	s, db = newTestService(t, nil, WithMaxResponseSize(int64(len(body))))
+	msg = seedMessage(t, db)
+	if err := s.saveResponse(t.Context(), &msg, io.NopCloser(strings.NewReader(body))); err != nil {
+		t.Fatalf("saveResponse() error = %v", err)
+	}
+	if got := getMessage(t, db, msg.ID).ProviderMessageID; got == nil || *got != "provider-2" {
+		t.Errorf("provider message id = %v, want provider-2", got)
+	}
+}
+
+func TestOversizedResponseStillMarksMessageSent(t *testing.T) {
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		// the body is streamed beyond the limit
+		chunk := []byte(strings.Repeat("a", 1024))
+		for range 64 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}, WithMaxResponseSize(1024))
+	msg := seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+	if got := getMessage(t, db, msg.ID); got.Status != domain.StatusSuccess || got.ProviderMessageID != nil {
+		t.Errorf("message status = %s, provider id = %v, want success without provider id", got.Status, got.ProviderMessageID)
+	}
+}
+
+// fakeLeader is a leader elector whose leadership is set by the test
+type fakeLeader struct {
+	leader atomic.Bool
+}
+
+func (l *fakeLeader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+func TestOnlyLeaderSchedulesBatches(t *testing.T) {
+	var sent atomic.Int32
+	webhook := func(w http.ResponseWriter, r *http.Request) {
+		sent.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}
+	leader, follower := &fakeLeader{}, &fakeLeader{}
+	leader.leader.Store(true)
+	s, db := newTestService(t, webhook, WithLeaderElector(leader))
+	other := newTestSender(t, db, s.webhookURL, WithLeaderElector(follower))
+	msg := seedMessage(t, db)
+
+	if !s.GetStatus().IsLeader || other.GetStatus().IsLeader {
+		t.Fatalf("leader status = %t and %t, want only the first instance as leader", s.GetStatus().IsLeader, other.GetStatus().IsLeader)
+	}
+
+	other.runScheduledBatch(t.Context())
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusPending || sent.Load() != 0 {
+		t.Fatalf("status after the follower's batch = %s with %d sends, want pending without sends", got, sent.Load())
+	}
+
+	// leadership moves to the other instance
+	leader.leader.Store(false)
+	follower.leader.Store(true)
+	s.runScheduledBatch(t.Context())
+	if sent.Load() != 0 {
+		t.Fatalf("former leader sent %d messages, want none", sent.Load())
+	}
+	other.runScheduledBatch(t.Context())
+	if got := getMessage(t, db, msg.ID).Status; got != domain.StatusSuccess || sent.Load() != 1 {
+		t.Errorf("status after the new leader's batch = %s with %d sends, want success with one send", got, sent.Load())
+	}
+}
+
+func TestTriggerBatchDoesNotOverlapRunningBatch(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})
+	seedMessage(t, db)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runScheduledBatch(t.Context())
+	}()
+	<-started
+
+	if _, err := s.TriggerBatch(t.Context()); !errors.Is(err, ErrBatchInProgress) {
+		t.Errorf("TriggerBatch() during a scheduled batch error = %v, want %v", err, ErrBatchInProgress)
+	}
+	close(release)
+	<-done
+
+	if n, err := s.TriggerBatch(t.Context()); err != nil || n != 0 {
+		t.Errorf("TriggerBatch() after the scheduled batch = %d, %v, want 0 messages without error", n, err)
+	}
+}
+
+func TestDedupeWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		window     time.Duration
+		wait       time.Duration
+		wantSends  int32
+		wantSecond domain.MessageStatus
+	}{
+		{name: "duplicate within the window", window: time.Hour, wantSends: 1, wantSecond: domain.StatusRejected},
+		{name: "duplicate after the window", window: 20 * time.Millisecond, wait: 50 * time.Millisecond, wantSends: 2, wantSecond: domain.StatusSuccess},
+		{name: "disabled", wantSends: 2, wantSecond: domain.StatusSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sends atomic.Int32
+			publisher := &recordingPublisher{}
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				sends.Add(1)
+				w.WriteHeader(http.StatusAccepted)
+			}, WithDedupeWindow(tt.window), WithEventPublisher(publisher, "sent"))
+
+			first := seedMessage(t, db)
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+			time.Sleep(tt.wait)
+
+			// the same content is enqueued to the same number again
+			second := seedMessage(t, db)
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			if got := sends.Load(); got != tt.wantSends {
+				t.Errorf("webhook received %d messages, want %d", got, tt.wantSends)
+			}
+			if got := getMessage(t, db, first.ID).Status; got != domain.StatusSuccess {
+				t.Errorf("status of the first message = %s, want success", got)
+			}
+			// a skipped duplicate isn't sent, so it has no sent time or sent event
+			got := getMessage(t, db, second.ID)
+			if got.Status != tt.wantSecond {
+				t.Errorf("status of the second message = %s, want %s", got.Status, tt.wantSecond)
+			}
+			if sent := got.SentAt != nil; sent != (tt.wantSecond == domain.StatusSuccess) {
+				t.Errorf("second message has sent time %t, want %t", sent, !sent)
+			}
+			if tt.wantSecond == domain.StatusRejected && got.LastError == nil {
+				t.Error("last error of the skipped message is not set")
+			}
+			if n := len(publisher.payloads); n != int(tt.wantSends) {
+				t.Errorf("published %d sent events, want %d", n, tt.wantSends)
+			}
+		})
+	}
+}
+
+func TestDedupeWindowDistinguishesRecipients(t *testing.T) {
+	var sends atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		sends.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}, WithDedupeWindow(time.Hour))
+
+	msgs := []domain.Message{
+		{Content: "hello", PhoneNumber: "+905549998871", Status: domain.StatusPending},
+		{Content: "hello", PhoneNumber: "+905549998872", Status: domain.StatusPending},
+		{Content: "other", PhoneNumber: "+905549998871", Status: domain.StatusPending},
+	}
+	for _, msg := range msgs {
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to seed message: %v", err)
+		}
+		if _, err := s.TriggerBatch(t.Context()); err != nil {
+			t.Fatalf("TriggerBatch() error = %v", err)
+		}
+	}
+
+	if got := sends.Load(); got != int32(len(msgs)) {
+		t.Errorf("webhook received %d messages, want %d", got, len(msgs))
+	}
+}
+
+func TestMessageTimeout(t *testing.T) {
+	const slowNumber = "+905549998871"
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), slowNumber) {
+			// hang until the send is cancelled
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}, WithMessageTimeout(50*time.Millisecond))
+	slow := domain.Message{Content: "hello", PhoneNumber: slowNumber, Status: domain.StatusPending}
+	fast := domain.Message{Content: "hello", PhoneNumber: "+905549998872", Status: domain.StatusPending}
+	for _, msg := range []*domain.Message{&slow, &fast} {
+		if err := db.Create(msg).Error; err != nil {
+			t.Fatalf("failed to seed message: %v", err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("batch took %s, want the slow message to be bounded by its timeout", elapsed)
+	}
+
+	got := getMessage(t, db, slow.ID)
+	if got.Status != domain.StatusFailed || got.RetryCount != 1 {
+		t.Errorf("slow message status = %s with %d retries, want failed with 1 retry", got.Status, got.RetryCount)
+	}
+	if got.LastError == nil || !strings.Contains(*got.LastError, "sending timed out") {
+		t.Errorf("last error = %v, want message timeout", got.LastError)
+	}
+	if got := getMessage(t, db, fast.ID).Status; got != domain.StatusSuccess {
+		t.Errorf("fast message status = %s, want success", got)
+	}
+}
+
+func TestProviderMessageIDIsPersisted(t *testing.T) {
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"messageId":"provider-1","message":"Accepted"}`))
+	})
+	msg := seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	// the provider id outlives the cache entry since it is stored on the row
+	got, err := s.GetMessage(msg.ID)
+	if err != nil {
+		t.Fatalf("GetMessage() error = %v", err)
+	}
+	if got.Status != domain.StatusSuccess || got.ProviderMessageID == nil || *got.ProviderMessageID != "provider-1" {
+		t.Errorf("message status = %s, provider id = %v, want success with provider-1", got.Status, got.ProviderMessageID)
+	}
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	if !strings.Contains(string(data), `"provider_message_id":"provider-1"`) {
+		t.Errorf("message json = %s, want the provider message id", data)
+	}
+}
+
+// countingRepo counts the status updates made through the repository
+type countingRepo struct {
+	messageRepo.Repository
+	mtx     sync.Mutex
+	updates []int
+}
+
+func (r *countingRepo) UpdateStatuses(ctx context.Context, msgs []*domain.Message, status domain.MessageStatus) ([]*domain.Message, error) {
+	r.mtx.Lock()
+	r.updates = append(r.updates, len(msgs))
+	r.mtx.Unlock()
+	return r.Repository.UpdateStatuses(ctx, msgs, status)
+}
+
+func TestBatchStatusesAreFlushedInGroups(t *testing.T) {
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "reject") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	repo := &countingRepo{Repository: s.messageRepo}
+	s.messageRepo = repo
+
+	// count the update statements issued against the database during the batch
+	var statements atomic.Int32
+	if err := db.Callback().Update().After("gorm:update").Register("test:count_updates", func(tx *gorm.DB) {
+		if tx.Error == nil {
+			statements.Add(1)
+		}
+	}); err != nil {
+		t.Fatalf("failed to register callback: %v", err)
+	}
+
+	var msgs []domain.Message
+	for i := range 6 {
+		content := "hello"
+		if i%3 == 0 {
+			content = "reject"
+		}
+		msgs = append(msgs, domain.Message{Content: content, PhoneNumber: fmt.Sprintf("+90554999887%d", i), Status: domain.StatusPending})
+	}
+	if err := db.Create(&msgs).Error; err != nil {
+		t.Fatalf("failed to seed messages: %v", err)
+	}
+	statements.Store(0)
+
+	if n, err := s.TriggerBatch(t.Context()); err != nil || n != len(msgs) {
+		t.Fatalf("TriggerBatch() = %d, %v, want %d messages", n, err, len(msgs))
+	}
+
+	// one update for the sent messages and one for the rejected ones instead of one per message
+	slices.Sort(repo.updates)
+	if !slices.Equal(repo.updates, []int{2, 4}) {
+		t.Errorf("status updates of the batch = %v, want [2 4]", repo.updates)
+	}
+	// locking the batch takes a single statement and each rejected message records its failure, the statuses of
+	// each group are set by a single version guarded statement however many messages it has
+	if got, want := statements.Load(), int32(1+2+len(repo.updates)); got != want {
+		t.Errorf("batch issued %d update statements, want %d", got, want)
+	}
+	for _, msg := range msgs {
+		want := domain.StatusSuccess
+		if msg.Content == "reject" {
+			want = domain.StatusRejected
+		}
+		if got := getMessage(t, db, msg.ID).Status; got != want {
+			t.Errorf("status of message %d = %s, want %s", msg.ID, got, want)
+		}
+	}
+}
+
+func TestCancelledSaveIsLoggedAtDebugLevel(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		// the message is accepted, then sending is cancelled while the response body is being read
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"messageId":`))
+		w.(http.Flusher).Flush()
+		// give the client time to receive the headers and block on the rest of the body
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(webhook.Close)
+
+	db, err := sqlite.Initialize("file::memory:", []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { persistant.Close(db) })
+	var logs strings.Builder
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	repo := messageRepo.NewMessageRepository(db, memory.NewMemoryCache(t.Context()))
+	s, err := NewMessageSenderService(repo, logger, webhook.URL, nil, 10, time.Hour)
+	if err != nil {
+		t.Fatalf("NewMessageSenderService() error = %v", err)
+	}
+	seedMessage(t, db)
+
+	s.TriggerBatch(ctx)
+
+	levels := make(map[string]string)
+	for line := range strings.Lines(logs.String()) {
+		var entry struct {
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("failed to decode log line %q: %v", line, err)
+		}
+		levels[entry.Msg] = entry.Level
+	}
+	if got := levels["message response is not saved since sending is cancelled"]; got != "DEBUG" {
+		t.Errorf("level of the cancelled save = %q, want DEBUG, logs:\n%s", got, logs.String())
+	}
+	if _, ok := levels["failed to save message response"]; ok {
+		t.Errorf("cancelled save is logged as an error, logs:\n%s", logs.String())
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	const (
+		sent   = "auto_messenger_messages_sent_total"
+		dryRun = "auto_messenger_messages_dry_run_total"
+	)
+	sentBefore, dryRunBefore := scrapeMetric(t, sent), scrapeMetric(t, dryRun)
+
+	var hits atomic.Int32
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusAccepted)
+	}, WithDryRun(true))
+	msg := seedMessage(t, db)
+
+	if n, err := s.TriggerBatch(t.Context()); err != nil || n != 1 {
+		t.Fatalf("TriggerBatch() = %d, %v, want 1 message", n, err)
+	}
+
+	if got := hits.Load(); got != 0 {
+		t.Errorf("webhook is hit %d times, want none", got)
+	}
+	got := getMessage(t, db, msg.ID)
+	if got.Status != domain.StatusSuccess || got.ProviderMessageID != nil {
+		t.Errorf("message status = %s, provider id = %v, want success without provider id", got.Status, got.ProviderMessageID)
+	}
+	// dry runs are counted apart from the real sends
+	if got := scrapeMetric(t, dryRun) - dryRunBefore; got != 1 {
+		t.Errorf("%s increased by %v, want 1", dryRun, got)
+	}
+	if got := scrapeMetric(t, sent) - sentBefore; got != 0 {
+		t.Errorf("%s increased by %v, want 0", sent, got)
+	}
+}
+
+// batchRecorder reports each batch fetched through the repository
+type batchRecorder struct {
+	messageRepo.Repository
+	batches chan int
+}
+
+func (r *batchRecorder) FetchAndLockMessages(ctx context.Context, limit int, maxRetry int) ([]domain.Message, error) {
+	r.batches <- limit
+	return r.Repository.FetchAndLockMessages(ctx, limit, maxRetry)
+}
+
+// recordBatches makes the service report the limit of each batch it fetches
+func recordBatches(s *service) <-chan int {
+	recorder := &batchRecorder{Repository: s.messageRepo, batches: make(chan int, 10)}
+	s.messageRepo = recorder
+	return recorder.batches
+}
+
+func TestSetInterval(t *testing.T) {
+	s, _ := newTestService(t, nil)
+	batches := recordBatches(s)
+
+	for _, d := range []time.Duration{0, -time.Second, 500 * time.Millisecond, 25 * time.Hour} {
+		if err := s.SetInterval(d); !errors.Is(err, ErrInvalidInterval) {
+			t.Errorf("SetInterval(%s) error = %v, want %v", d, err, ErrInvalidInterval)
+		}
+	}
+
+	s.Start()
+	defer stopWithin(t, s, time.Second)
+	<-batches
+
+	// the scheduler started with an hour interval runs its next batch after the new interval
+	changed := time.Now()
+	if err := s.SetInterval(time.Second); err != nil {
+		t.Fatalf("SetInterval() error = %v", err)
+	}
+	if got := s.GetStatus().SendInterval; got != "1s" {
+		t.Errorf("send interval = %s, want 1s", got)
+	}
+	select {
+	case <-batches:
+		if elapsed := time.Since(changed); elapsed < 900*time.Millisecond {
+			t.Errorf("next batch ran %s after the change, want about a second", elapsed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no batch ran within 3s of changing the interval to 1s")
+	}
+}
+
+func TestSetBatchSize(t *testing.T) {
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	batches := recordBatches(s)
+	for range 5 {
+		seedMessage(t, db)
+	}
+
+	for _, n := range []int{0, -1} {
+		if err := s.SetBatchSize(n); !errors.Is(err, ErrInvalidBatchSize) {
+			t.Errorf("SetBatchSize(%d) error = %v, want %v", n, err, ErrInvalidBatchSize)
+		}
+	}
+
+	if err := s.SetBatchSize(2); err != nil {
+		t.Fatalf("SetBatchSize() error = %v", err)
+	}
+	if got := s.GetStatus().BatchSize; got != 2 {
+		t.Errorf("batch size = %d, want 2", got)
+	}
+
+	// both manual and scheduled batches use the updated size
+	if n, err := s.TriggerBatch(t.Context()); err != nil || n != 2 {
+		t.Errorf("TriggerBatch() = %d, %v, want 2 messages", n, err)
+	}
+	if got := <-batches; got != 2 {
+		t.Errorf("manual batch limit = %d, want 2", got)
+	}
+	s.runScheduledBatch(t.Context())
+	if got := <-batches; got != 2 {
+		t.Errorf("scheduled batch limit = %d, want 2", got)
+	}
+
+	if err := s.SetBatchSize(3); err != nil {
+		t.Fatalf("SetBatchSize() error = %v", err)
+	}
+	s.runScheduledBatch(t.Context())
+	if got := <-batches; got != 3 {
+		t.Errorf("scheduled batch limit after the second change = %d, want 3", got)
+	}
+
+	var pending int64
+	if err := db.Model(&domain.Message{}).Where("status = ?", domain.StatusPending).Count(&pending).Error; err != nil {
+		t.Fatalf("failed to count messages: %v", err)
+	}
+	if pending != 0 {
+		t.Errorf("%d messages are pending, want all 5 sent in batches of 2, 2 and 1", pending)
+	}
+}
+
+func TestWebhookRedirects(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRedirects int
+		hops         int
+		wantStatus   domain.MessageStatus
+		wantDelivery bool
+	}{
+		{name: "not followed by default", hops: 1, wantStatus: domain.StatusRejected},
+		{name: "followed within the limit", maxRedirects: 2, hops: 2, wantStatus: domain.StatusSuccess, wantDelivery: true},
+		{name: "beyond the limit", maxRedirects: 1, hops: 2, wantStatus: domain.StatusRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var delivered atomic.Int32
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if body, _ := io.ReadAll(r.Body); strings.Contains(string(body), "hello") {
+					delivered.Add(1)
+				}
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			t.Cleanup(target.Close)
+
+			// each hop redirects to the next one, the last one to the target
+			next := target.URL
+			for range tt.hops {
+				location := next
+				hop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+				}))
+				t.Cleanup(hop.Close)
+				next = hop.URL
+			}
+
+			db, err := sqlite.Initialize("file::memory:", []any{&domain.Message{}}, true)
+			if err != nil {
+				t.Fatalf("failed to open database: %v", err)
+			}
+			t.Cleanup(func() { persistant.Close(db) })
+			s := newTestSender(t, db, next, WithMaxRedirects(tt.maxRedirects))
+			msg := seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			got := getMessage(t, db, msg.ID)
+			if got.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got.Status, tt.wantStatus)
+			}
+			if (delivered.Load() == 1) != tt.wantDelivery {
+				t.Errorf("target received %d messages, want delivery %t", delivered.Load(), tt.wantDelivery)
+			}
+			if !tt.wantDelivery && (got.LastError == nil || !strings.Contains(*got.LastError, "307")) {
+				t.Errorf("last error = %v, want the redirect status", got.LastError)
+			}
+		})
+	}
+}
+
+func TestNegativeMaxRedirectsIsRejected(t *testing.T) {
+	repo := messageRepo.NewMessageRepository(nil, memory.NewMemoryCache(t.Context()))
+	if _, err := NewMessageSenderService(repo, slog.New(slog.DiscardHandler), "http://localhost", nil, 10, time.Hour, WithMaxRedirects(-1)); err == nil {
+		t.Error("NewMessageSenderService() with negative max redirects error = nil, want error")
+	}
+}
+
+func TestPayloadCompression(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		opt            Option
+		wantCompressed bool
+	}{
+		{name: "large payload", content: strings.Repeat("a", domain.MaxContentLength), opt: WithPayloadCompression(true, 100), wantCompressed: true},
+		{name: "small payload", content: "hello", opt: WithPayloadCompression(true, 100)},
+		{name: "disabled", content: strings.Repeat("a", domain.MaxContentLength), opt: WithPayloadCompression(false, 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type request struct {
+				encoding string
+				payload  map[string]string
+			}
+			requests := make(chan request, 1)
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				body := io.Reader(r.Body)
+				if r.Header.Get("Content-Encoding") == "gzip" {
+					zr, err := gzip.NewReader(r.Body)
+					if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					body = zr
+				}
+				var payload map[string]string
+				if err := json.NewDecoder(body).Decode(&payload); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				requests <- request{encoding: r.Header.Get("Content-Encoding"), payload: payload}
+				w.WriteHeader(http.StatusAccepted)
+			}, tt.opt)
+			msg := domain.Message{Content: tt.content, PhoneNumber: "+905549998877", Status: domain.StatusPending}
+			if err := db.Create(&msg).Error; err != nil {
+				t.Fatalf("failed to seed message: %v", err)
+			}
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+			if got := getMessage(t, db, msg.ID).Status; got != domain.StatusSuccess {
+				t.Fatalf("status = %s, want success", got)
+			}
+
+			req := <-requests
+			if compressed := req.encoding == "gzip"; compressed != tt.wantCompressed {
+				t.Errorf("content encoding = %q, want compressed %t", req.encoding, tt.wantCompressed)
+			}
+			if req.payload["to"] != msg.PhoneNumber || req.payload["content"] != tt.content {
+				t.Errorf("payload = %v, want the message", req.payload)
+			}
+		})
+	}
+}
+
+func TestWebhookConnectionsAreReused(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"messageId":"provider-1","message":"Accepted"}`))
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	db, err := sqlite.Initialize("file::memory:", []any{&domain.Message{}}, true)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { persistant.Close(db) })
+	s := newTestSender(t, db, srv.URL, WithMaxConcurrency(2), WithIdleConns(10, 10, time.Minute))
+
+	// sends of consecutive batches reuse the idle connections of the earlier ones
+	for range 3 {
+		for range 4 {
+			seedMessage(t, db)
+		}
+		if n, err := s.TriggerBatch(t.Context()); err != nil || n != 4 {
+			t.Fatalf("TriggerBatch() = %d, %v, want 4 messages", n, err)
+		}
+	}
+
+	if got := conns.Load(); got > 2 {
+		t.Errorf("webhook accepted %d connections for 12 sends, want at most 2 as many as concurrent sends", got)
+	}
+}
+
+func TestErrorResponseSnippet(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantError string
+	}{
+		{name: "short body", body: "invalid phone\n", wantError: "webhook responded with status 400: invalid phone"},
+		{name: "long body", body: "phone number is not valid", wantError: "webhook responded with status 400: phone number is..."},
+		{name: "body cut in a character", body: "bu numaralar geçersiz", wantError: "webhook responded with status 400: bu numaralar ge..."},
+		{name: "empty body", body: "", wantError: "webhook responded with status 400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(tt.body))
+			}, WithErrorSnippetSize(16))
+			s.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+			msg := seedMessage(t, db)
+
+			if _, err := s.TriggerBatch(t.Context()); err != nil {
+				t.Fatalf("TriggerBatch() error = %v", err)
+			}
+
+			got := getMessage(t, db, msg.ID)
+			if got.LastError == nil || *got.LastError != tt.wantError {
+				t.Errorf("last error = %v, want %q", got.LastError, tt.wantError)
+			}
+			// the snippet is logged along with the status code
+			snippet, _ := strings.CutPrefix(tt.wantError, "webhook responded with status 400")
+			snippet = strings.TrimPrefix(snippet, ": ")
+			wantLog, _ := json.Marshal(snippet)
+			if !strings.Contains(logs.String(), `"body":`+string(wantLog)) {
+				t.Errorf("logs = %s, want the body snippet %s", logs.String(), wantLog)
+			}
+		})
+	}
+}
+
+// countDials counts the connections the sender dials to the webhook
+func countDials(t *testing.T, s *service) *atomic.Int32 {
+	t.Helper()
+
+	transport, ok := s.httpClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport = %T, want *http.Transport", s.httpClient.Transport)
+	}
+	var dials atomic.Int32
+	dialer := &net.Dialer{}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &dials
+}
+
+func TestErrorResponsesAreDrained(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{name: "client error", status: http.StatusBadRequest},
+		{name: "server error", status: http.StatusInternalServerError},
+		{name: "unexpected status", status: http.StatusMultipleChoices},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+				// the body is larger than the transport drains by itself on close, but within the max response size
+				w.WriteHeader(tt.status)
+				w.Write([]byte(strings.Repeat("a", 512<<10)))
+			}, WithMaxConcurrency(1), WithErrorSnippetSize(16), withFastRetries())
+			dials := countDials(t, s)
+
+			for range 10 {
+				seedMessage(t, db)
+			}
+			if n, err := s.TriggerBatch(t.Context()); err != nil || n != 10 {
+				t.Fatalf("TriggerBatch() = %d, %v, want 10 messages", n, err)
+			}
+
+			if got := dials.Load(); got != 1 {
+				t.Errorf("sender dialed %d connections for sequential failed sends, want 1", got)
+			}
+		})
+	}
+}
+
+func TestTemplatedMessageIsRenderedBeforeSending(t *testing.T) {
+	contents := make(chan string, 1)
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		contents <- payload["content"]
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	// templates are validated when the message is created
+	for _, template := range []string{"Hi {{.name", "Hi {{.surname}}"} {
+		msg := domain.Message{Template: template, Variables: map[string]string{"name": "Ada"}, PhoneNumber: "+905549998877"}
+		if _, _, err := s.CreateMessage(msg); !errors.Is(err, ErrInvalidMessage) || !errors.Is(err, domain.ErrInvalidTemplate) {
+			t.Errorf("CreateMessage() with template %q error = %v, want %v", template, err, domain.ErrInvalidTemplate)
+		}
+	}
+
+	created, _, err := s.CreateMessage(domain.Message{Template: "Hi {{.name}}", Variables: map[string]string{"name": "Ada"}, PhoneNumber: "+905549998877"})
+	if err != nil {
+		t.Fatalf("CreateMessage() error = %v", err)
+	}
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	if got := <-contents; got != "Hi Ada" {
+		t.Errorf("sent content = %q, want %q", got, "Hi Ada")
+	}
+	// the stored message keeps its template and variables
+	got := getMessage(t, db, created.ID)
+	if got.Status != domain.StatusSuccess || got.Template != "Hi {{.name}}" || !maps.Equal(got.Variables, map[string]string{"name": "Ada"}) {
+		t.Errorf("stored message = %+v, want success with its template and variables", got)
+	}
+}
+
+// statusChange is a call of the status change hook
+type statusChange struct {
+	id                   int
+	oldStatus, newStatus domain.MessageStatus
+}
+
+func TestStatusChangeHook(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		changes []statusChange
+	)
+	hook := func(msg domain.Message, oldStatus, newStatus domain.MessageStatus) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		changes = append(changes, statusChange{id: msg.ID, oldStatus: oldStatus, newStatus: newStatus})
+	}
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "reject") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}, WithStatusChangeHook(hook))
+
+	sent := seedMessage(t, db)
+	rejected := domain.Message{Content: "reject", PhoneNumber: "+905549998877", Status: domain.StatusPending}
+	if err := db.Create(&rejected).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	slices.SortFunc(changes, func(a, b statusChange) int { return a.id - b.id })
+	want := []statusChange{
+		{id: sent.ID, oldStatus: domain.StatusProcessing, newStatus: domain.StatusSuccess},
+		{id: rejected.ID, oldStatus: domain.StatusProcessing, newStatus: domain.StatusRejected},
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("hook calls = %+v, want %+v", changes, want)
+	}
+}
+
+func TestStatusChangeHookOutsideBatches(t *testing.T) {
+	locked := time.Now().UTC().Add(-time.Hour)
+	tests := []struct {
+		name   string
+		status domain.MessageStatus
+		change func(s *service, msg domain.Message) error
+	}{
+		{name: "requeue", status: domain.StatusFailed, change: func(s *service, msg domain.Message) error {
+			_, err := s.RequeueMessages(domain.StatusFailed)
+			return err
+		}},
+		{name: "resend", status: domain.StatusSuccess, change: func(s *service, msg domain.Message) error {
+			_, err := s.ResendMessage(msg.ID)
+			return err
+		}},
+		{name: "stale recovery", status: domain.StatusProcessing, change: func(s *service, msg domain.Message) error {
+			s.recoverStaleMessages(t.Context())
+			return nil
+		}},
+		{name: "lease recovery", status: domain.StatusProcessing, change: func(s *service, msg domain.Message) error {
+			s.recoverExpiredLeases(t.Context())
+			return nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes []statusChange
+			s, db := newTestService(t, nil, WithStaleMessageTimeout(time.Minute), WithProcessingLease(time.Minute),
+				WithStatusChangeHook(func(msg domain.Message, oldStatus, newStatus domain.MessageStatus) {
+					changes = append(changes, statusChange{id: msg.ID, oldStatus: oldStatus, newStatus: newStatus})
+				}))
+			msg := domain.Message{Content: "hello", PhoneNumber: "+905549998877", Status: tt.status, UpdatedAt: &locked}
+			if err := db.Create(&msg).Error; err != nil {
+				t.Fatalf("failed to seed message: %v", err)
+			}
+
+			if err := tt.change(s, msg); err != nil {
+				t.Fatalf("changing the status error = %v", err)
+			}
+
+			want := []statusChange{{id: msg.ID, oldStatus: tt.status, newStatus: domain.StatusPending}}
+			if !slices.Equal(changes, want) {
+				t.Errorf("hook calls = %+v, want %+v", changes, want)
+			}
+		})
+	}
+}
+
+func TestPanickingStatusChangeHookIsRecovered(t *testing.T) {
+	var logs strings.Builder
+	calls := 0
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}, WithStatusChangeHook(func(msg domain.Message, oldStatus, newStatus domain.MessageStatus) {
+		calls++
+		panic("hook failed")
+	}))
+	s.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	msgs := []domain.Message{seedMessage(t, db), seedMessage(t, db)}
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	// the hook is called for every message and the statuses are persisted regardless of the panics
+	if calls != len(msgs) {
+		t.Errorf("hook is called %d times, want %d", calls, len(msgs))
+	}
+	for _, msg := range msgs {
+		if got := getMessage(t, db, msg.ID); got.Status != domain.StatusSuccess {
+			t.Errorf("message %d status = %s, want %s", msg.ID, got.Status, domain.StatusSuccess)
+		}
+	}
+	if !strings.Contains(logs.String(), "status change hook panicked") {
+		t.Errorf("logs = %s, want the panic logged", logs.String())
+	}
+}
+
+func TestSentEventIsPublished(t *testing.T) {
+	mr := miniredis.RunT(t)
+	publisher, err := redisCache.NewRedisCache(t.Context(), mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("NewRedisCache() error = %v", err)
+	}
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "reject") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"messageId":"provider-1","message":"Accepted"}`))
+	}, WithEventPublisher(publisher, "messages.sent"))
+
+	sub := mr.NewSubscriber()
+	defer sub.Close()
+	sub.Subscribe("messages.sent")
+
+	sent := seedMessage(t, db)
+	rejected := domain.Message{Content: "reject", PhoneNumber: "+905549998877", Status: domain.StatusPending}
+	if err := db.Create(&rejected).Error; err != nil {
+		t.Fatalf("failed to seed message: %v", err)
+	}
+
+	// the subscriber is unbuffered, so publishing blocks the batch until the event is read
+	triggered := make(chan error, 1)
+	go func() {
+		_, err := s.TriggerBatch(t.Context())
+		triggered <- err
+	}()
+
+	var event domain.MessageSentEvent
+	select {
+	case got := <-sub.Messages():
+		if err := json.Unmarshal([]byte(got.Message), &event); err != nil {
+			t.Fatalf("failed to decode event %s: %v", got.Message, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the sent event")
+	}
+	if err := <-triggered; err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	stored := getMessage(t, db, sent.ID)
+	if event.ID != sent.ID || event.ProviderMessageID == nil || *event.ProviderMessageID != "provider-1" {
+		t.Errorf("event = %+v, want message %d with provider-1", event, sent.ID)
+	}
+	if stored.SentAt == nil || !event.SentAt.Equal(*stored.SentAt) {
+		t.Errorf("event sent at = %s, want %v", event.SentAt, stored.SentAt)
+	}
+
+	// only the sent message has an event
+	select {
+	case got := <-sub.Messages():
+		t.Errorf("unexpected event %s", got.Message)
+	default:
+	}
+}
+
+// recordingPublisher records the published payloads
+type recordingPublisher struct {
+	payloads []string
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, channel, payload string) error {
+	p.payloads = append(p.payloads, payload)
+	return nil
+}
+
+func TestSentEventIsNotPublishedWithoutChannel(t *testing.T) {
+	publisher := &recordingPublisher{}
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}, WithEventPublisher(publisher, ""))
+	msg := seedMessage(t, db)
+
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	if got := getMessage(t, db, msg.ID); got.Status != domain.StatusSuccess {
+		t.Fatalf("message status = %s, want %s", got.Status, domain.StatusSuccess)
+	}
+	if len(publisher.payloads) != 0 {
+		t.Errorf("published events = %v, want none without a channel", publisher.payloads)
+	}
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"time"
+
+	"github.com/sony/gobreaker"
+	"golang.org/x/time/rate"
+)
+
+type Option func(s *service)
+
+// WithStaleMessageTimeout sets the duration after which messages stuck in processing are reset to pending
+// when the scheduler starts. Zero disables the recovery.
+func WithStaleMessageTimeout(d time.Duration) Option {
+	return func(s *service) {
+		s.staleTimeout = d
+	}
+}
+
+// WithSuccessStatusCodes sets the webhook response status codes that are treated as a successful send.
+// Default is 202 Accepted.
+func WithSuccessStatusCodes(codes []int) Option {
+	return func(s *service) {
+		if len(codes) > 0 {
+			s.successCodes = codes
+		}
+	}
+}
+
+// WithDrainTimeout sets how long Stop waits for an in-flight batch to complete before cancelling its sends.
+// Zero cancels in-flight sends immediately.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(s *service) {
+		s.drainTimeout = d
+	}
+}
+
+// WithMaxConcurrency sets the maximum number of messages that are sent concurrently within a batch.
+// Zero allows the whole batch to be sent at once.
+func WithMaxConcurrency(n int) Option {
+	return func(s *service) {
+		s.maxConcurrency = n
+	}
+}
+
+// WithSigningSecret sets the secret used to sign webhook request bodies with HMAC-SHA256.
+// The signature is sent hex encoded in the X-Signature header. Empty secret disables signing.
+func WithSigningSecret(secret string) Option {
+	return func(s *service) {
+		s.signingSecret = secret
+	}
+}
+
+// WithWebhookHeaders sets static headers that are added to every webhook request.
+// Headers set by the service itself such as X-Request-ID can't be overridden.
+func WithWebhookHeaders(headers map[string]string) Option {
+	return func(s *service) {
+		s.webhookHeaders = headers
+	}
+}
+
+// WithUserAgent sets the User-Agent header of webhook requests. Default is auto-messenger/1.0.
+func WithUserAgent(userAgent string) Option {
+	return func(s *service) {
+		if userAgent != "" {
+			s.userAgent = userAgent
+		}
+	}
+}
+
+// WithWebhookTimeout sets the timeout of webhook requests. Default is five seconds.
+func WithWebhookTimeout(d time.Duration) Option {
+	return func(s *service) {
+		s.httpClient.Timeout = d
+	}
+}
+
+// WithMaxRedirects sets the number of redirects followed for a webhook request. Default is zero, redirects are
+// not followed and the redirect response is handled as an unexpected status code.
+func WithMaxRedirects(n int) Option {
+	return func(s *service) {
+		s.maxRedirects = n
+	}
+}
+
+// WithIdleConns sets the limits of the idle webhook connections kept alive for reuse. Non-positive values keep
+// the defaults of 100 connections in total, 100 connections per host and 90 seconds of idle time.
+func WithIdleConns(maxIdle, maxIdlePerHost int, idleTimeout time.Duration) Option {
+	return func(s *service) {
+		if maxIdle > 0 {
+			s.maxIdleConns = maxIdle
+		}
+		if maxIdlePerHost > 0 {
+			s.maxIdleConnsPerHost = maxIdlePerHost
+		}
+		if idleTimeout > 0 {
+			s.idleConnTimeout = idleTimeout
+		}
+	}
+}
+
+// WithPayloadCompression enables gzip compression of webhook request bodies of at least minSize bytes.
+// A non-positive minSize keeps the default of 1KB.
+func WithPayloadCompression(enabled bool, minSize int) Option {
+	return func(s *service) {
+		s.compressPayload = enabled
+		if minSize > 0 {
+			s.compressMinSize = minSize
+		}
+	}
+}
+
+// WithErrorSnippetSize sets the number of bytes of an error response body that are logged and stored as the
+// last error of the message. A non-positive size keeps the default of 512 bytes.
+func WithErrorSnippetSize(n int) Option {
+	return func(s *service) {
+		if n > 0 {
+			s.errorSnippetSize = n
+		}
+	}
+}
+
+// WithRetryBaseDelay sets the base delay of the exponential retry backoff. Default is one second.
+func WithRetryBaseDelay(d time.Duration) Option {
+	return func(s *service) {
+		if d > 0 {
+			s.backoff.baseDelay = d
+		}
+	}
+}
+
+// WithRetryMaxDelay sets the maximum delay between retries. Default is 32 seconds.
+// It also caps the delay a provider can request with Retry-After, a message asked to wait longer is left for a later batch.
+func WithRetryMaxDelay(d time.Duration) Option {
+	return func(s *service) {
+		if d > 0 {
+			s.backoff.maxDelay = d
+		}
+	}
+}
+
+// WithRetryMultiplier sets the growth factor of the exponential retry backoff. Default is two.
+func WithRetryMultiplier(m int) Option {
+	return func(s *service) {
+		if m > 0 {
+			s.backoff.multiplier = m
+		}
+	}
+}
+
+// WithRetryJitter enables or disables randomizing retry delays. Jitter is enabled by default.
+// When disabled, each retry waits for the full backoff delay.
+func WithRetryJitter(enabled bool) Option {
+	return func(s *service) {
+		s.backoff.jitter = enabled
+	}
+}
+
+// WithMaxCreateBatchSize sets the maximum number of messages that can be created at once. Zero means no limit.
+func WithMaxCreateBatchSize(n int) Option {
+	return func(s *service) {
+		s.maxCreateBatch = n
+	}
+}
+
+// WithMaxResponseSize sets the maximum number of bytes read from a webhook response body. Defaults to 1MB.
+func WithMaxResponseSize(n int64) Option {
+	return func(s *service) {
+		if n != 0 {
+			s.maxResponseSize = n
+		}
+	}
+}
+
+// WithBatchTimeout sets the maximum time spent on a batch. Sends still in flight when it passes are cancelled
+// and their messages released to pending. Zero disables the timeout.
+func WithBatchTimeout(d time.Duration) Option {
+	return func(s *service) {
+		s.batchTimeout = d
+	}
+}
+
+// WithStatusChangeHook registers a hook that is called after each status change of a message is persisted, whether
+// the message is sent by a batch, requeued, resent or recovered back to pending. Panics of the hook are recovered
+// and logged.
+func WithStatusChangeHook(hook StatusChangeHook) Option {
+	return func(s *service) {
+		s.onStatusChange = hook
+	}
+}
+
+// WithEventPublisher publishes an event to the channel each time a message is sent. An empty channel disables publishing.
+func WithEventPublisher(publisher EventPublisher, channel string) Option {
+	return func(s *service) {
+		s.publisher = publisher
+		s.eventChannel = channel
+	}
+}
+
+// MinProcessingLeaseTTL is the shortest processing lease ttl allowed. The ttl must also be at least the message
+// timeout so a lease can't expire while its message is sent.
+const MinProcessingLeaseTTL = time.Second
+
+// WithProcessingLease records a lease with the given ttl in the cache for each message while it is processed.
+// Leases are renewed while the messages are sent, messages left in processing whose lease is expired are reset
+// to pending before each scheduled batch. Zero disables leases.
+func WithProcessingLease(ttl time.Duration) Option {
+	return func(s *service) {
+		s.leaseTTL = ttl
+	}
+}
+
+// WithDryRun logs the payload of each message instead of sending it to the webhook and marks the message as sent.
+// Dry run sends are counted separately from real sends in the metrics.
+func WithDryRun(enabled bool) Option {
+	return func(s *service) {
+		s.dryRun = enabled
+	}
+}
+
+// WithFallbackWebhookURLs sets webhook urls that are tried in order when the primary webhook
+// is unreachable or responds with a server error.
+func WithFallbackWebhookURLs(urls []string) Option {
+	return func(s *service) {
+		s.fallbackURLs = urls
+	}
+}
+
+// WithCircuitBreaker opens a circuit breaker around webhook requests after the given number of consecutive
+// failures. While open, batches are skipped and messages stay pending until the cooldown passes and a trial
+// request succeeds. Zero failures disables the circuit breaker.
+func WithCircuitBreaker(failures uint32, cooldown time.Duration) Option {
+	return func(s *service) {
+		if failures == 0 {
+			return
+		}
+		s.breaker = gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
+			Name:    "webhook",
+			Timeout: cooldown,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= failures
+			},
+			OnStateChange: func(name string, from, to gobreaker.State) {
+				s.logger.Warn("circuit breaker state changed", "from", from.String(), "to", to.String())
+			},
+		})
+	}
+}
+
+// WithRateLimit limits outbound webhook requests to the given number of requests per second with the given burst.
+// Burst defaults to one if not positive. Zero requests per second disables rate limiting.
+func WithRateLimit(requestsPerSecond float64, burst int) Option {
+	return func(s *service) {
+		if requestsPerSecond <= 0 {
+			return
+		}
+		s.limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), max(burst, 1))
+	}
+}
+
+// WithPayloadTemplate sets the text/template that renders the webhook request body from the message.
+// The "json" function quotes and escapes values, e.g. {"recipient": {{json .PhoneNumber}}, "text": {{json .Content}}}.
+// Default payload is {"to": <phone number>, "content": <content>}.
+func WithPayloadTemplate(text string) Option {
+	return func(s *service) {
+		s.payloadTemplateText = text
+	}
+}
+
+// WithLeaderElector makes the scheduler skip batches unless the elector reports this instance as the leader
+func WithLeaderElector(e LeaderElector) Option {
+	return func(s *service) {
+		s.leader = e
+	}
+}
+
+// WithDedupeWindow skips sending a message if the same content is sent to the same phone number within the window.
+// The message is rejected with the reason instead, it is neither marked as sent nor announced with a sent event.
+// Disabled if zero.
+func WithDedupeWindow(d time.Duration) Option {
+	return func(s *service) {
+		s.dedupeWindow = d
+	}
+}
+
+// WithMessageTimeout bounds the time spent sending a single message, including its retries.
+// A message that times out is counted as a failed attempt and retried in a later batch. Disabled if zero.
+func WithMessageTimeout(d time.Duration) Option {
+	return func(s *service) {
+		s.messageTimeout = d
+	}
+}
+
+// WithDefaultCountryCode sets the region, e.g. "TR", phone numbers without a country code are parsed for.
+// Such numbers are rejected if empty.
+func WithDefaultCountryCode(region string) Option {
+	return func(s *service) {
+		s.defaultRegion = region
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+)
+
+// payloadFuncs are the functions available to payload templates
+var payloadFuncs = template.FuncMap{
+	// json encodes the value as json so strings are quoted and escaped
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// parsePayloadTemplate parses the webhook payload template and verifies it renders valid json
+func parsePayloadTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("payload").Funcs(payloadFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse payload template: %w", err)
+	}
+
+	sample := &domain.Message{ID: 1, Content: "sample \"content\"", PhoneNumber: "+905549998877"}
+	payload, err := renderPayload(tmpl, sample)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(payload) {
+		return nil, fmt.Errorf("payload template doesn't render valid json: %s", payload)
+	}
+
+	return tmpl, nil
+}
+
+// renderPayload creates the webhook request body of the message. If no template is given,
+// the default payload with "to" and "content" fields is used.
+func renderPayload(tmpl *template.Template, msg *domain.Message) ([]byte, error) {
+	if tmpl == nil {
+		return json.Marshal(map[string]string{
+			"to":      msg.PhoneNumber,
+			"content": msg.Content,
+		})
+	}
+
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, msg); err != nil {
+		return nil, fmt.Errorf("failed to render payload template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipPayload compresses the webhook request body
+func gzipPayload(payload []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"text/template"
+
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+)
+
+func TestRenderPayload(t *testing.T) {
+	msg := &domain.Message{ID: 42, Content: `say "hi"`, PhoneNumber: "+905549998877"}
+	tests := []struct {
+		name     string
+		template string
+		want     map[string]any
+	}{
+		{
+			name: "default",
+			want: map[string]any{"to": "+905549998877", "content": `say "hi"`},
+		},
+		{
+			name:     "renamed fields",
+			template: `{"recipient": {{json .PhoneNumber}}, "text": {{json .Content}}}`,
+			want:     map[string]any{"recipient": "+905549998877", "text": `say "hi"`},
+		},
+		{
+			name:     "nested fields",
+			template: `{"message": {"id": {{.ID}}, "to": {{json .PhoneNumber}}, "body": {{json .Content}}}, "channel": "sms"}`,
+			want: map[string]any{
+				"message": map[string]any{"id": float64(42), "to": "+905549998877", "body": `say "hi"`},
+				"channel": "sms",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tmpl *template.Template
+			if tt.template != "" {
+				var err error
+				if tmpl, err = parsePayloadTemplate(tt.template); err != nil {
+					t.Fatalf("parsePayloadTemplate() error = %v", err)
+				}
+			}
+
+			payload, err := renderPayload(tmpl, msg)
+			if err != nil {
+				t.Fatalf("renderPayload() error = %v", err)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(payload, &got); err != nil {
+				t.Fatalf("payload %s is not valid json: %v", payload, err)
+			}
+			// maps are marshaled with sorted keys so equal payloads encode the same
+			if gotJSON, _ := json.Marshal(got); string(gotJSON) != mustMarshal(t, tt.want) {
+				t.Errorf("payload = %s, want %v", payload, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePayloadTemplateRejectsInvalidTemplates(t *testing.T) {
+	for name, text := range map[string]string{
+		"syntax error":  `{"to": {{json .PhoneNumber}`,
+		"unknown field": `{"to": {{json .Recipient}}}`,
+		"invalid json":  `{"to": {{.PhoneNumber}}}`,
+	} {
+		if _, err := parsePayloadTemplate(text); err == nil {
+			t.Errorf("parsePayloadTemplate() with %s error = nil, want error", name)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, v any) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal %v: %v", v, err)
+	}
+	return string(b)
+}
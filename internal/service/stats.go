@@ -0,0 +1,107 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// statsWindow is the longest period the send statistics are kept for
+const statsWindow = time.Hour
+
+// Stats represents the rolling send statistics of this instance
+type Stats struct {
+	SentLastMinute   int64 `json:"sent_last_minute"`
+	SentLastHour     int64 `json:"sent_last_hour"`
+	FailedLastMinute int64 `json:"failed_last_minute"`
+	FailedLastHour   int64 `json:"failed_last_hour"`
+	// SuccessRatio is the ratio of sent messages to sent and failed messages in the last hour, zero if there are none
+	SuccessRatio float64 `json:"success_ratio"`
+	// AvgLatencyMs is the average latency of the webhook requests made in the last hour in milliseconds
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// statsBucket holds the counts of a single second
+type statsBucket struct {
+	second   int64
+	sent     int64
+	failed   int64
+	requests int64
+	latency  time.Duration
+}
+
+// sendStats counts sends in a ring of per second buckets that covers the stats window
+type sendStats struct {
+	mtx     sync.Mutex
+	buckets [int(statsWindow / time.Second)]statsBucket
+	now     func() time.Time
+}
+
+func newSendStats() *sendStats {
+	return &sendStats{now: time.Now}
+}
+
+// bucket returns the bucket of the current second, resetting it if it holds counts of an earlier window.
+// The mutex must be held.
+func (st *sendStats) bucket() *statsBucket {
+	second := st.now().Unix()
+	b := &st.buckets[second%int64(len(st.buckets))]
+	if b.second != second {
+		*b = statsBucket{second: second}
+	}
+	return b
+}
+
+func (st *sendStats) recordSent() {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.bucket().sent++
+}
+
+func (st *sendStats) recordFailed() {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.bucket().failed++
+}
+
+func (st *sendStats) recordRequest(latency time.Duration) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	b := st.bucket()
+	b.requests++
+	b.latency += latency
+}
+
+// snapshot computes the statistics of the buckets within the window
+func (st *sendStats) snapshot() Stats {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+
+	var (
+		stats    Stats
+		requests int64
+		latency  time.Duration
+	)
+	now := st.now().Unix()
+	for _, b := range st.buckets {
+		age := now - b.second
+		if age < 0 || age >= int64(len(st.buckets)) {
+			continue
+		}
+		if age < int64(time.Minute/time.Second) {
+			stats.SentLastMinute += b.sent
+			stats.FailedLastMinute += b.failed
+		}
+		stats.SentLastHour += b.sent
+		stats.FailedLastHour += b.failed
+		requests += b.requests
+		latency += b.latency
+	}
+
+	if total := stats.SentLastHour + stats.FailedLastHour; total > 0 {
+		stats.SuccessRatio = float64(stats.SentLastHour) / float64(total)
+	}
+	if requests > 0 {
+		stats.AvgLatencyMs = float64(latency) / float64(time.Millisecond) / float64(requests)
+	}
+	return stats
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aniladanir/auto-messender-service/internal/domain"
+)
+
+func TestSendStatsWindows(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	st := newSendStats()
+	st.now = func() time.Time { return now }
+
+	// an hour ago, which is outside of the window
+	now = now.Add(-time.Hour)
+	st.recordSent()
+	st.recordRequest(time.Second)
+
+	// half an hour ago
+	now = now.Add(30 * time.Minute)
+	st.recordSent()
+	st.recordFailed()
+	st.recordRequest(100 * time.Millisecond)
+	st.recordRequest(300 * time.Millisecond)
+
+	// within the last minute
+	now = now.Add(30*time.Minute - 10*time.Second)
+	st.recordSent()
+	st.recordSent()
+	st.recordRequest(200 * time.Millisecond)
+	st.recordRequest(200 * time.Millisecond)
+
+	now = now.Add(10 * time.Second)
+	want := Stats{
+		SentLastMinute:   2,
+		SentLastHour:     3,
+		FailedLastMinute: 0,
+		FailedLastHour:   1,
+		SuccessRatio:     0.75,
+		AvgLatencyMs:     200,
+	}
+	if got := st.snapshot(); got != want {
+		t.Errorf("snapshot() = %+v, want %+v", got, want)
+	}
+
+	// the counts leave the window as time passes
+	now = now.Add(time.Hour)
+	if got := st.snapshot(); got != (Stats{}) {
+		t.Errorf("snapshot() an hour later = %+v, want no counts", got)
+	}
+}
+
+func TestSendStatsReuseBuckets(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	st := newSendStats()
+	st.now = func() time.Time { return now }
+
+	st.recordFailed()
+	// the same bucket is used a window later, the earlier counts must not be added to the new ones
+	now = now.Add(statsWindow)
+	st.recordSent()
+
+	want := Stats{SentLastMinute: 1, SentLastHour: 1, SuccessRatio: 1}
+	if got := st.snapshot(); got != want {
+		t.Errorf("snapshot() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	s, db := newTestService(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		time.Sleep(10 * time.Millisecond)
+		if payload["content"] == "invalid" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	if got := s.GetStats(); got != (Stats{}) {
+		t.Errorf("GetStats() before sending = %+v, want no counts", got)
+	}
+
+	for _, content := range []string{"hello", "hello", "hello", "invalid"} {
+		msg := domain.Message{Content: content, PhoneNumber: "+905549998877", Status: domain.StatusPending}
+		if err := db.Create(&msg).Error; err != nil {
+			t.Fatalf("failed to seed message: %v", err)
+		}
+	}
+	if _, err := s.TriggerBatch(t.Context()); err != nil {
+		t.Fatalf("TriggerBatch() error = %v", err)
+	}
+
+	got := s.GetStats()
+	if got.SentLastMinute != 3 || got.SentLastHour != 3 || got.FailedLastMinute != 1 || got.FailedLastHour != 1 {
+		t.Errorf("GetStats() = %+v, want 3 sent and 1 failed", got)
+	}
+	if got.SuccessRatio != 0.75 {
+		t.Errorf("SuccessRatio = %v, want 0.75", got.SuccessRatio)
+	}
+	if got.AvgLatencyMs < 10 {
+		t.Errorf("AvgLatencyMs = %v, want at least the 10ms the webhook takes", got.AvgLatencyMs)
+	}
+}